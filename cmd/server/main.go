@@ -1,10 +1,18 @@
 package main
 
 import (
+    "context"
     "database/sql"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
@@ -13,6 +21,10 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/CVWO/sample-go-app/internal/handlers"
 	"github.com/CVWO/sample-go-app/internal/database"
+	"github.com/CVWO/sample-go-app/internal/jobs"
+	"github.com/CVWO/sample-go-app/internal/mail"
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/CVWO/sample-go-app/internal/search"
 )
 
 func main() {
@@ -56,6 +68,98 @@ func main() {
         log.Fatalf("Failed to initialize database: %v", err)
     }
 
+    // Hard delete soft deleted content once its retention period has passed
+    retentionDays, err := strconv.Atoi(os.Getenv("DELETED_RETENTION_DAYS"))
+    if err != nil || retentionDays <= 0 {
+        retentionDays = 30
+    }
+    retention := time.Duration(retentionDays) * 24 * time.Hour
+    go jobs.Every(context.Background(), time.Hour, "purge deleted content", func(ctx context.Context) error {
+        return jobs.PurgeDeleted(ctx, db, retention)
+    })
+
+    // Without SESSION_SECRET, login tokens are signed with a random secret, so
+    // they stop working on restart and are not accepted by other instances
+    if os.Getenv("SESSION_SECRET") == "" {
+        log.Println("SESSION_SECRET is not set, so users are logged out on restart and tokens only work on this instance")
+    }
+
+    // Log users out this many hours after they log in
+    if hours, err := strconv.Atoi(os.Getenv("SESSION_LIFETIME_HOURS")); err == nil && hours > 0 {
+        handlers.SetSessionLifetime(time.Duration(hours) * time.Hour)
+    }
+
+    // Hide content reported by this many users until a moderator reviews it,
+    // or never when REPORT_HIDE_THRESHOLD=0
+    if threshold, err := strconv.Atoi(os.Getenv("REPORT_HIDE_THRESHOLD")); err == nil && threshold >= 0 {
+        handlers.SetReportHideThreshold(threshold)
+    }
+
+    // Base URLs used in links in emails and feeds
+    links := handlers.Links{API: os.Getenv("PUBLIC_URL"), Frontend: os.Getenv("FRONTEND_URL"), ReplyAddress: os.Getenv("REPLY_ADDRESS")}
+    if links.API == "" {
+        links.API = "http://localhost:10000"
+    }
+    if links.Frontend == "" {
+        links.Frontend = "http://localhost:10001"
+    }
+    handlers.SetLinks(links)
+
+    // Email notifications through the configured mailer, if any
+    var mailer mail.Mailer
+    switch os.Getenv("MAILER") {
+    case "smtp":
+        mailer = mail.NewSMTP(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+    case "file":
+        mailDir := os.Getenv("MAIL_DIR")
+        if mailDir == "" {
+            mailDir = "mail"
+        }
+        mailer, err = mail.NewFileSink(mailDir, os.Getenv("MAIL_FROM"))
+        if err != nil {
+            log.Fatalf("Failed to create mail directory: %v", err)
+        }
+    }
+    if mailer != nil {
+        go jobs.Every(context.Background(), time.Minute, "send notification emails", func(ctx context.Context) error {
+            return handlers.SendNotificationEmails(ctx, db, mailer, links)
+        })
+    }
+
+    // Lift suspensions once they expire
+    go jobs.Every(context.Background(), time.Minute, "lift expired suspensions", func(ctx context.Context) error {
+        return handlers.LiftExpiredSuspensions(ctx, db)
+    })
+
+    // Send queued webhook deliveries
+    go jobs.Every(context.Background(), 10*time.Second, "deliver webhooks", func(ctx context.Context) error {
+        return handlers.DeliverWebhooks(ctx, db)
+    })
+
+    // Search with the database's full-text search, or with an in-process index
+    // when SEARCH_ENGINE=memory
+    if os.Getenv("SEARCH_ENGINE") == "memory" {
+        handlers.SetSearchEngine(search.NewMemory())
+        if err := handlers.ReindexSearch(context.Background(), db); err != nil {
+            log.Fatalf("Failed to build search index: %v", err)
+        }
+    } else {
+        handlers.SetSearchEngine(search.NewPostgres(db))
+    }
+
+    // Deliver realtime events to clients of every instance through the
+    // database, or within this instance only when PUBSUB=memory
+    if os.Getenv("PUBSUB") == "memory" {
+        handlers.SetPubSub(pubsub.NewMemory())
+    } else {
+        events, err := pubsub.NewPostgres(db, dbURL)
+        if err != nil {
+            log.Fatalf("Failed to listen for events: %v", err)
+        }
+        defer events.Close()
+        handlers.SetPubSub(events)
+    }
+
 	// // Open the SQLite database file
     // dbPath := wd + "/internal/database/database.db"
     // // Check if the file exists
@@ -74,8 +178,19 @@ func main() {
     // }
     // defer db.Close()
 
-	// Create the Gin router
-	r := gin.Default()
+	// Create the Gin router, logging requests without their tokens
+	r := gin.New()
+	r.Use(handlers.Logger(), gin.Recovery())
+
+	// Only take client IPs from X-Forwarded-For when the request comes through
+	// one of the proxies in TRUSTED_PROXIES, so they cannot be forged
+	var trustedProxies []string
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -88,37 +203,134 @@ func main() {
 			"http://localhost:10001",
 		},
         AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"},
-        AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+        AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Last-Event-ID"},
         ExposeHeaders:    []string{"Content-Length"},
         AllowCredentials: true,
     }))
 
+	// Resolve the logged-in user from the session token, if any
+	r.Use(handlers.Authenticate())
+	r.Use(handlers.RejectSuspendedWrites(db))
+
 	// Creation endpoints
 	r.POST("/users", func(c *gin.Context) { handlers.CreateUser(c, db) })
-	r.POST("/threads", func(c *gin.Context) { handlers.CreateThread(c, db) })
-	r.POST("/comments", func(c *gin.Context) { handlers.CreateComment(c, db) })
+	r.POST("/threads", handlers.RequireUser(), func(c *gin.Context) { handlers.CreateThread(c, db) })
+	r.POST("/comments", handlers.RequireUser(), func(c *gin.Context) { handlers.CreateComment(c, db) })
 
 	// Listing endpoints
-	r.GET("/threads", func(c *gin.Context) {
-		if tagsQuery := c.Query("tags"); tagsQuery != "" {
-			handlers.GetThreadsByTags(c, db) // Handle filtered query
-		} else {
-			handlers.ListThreads(c, db) // Handle unfiltered query
-		}
-	})
+	r.GET("/search", func(c *gin.Context) { handlers.Search(c, db) })
+	r.GET("/threads/similar", func(c *gin.Context) { handlers.ListSimilarThreads(c, db) })
+	r.GET("/threads", func(c *gin.Context) { handlers.ListThreads(c, db) })
 	r.GET("/comments", func(c *gin.Context) { handlers.ListComments(c, db) })
 	r.GET("/tags", func(c *gin.Context) { handlers.ListTags(c, db) })
+	r.GET("/categories", func(c *gin.Context) { handlers.ListCategories(c, db) })
+	r.GET("/reactions", handlers.ListReactionEmojis)
+	r.GET("/notifications", handlers.RequireUser(), func(c *gin.Context) { handlers.ListNotifications(c, db) })
+	r.GET("/notifications/unread_count", handlers.RequireUser(), func(c *gin.Context) { handlers.CountUnreadNotifications(c, db) })
+	r.GET("/notifications/preferences", handlers.RequireUser(), func(c *gin.Context) { handlers.GetNotificationPreferences(c, db) })
+	r.PUT("/notifications/preferences", handlers.RequireUser(), func(c *gin.Context) { handlers.UpdateNotificationPreferences(c, db) })
+	r.GET("/unsubscribe", func(c *gin.Context) { handlers.Unsubscribe(c, db) })
+	r.POST("/unsubscribe", func(c *gin.Context) { handlers.Unsubscribe(c, db) })
+	r.POST("/notifications/read", handlers.RequireUser(), func(c *gin.Context) { handlers.MarkAllNotificationsRead(c, db) })
+	r.POST("/notifications/:id/read", handlers.RequireUser(), func(c *gin.Context) { handlers.MarkNotificationRead(c, db) })
+
+	// User endpoints
+	r.GET("/users/:id", func(c *gin.Context) { handlers.GetUser(c, db) })
+	r.PUT("/users/:id/block", handlers.RequireUser(), func(c *gin.Context) { handlers.BlockUser(c, db) })
+	r.DELETE("/users/:id/block", handlers.RequireUser(), func(c *gin.Context) { handlers.UnblockUser(c, db) })
+	r.PUT("/users/:id/password", handlers.RequireUser(), func(c *gin.Context) { handlers.SetPassword(c, db) })
 
 	// Login endpoint
 	r.POST("/login", func(c *gin.Context) { handlers.Login(c, db) })
 
 	// Deletion endpoints
-	r.DELETE("/comments/:id", func(c *gin.Context) { handlers.DeleteComment(c, db) })
-	r.DELETE("/threads/:id", func(c *gin.Context) { handlers.DeleteThread(c, db) })
+	r.DELETE("/comments/:id", handlers.RequireUser(), func(c *gin.Context) { handlers.DeleteComment(c, db) })
+	r.DELETE("/threads/:id", handlers.RequireUser(), func(c *gin.Context) { handlers.DeleteThread(c, db) })
 
 	// Update endpoints
-	r.PATCH("/comments/:id", func(c *gin.Context) { handlers.UpdateComment(c, db) })
-	r.PATCH("/threads/:id", func(c *gin.Context) { handlers.UpdateThread(c, db) })
+	r.PATCH("/comments/:id", handlers.RequireUser(), func(c *gin.Context) { handlers.UpdateComment(c, db) })
+	r.PATCH("/threads/:id", handlers.RequireUser(), func(c *gin.Context) { handlers.UpdateThread(c, db) })
+
+	// Tag management endpoints
+	r.POST("/tags", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.CreateTag(c, db) })
+	r.PATCH("/tags/:id", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.UpdateTag(c, db) })
+	r.DELETE("/tags/:id", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.DeleteTag(c, db) })
+	r.POST("/tags/:id/merge", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.MergeTag(c, db) })
+	r.POST("/tags/:id/synonyms", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.AddTagSynonym(c, db) })
+	r.DELETE("/tags/:id/synonyms/:name", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.DeleteTagSynonym(c, db) })
+
+	// Category management endpoints
+	r.POST("/categories", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.CreateCategory(c, db) })
+	r.PATCH("/categories/:id", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.UpdateCategory(c, db) })
+	r.DELETE("/categories/:id", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.DeleteCategory(c, db) })
+
+	// Webhook endpoints
+	r.GET("/webhooks", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.ListWebhooks(c, db) })
+	r.POST("/webhooks", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.CreateWebhook(c, db) })
+	r.PATCH("/webhooks/:id", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.UpdateWebhook(c, db) })
+	r.DELETE("/webhooks/:id", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.DeleteWebhook(c, db) })
+	r.GET("/webhooks/:id/deliveries", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.ListWebhookDeliveries(c, db) })
+	r.POST("/webhooks/:id/deliveries/:deliveryID/redeliver", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.RedeliverWebhook(c, db) })
+
+	// Inbound endpoints for external systems and the mail provider
+	r.POST("/inbound/webhook", func(c *gin.Context) { handlers.InboundWebhook(c, db) })
+	r.POST("/inbound/email", func(c *gin.Context) { handlers.InboundEmail(c, db) })
+
+	// Restore endpoints
+	r.POST("/comments/:id/restore", handlers.RequireModerator(db), func(c *gin.Context) { handlers.RestoreComment(c, db) })
+	r.POST("/threads/:id/restore", handlers.RequireModerator(db), func(c *gin.Context) { handlers.RestoreThread(c, db) })
+
+	// Revision history endpoints
+	r.GET("/comments/:id/revisions", func(c *gin.Context) { handlers.ListCommentRevisions(c, db) })
+	r.GET("/threads/:id/revisions", func(c *gin.Context) { handlers.ListThreadRevisions(c, db) })
+
+	// Reaction endpoints
+	r.POST("/comments/:id/reactions", handlers.RequireUser(), func(c *gin.Context) { handlers.AddReaction(c, db) })
+	r.DELETE("/comments/:id/reactions/:emoji", handlers.RequireUser(), func(c *gin.Context) { handlers.RemoveReaction(c, db) })
+
+	// Subscription and unread tracking endpoints
+	r.PUT("/threads/:id/watch", handlers.RequireUser(), func(c *gin.Context) { handlers.WatchThread(c, db) })
+	r.DELETE("/threads/:id/watch", handlers.RequireUser(), func(c *gin.Context) { handlers.UnwatchThread(c, db) })
+	r.POST("/threads/:id/read", handlers.RequireUser(), func(c *gin.Context) { handlers.MarkThreadRead(c, db) })
+
+	// Direct message endpoints, where only participants can access a conversation
+	r.GET("/conversations", handlers.RequireUser(), func(c *gin.Context) { handlers.ListConversations(c, db) })
+	r.POST("/conversations", handlers.RequireUser(), func(c *gin.Context) { handlers.CreateConversation(c, db) })
+	r.GET("/conversations/unread_count", handlers.RequireUser(), func(c *gin.Context) { handlers.CountUnreadMessages(c, db) })
+	r.GET("/conversations/:id", handlers.RequireParticipant(db), func(c *gin.Context) { handlers.GetConversation(c, db) })
+	r.GET("/conversations/:id/messages", handlers.RequireParticipant(db), func(c *gin.Context) { handlers.ListMessages(c, db) })
+	r.POST("/conversations/:id/messages", handlers.RequireParticipant(db), func(c *gin.Context) { handlers.CreateMessage(c, db) })
+	r.POST("/conversations/:id/read", handlers.RequireParticipant(db), func(c *gin.Context) { handlers.MarkConversationRead(c, db) })
+
+	// Suspension and role endpoints
+	r.GET("/users/:id/suspensions", handlers.RequireModerator(db), func(c *gin.Context) { handlers.ListSuspensions(c, db) })
+	r.PUT("/users/:id/suspension", handlers.RequireModerator(db), func(c *gin.Context) { handlers.SuspendUser(c, db) })
+	r.DELETE("/users/:id/suspension", handlers.RequireModerator(db), func(c *gin.Context) { handlers.LiftSuspension(c, db) })
+	r.PUT("/users/:id/role", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.UpdateUserRole(c, db) })
+
+	// Reporting and moderation queue endpoints
+	r.POST("/reports", handlers.RequireUser(), func(c *gin.Context) { handlers.CreateReport(c, db) })
+	r.GET("/moderation/reports", handlers.RequireModerator(db), func(c *gin.Context) { handlers.ListReportedItems(c, db) })
+	r.GET("/moderation/reports/:id", handlers.RequireModerator(db), func(c *gin.Context) { handlers.GetReportedItem(c, db) })
+	r.POST("/moderation/reports/:id/claim", handlers.RequireModerator(db), func(c *gin.Context) { handlers.ClaimReportedItem(c, db) })
+	r.DELETE("/moderation/reports/:id/claim", handlers.RequireModerator(db), func(c *gin.Context) { handlers.UnclaimReportedItem(c, db) })
+	r.POST("/moderation/reports/:id/resolve", handlers.RequireModerator(db), func(c *gin.Context) { handlers.ResolveReportedItem(c, db) })
+	r.POST("/moderation/reports/:id/notes", handlers.RequireModerator(db), func(c *gin.Context) { handlers.CreateReportNote(c, db) })
+
+	// Moderation log endpoint, where every privileged action is recorded
+	r.GET("/moderation/log", handlers.RequireRole(db, handlers.RoleAdmin), func(c *gin.Context) { handlers.ListModerationLog(c, db) })
+
+	// Real-time endpoints
+	r.GET("/threads/:id/events", func(c *gin.Context) { handlers.StreamThreadEvents(c, db) })
+	r.GET("/ws", func(c *gin.Context) { handlers.ServeWebSocket(c, db) })
+
+	// Feed endpoints
+	r.GET("/feeds/threads.atom", func(c *gin.Context) { handlers.ThreadsFeed(c, db) })
+	r.GET("/feeds/tags/:file", func(c *gin.Context) { handlers.TagFeed(c, db) })
+	r.GET("/feeds/threads/:id/comments.atom", func(c *gin.Context) { handlers.ThreadCommentsFeed(c, db) })
+	r.GET("/feeds/users/:file", func(c *gin.Context) { handlers.UserFeed(c, db) })
+	r.POST("/feeds/token", handlers.RequireUser(), func(c *gin.Context) { handlers.CreateFeedToken(c, db) })
+	r.DELETE("/feeds/token", handlers.RequireUser(), func(c *gin.Context) { handlers.RevokeFeedToken(c, db) })
 
 	// Bind to the port specified by the PORT environment variable
     port := os.Getenv("PORT")
@@ -126,8 +338,29 @@ func main() {
         port = "10000"  // Default Render port
     }
 
+    // Cancel the context of every request on shutdown, which ends event
+    // streams and WebSocket connections
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    server := &http.Server{
+        Addr:        "0.0.0.0:" + port,
+        Handler:     r,
+        BaseContext: func(net.Listener) context.Context { return ctx },
+    }
+
     fmt.Println("Using port:", port)
-    if err := r.Run("0.0.0.0:" + port); err != nil {
-        log.Fatal("Failed to start server:", err)
+    go func() {
+        if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            log.Fatal("Failed to start server:", err)
+        }
+    }()
+
+    // Wait for a shutdown signal, then let in-flight requests finish
+    <-ctx.Done()
+    log.Println("Shutting down server")
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        log.Printf("Failed to shut down server: %v", err)
     }
 }
\ No newline at end of file
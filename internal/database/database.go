@@ -3,6 +3,7 @@ package database
 import (
     "database/sql"
     "fmt"
+    "log"
 )
 
 // Create the database file and initialize the necessary tables and seed data
@@ -40,6 +41,319 @@ func InitializeDatabase(db *sql.DB) error {
         tag_id INT REFERENCES tags(id) ON DELETE CASCADE,
         PRIMARY KEY (thread_id, tag_id)
     );
+
+    CREATE TABLE IF NOT EXISTS comment_reactions (
+        comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+        user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        emoji TEXT NOT NULL,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (comment_id, user_id, emoji)
+    );
+
+    ALTER TABLE comments ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
+
+    ALTER TABLE tags ADD COLUMN IF NOT EXISTS slug TEXT;
+    ALTER TABLE tags ADD COLUMN IF NOT EXISTS colour TEXT NOT NULL DEFAULT '';
+    ALTER TABLE tags ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+    UPDATE tags SET slug = trim(both '-' from regexp_replace(lower(name), '[^a-z0-9]+', '-', 'g')) WHERE slug IS NULL;
+    ALTER TABLE tags ALTER COLUMN slug SET NOT NULL;
+    CREATE UNIQUE INDEX IF NOT EXISTS tags_slug_idx ON tags (slug);
+    ALTER TABLE tags ADD COLUMN IF NOT EXISTS parent_id INT REFERENCES tags(id) ON DELETE SET NULL;
+
+    CREATE TABLE IF NOT EXISTS tag_synonyms (
+        name TEXT PRIMARY KEY,
+        tag_id INT NOT NULL REFERENCES tags(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS categories (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        slug TEXT UNIQUE NOT NULL,
+        description TEXT NOT NULL DEFAULT '',
+        position INT NOT NULL DEFAULT 0,
+        read_role TEXT NOT NULL DEFAULT 'guest',
+        post_role TEXT NOT NULL DEFAULT 'guest'
+    );
+
+    -- Existing threads are moved into a default category on first run
+    INSERT INTO categories (name, slug, description)
+    SELECT 'General', 'general', 'General discussion'
+    WHERE NOT EXISTS (SELECT 1 FROM categories);
+
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS category_id INT REFERENCES categories(id);
+    UPDATE threads SET category_id = (SELECT id FROM categories ORDER BY position, id LIMIT 1) WHERE category_id IS NULL;
+    ALTER TABLE threads ALTER COLUMN category_id SET NOT NULL;
+    CREATE INDEX IF NOT EXISTS threads_category_idx ON threads (category_id);
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+    ALTER TABLE comments ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+    ALTER TABLE comments ADD COLUMN IF NOT EXISTS deleted_by INT REFERENCES users(id);
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS deleted_by INT REFERENCES users(id);
+
+    CREATE TABLE IF NOT EXISTS user_blocks (
+        user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        blocked_user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, blocked_user_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS mentions (
+        id SERIAL PRIMARY KEY,
+        thread_id INT NOT NULL REFERENCES threads(id) ON DELETE CASCADE,
+        comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        author_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS mentions_thread_comment_idx ON mentions (thread_id, comment_id);
+
+    CREATE TABLE IF NOT EXISTS comment_quotes (
+        comment_id INT PRIMARY KEY REFERENCES comments(id) ON DELETE CASCADE,
+        source_comment_id INT REFERENCES comments(id) ON DELETE SET NULL,
+        start_offset INT NOT NULL,
+        end_offset INT NOT NULL,
+        quoted_text TEXT NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS notifications (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        type TEXT NOT NULL,
+        actor_id INT REFERENCES users(id) ON DELETE SET NULL,
+        thread_id INT REFERENCES threads(id) ON DELETE CASCADE,
+        comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+        read_at TIMESTAMPTZ,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, id);
+
+    CREATE TABLE IF NOT EXISTS comment_revisions (
+        id SERIAL PRIMARY KEY,
+        comment_id INT NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+        text TEXT NOT NULL,
+        edited_by INT REFERENCES users(id),
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS thread_revisions (
+        id SERIAL PRIMARY KEY,
+        thread_id INT NOT NULL REFERENCES threads(id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        edited_by INT REFERENCES users(id),
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+    UPDATE threads SET created_at = COALESCE((SELECT MIN(created_at) FROM comments WHERE comments.thread_id = threads.id), CURRENT_TIMESTAMP) WHERE created_at IS NULL;
+    ALTER TABLE threads ALTER COLUMN created_at SET DEFAULT CURRENT_TIMESTAMP;
+
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('english', name)) STORED;
+    ALTER TABLE comments ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('english', text)) STORED;
+    CREATE INDEX IF NOT EXISTS threads_search_idx ON threads USING GIN (search_vector);
+    CREATE INDEX IF NOT EXISTS comments_search_idx ON comments USING GIN (search_vector);
+
+    -- watching is NULL until the user watches or unwatches the thread
+    CREATE TABLE IF NOT EXISTS thread_subscriptions (
+        user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        thread_id INT REFERENCES threads(id) ON DELETE CASCADE,
+        watching BOOLEAN,
+        last_read_comment_id INT,
+        PRIMARY KEY (user_id, thread_id)
+    );
+    CREATE INDEX IF NOT EXISTS thread_subscriptions_thread_idx ON thread_subscriptions (thread_id) WHERE watching;
+    CREATE INDEX IF NOT EXISTS comments_thread_idx ON comments (thread_id, id);
+
+    ALTER TABLE notifications ADD COLUMN IF NOT EXISTS detail TEXT NOT NULL DEFAULT '';
+    ALTER TABLE notifications ADD COLUMN IF NOT EXISTS count INT NOT NULL DEFAULT 1;
+    CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id, thread_id) WHERE read_at IS NULL;
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+    ALTER TABLE notifications ADD COLUMN IF NOT EXISTS emailed_at TIMESTAMPTZ;
+
+    CREATE TABLE IF NOT EXISTS notification_preferences (
+        user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        type TEXT NOT NULL,
+        delivery TEXT NOT NULL,
+        PRIMARY KEY (user_id, type)
+    );
+
+    CREATE TABLE IF NOT EXISTS notification_digests (
+        user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        frequency TEXT NOT NULL,
+        sent_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, frequency)
+    );
+
+    CREATE TABLE IF NOT EXISTS webhooks (
+        id SERIAL PRIMARY KEY,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        event_types TEXT[] NOT NULL,
+        tag_ids INT[] NOT NULL DEFAULT '{}',
+        active BOOLEAN NOT NULL DEFAULT TRUE,
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+
+    -- next_attempt_at is NULL once a delivery succeeded or failed for good
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id SERIAL PRIMARY KEY,
+        webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+        event_type TEXT NOT NULL,
+        payload JSONB NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending',
+        attempts INT NOT NULL DEFAULT 0,
+        last_status_code INT,
+        last_error TEXT,
+        next_attempt_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        delivered_at TIMESTAMPTZ
+    );
+    CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+    CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id);
+
+    -- last_message_id orders conversations by their latest message
+    CREATE TABLE IF NOT EXISTS conversations (
+        id SERIAL PRIMARY KEY,
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        last_message_id INT,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS conversation_participants (
+        conversation_id INT REFERENCES conversations(id) ON DELETE CASCADE,
+        user_id INT REFERENCES users(id) ON DELETE CASCADE,
+        last_read_message_id INT,
+        joined_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (conversation_id, user_id)
+    );
+    CREATE INDEX IF NOT EXISTS conversation_participants_user_idx ON conversation_participants (user_id);
+
+    CREATE TABLE IF NOT EXISTS direct_messages (
+        id SERIAL PRIMARY KEY,
+        conversation_id INT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+        user_id INT REFERENCES users(id) ON DELETE SET NULL,
+        text TEXT NOT NULL,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS direct_messages_conversation_idx ON direct_messages (conversation_id, id);
+
+    -- Content that passed the report threshold is hidden until a moderator reviews it
+    ALTER TABLE threads ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMPTZ;
+    ALTER TABLE comments ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMPTZ;
+
+    -- Reports are grouped by the thread or comment they are about. An item
+    -- stays open until a moderator resolves it, and later reports of the same
+    -- content open a new item.
+    CREATE TABLE IF NOT EXISTS reported_items (
+        id SERIAL PRIMARY KEY,
+        thread_id INT NOT NULL REFERENCES threads(id) ON DELETE CASCADE,
+        comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+        author_id INT REFERENCES users(id) ON DELETE SET NULL,
+        status TEXT NOT NULL DEFAULT 'open',
+        resolution TEXT,
+        claimed_by INT REFERENCES users(id) ON DELETE SET NULL,
+        claimed_at TIMESTAMPTZ,
+        resolved_by INT REFERENCES users(id) ON DELETE SET NULL,
+        resolved_at TIMESTAMPTZ,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS reported_items_open_idx ON reported_items (thread_id, COALESCE(comment_id, 0)) WHERE status = 'open';
+
+    CREATE TABLE IF NOT EXISTS reports (
+        id SERIAL PRIMARY KEY,
+        item_id INT NOT NULL REFERENCES reported_items(id) ON DELETE CASCADE,
+        reporter_id INT REFERENCES users(id) ON DELETE CASCADE,
+        reason TEXT NOT NULL,
+        details TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (item_id, reporter_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS report_notes (
+        id SERIAL PRIMARY KEY,
+        item_id INT NOT NULL REFERENCES reported_items(id) ON DELETE CASCADE,
+        user_id INT REFERENCES users(id) ON DELETE SET NULL,
+        text TEXT NOT NULL,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+
+    -- A suspension without expires_at is a permanent ban. Users have at most one
+    -- active suspension, which stays active until it is lifted, early by a
+    -- moderator or once it expires by the job lifting expired suspensions.
+    CREATE TABLE IF NOT EXISTS user_suspensions (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        reason TEXT NOT NULL,
+        expires_at TIMESTAMPTZ,
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        lifted_at TIMESTAMPTZ,
+        lifted_by INT REFERENCES users(id) ON DELETE SET NULL
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS user_suspensions_active_idx ON user_suspensions (user_id) WHERE lifted_at IS NULL;
+    CREATE INDEX IF NOT EXISTS user_suspensions_expiry_idx ON user_suspensions (expires_at) WHERE lifted_at IS NULL;
+
+    -- Append-only record of moderation actions. A NULL actor_id means the
+    -- action was taken automatically.
+    CREATE TABLE IF NOT EXISTS moderation_log (
+        id SERIAL PRIMARY KEY,
+        actor_id INT REFERENCES users(id) ON DELETE SET NULL,
+        action TEXT NOT NULL,
+        target_user_id INT REFERENCES users(id) ON DELETE SET NULL,
+        reason TEXT NOT NULL DEFAULT '',
+        details JSONB NOT NULL DEFAULT '{}',
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
+
+    -- Every privileged action is logged with its target, the target's row before
+    -- and after the change, and the IP address of the actor. Entries logged
+    -- before targets were recorded are about their target user.
+    ALTER TABLE moderation_log ADD COLUMN IF NOT EXISTS target_type TEXT NOT NULL DEFAULT '';
+    ALTER TABLE moderation_log ADD COLUMN IF NOT EXISTS target_id INT;
+    ALTER TABLE moderation_log ADD COLUMN IF NOT EXISTS before JSONB;
+    ALTER TABLE moderation_log ADD COLUMN IF NOT EXISTS after JSONB;
+    ALTER TABLE moderation_log ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '';
+    UPDATE moderation_log SET target_type = 'user', target_id = target_user_id WHERE target_type = '' AND target_user_id IS NOT NULL;
+    CREATE INDEX IF NOT EXISTS moderation_log_actor_idx ON moderation_log (actor_id, id);
+    CREATE INDEX IF NOT EXISTS moderation_log_target_idx ON moderation_log (target_type, target_id, id);
+    CREATE INDEX IF NOT EXISTS moderation_log_target_user_idx ON moderation_log (target_user_id, id);
+
+    -- Keep the moderation log append-only. The only change allowed is clearing
+    -- the references to a user when they are deleted.
+    CREATE OR REPLACE FUNCTION reject_moderation_log_change() RETURNS trigger AS $$
+    BEGIN
+        IF TG_OP = 'UPDATE'
+            AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+            AND (NEW.target_user_id IS NULL OR NEW.target_user_id = OLD.target_user_id)
+            AND to_jsonb(NEW) - ARRAY['actor_id', 'target_user_id'] = to_jsonb(OLD) - ARRAY['actor_id', 'target_user_id'] THEN
+            RETURN NEW;
+        END IF;
+        RAISE EXCEPTION 'moderation_log is append-only';
+    END;
+    $$ LANGUAGE plpgsql;
+    DROP TRIGGER IF EXISTS moderation_log_append_only ON moderation_log;
+    CREATE TRIGGER moderation_log_append_only BEFORE UPDATE OR DELETE ON moderation_log
+        FOR EACH ROW EXECUTE FUNCTION reject_moderation_log_change();
+    DROP TRIGGER IF EXISTS moderation_log_no_truncate ON moderation_log;
+    CREATE TRIGGER moderation_log_no_truncate BEFORE TRUNCATE ON moderation_log
+        FOR EACH STATEMENT EXECUTE FUNCTION reject_moderation_log_change();
+
+    -- Users log in with a password, stored as a bcrypt hash. Accounts created
+    -- before passwords were required have none and cannot log in until one is set.
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+
+    -- Read-only tokens for feed readers, which cannot log in. Only a hash of
+    -- the token is stored, and users have at most one, which they can rotate
+    -- or revoke at any time.
+    CREATE TABLE IF NOT EXISTS feed_tokens (
+        user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+        token_hash TEXT NOT NULL UNIQUE,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    );
     `
 
     _, err := db.Exec(tableSQL)
@@ -47,14 +361,28 @@ func InitializeDatabase(db *sql.DB) error {
         return fmt.Errorf("failed to create tables: %v", err)
     }
 
-    // Seed tags
+    // Index thread names by trigrams to find similar threads. Creating the
+    // pg_trgm extension needs a role allowed to create extensions, so if it
+    // cannot be created the server starts without suggesting similar threads.
+    trigramSQL := `
+    CREATE EXTENSION IF NOT EXISTS pg_trgm;
+    CREATE INDEX IF NOT EXISTS threads_name_trgm_idx ON threads USING GIN (name gin_trgm_ops);
+    `
+    _, err = db.Exec(trigramSQL)
+    if err != nil {
+        log.Printf("Similar threads are disabled, as the pg_trgm extension could not be created: %v", err)
+    }
+
+    // Seed the default tags on first run only, so tags deleted by admins stay deleted
     seedTagsSQL := `
-    INSERT INTO tags (name) VALUES
-    ('School'),
-    ('Work'),
-    ('Interests and Hobbies'),
-    ('Miscellaneous')
-    ON CONFLICT (name) DO NOTHING;
+    INSERT INTO tags (name, slug)
+    SELECT name, slug FROM (VALUES
+        ('School', 'school'),
+        ('Work', 'work'),
+        ('Interests and Hobbies', 'interests-and-hobbies'),
+        ('Miscellaneous', 'miscellaneous')
+    ) AS defaults (name, slug)
+    WHERE NOT EXISTS (SELECT 1 FROM tags);
     `
     _, err = db.Exec(seedTagsSQL)
     if err != nil {
@@ -0,0 +1,174 @@
+// Package diff computes line and word level differences between two texts.
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Insert Op = "insert"
+	Delete Op = "delete"
+)
+
+// A single run of text that is equal, inserted or deleted
+type Edit struct {
+	Op   Op     `json:"op"`
+	Text string `json:"text"`
+}
+
+// Largest LCS table computed before falling back to replacing the whole text
+const maxTableSize = 4000000
+
+// Compute the edits turning a into b using the longest common subsequence
+func compute(a, b []string) []Edit {
+	if len(a)*len(b) > maxTableSize {
+		var edits []Edit
+		for _, token := range a {
+			edits = append(edits, Edit{Delete, token})
+		}
+		for _, token := range b {
+			edits = append(edits, Edit{Insert, token})
+		}
+		return edits
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk the table, preferring deletions before insertions
+	var edits []Edit
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			edits = append(edits, Edit{Equal, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, Edit{Delete, a[i]})
+			i++
+		default:
+			edits = append(edits, Edit{Insert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		edits = append(edits, Edit{Delete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, Edit{Insert, b[j]})
+	}
+	return edits
+}
+
+// Split text into words and the whitespace between them
+func splitWords(text string) []string {
+	var tokens []string
+	start := 0
+	prevSpace := false
+	for i, r := range text {
+		space := unicode.IsSpace(r)
+		if i > start && space != prevSpace {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		prevSpace = space
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// Words returns a word level diff of a and b, merging adjacent edits of the same kind
+func Words(a, b string) []Edit {
+	var merged []Edit
+	for _, edit := range compute(splitWords(a), splitWords(b)) {
+		if n := len(merged); n > 0 && merged[n-1].Op == edit.Op {
+			merged[n-1].Text += edit.Text
+			continue
+		}
+		merged = append(merged, edit)
+	}
+	return merged
+}
+
+// Unified returns a line diff of a and b in unified format with the given lines of context
+func Unified(a, b string, context int) string {
+	aLines := strings.Split(a, "\n")
+	bLines := strings.Split(b, "\n")
+	edits := compute(aLines, bLines)
+
+	// Find the edits that change something
+	var changed []int
+	for i, edit := range edits {
+		if edit.Op != Equal {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString("--- a\n+++ b\n")
+
+	// Group changes that are close together into hunks
+	for h := 0; h < len(changed); {
+		first := max(changed[h]-context, 0)
+		last := changed[h]
+		for h++; h < len(changed) && changed[h]-last <= 2*context+1; h++ {
+			last = changed[h]
+		}
+		last = min(last+context, len(edits)-1)
+
+		// Work out the line numbers where the hunk starts in each text
+		aStart, bStart := 1, 1
+		for _, edit := range edits[:first] {
+			if edit.Op != Insert {
+				aStart++
+			}
+			if edit.Op != Delete {
+				bStart++
+			}
+		}
+
+		var body strings.Builder
+		aCount, bCount := 0, 0
+		for _, edit := range edits[first : last+1] {
+			switch edit.Op {
+			case Equal:
+				body.WriteString(" " + edit.Text + "\n")
+				aCount++
+				bCount++
+			case Delete:
+				body.WriteString("-" + edit.Text + "\n")
+				aCount++
+			case Insert:
+				body.WriteString("+" + edit.Text + "\n")
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		out.WriteString(body.String())
+	}
+	return out.String()
+}
@@ -0,0 +1,144 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Edit
+	}{
+		{
+			name: "identical",
+			a:    "hello world",
+			b:    "hello world",
+			want: []Edit{{Equal, "hello world"}},
+		},
+		{
+			name: "both empty",
+			a:    "",
+			b:    "",
+			want: nil,
+		},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "new text",
+			want: []Edit{{Insert, "new text"}},
+		},
+		{
+			name: "to empty",
+			a:    "old text",
+			b:    "",
+			want: []Edit{{Delete, "old text"}},
+		},
+		{
+			name: "replaced word",
+			a:    "the quick fox",
+			b:    "the slow fox",
+			want: []Edit{{Equal, "the "}, {Delete, "quick"}, {Insert, "slow"}, {Equal, " fox"}},
+		},
+		{
+			name: "appended words",
+			a:    "hello",
+			b:    "hello there world",
+			want: []Edit{{Equal, "hello"}, {Insert, " there world"}},
+		},
+		{
+			name: "changed whitespace",
+			a:    "a b",
+			b:    "a  b",
+			want: []Edit{{Equal, "a"}, {Delete, " "}, {Insert, "  "}, {Equal, "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Words(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Words(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name:    "identical",
+			a:       "one\ntwo",
+			b:       "one\ntwo",
+			context: 3,
+			want:    "",
+		},
+		{
+			name:    "changed line",
+			a:       "one\ntwo\nthree",
+			b:       "one\n2\nthree",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n",
+		},
+		{
+			name:    "no context",
+			a:       "one\ntwo\nthree",
+			b:       "one\ntwo\n3",
+			context: 0,
+			want:    "--- a\n+++ b\n@@ -3,1 +3,1 @@\n-three\n+3\n",
+		},
+		{
+			name:    "inserted line",
+			a:       "one\nthree",
+			b:       "one\ntwo\nthree",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,2 +1,3 @@\n one\n+two\n three\n",
+		},
+		{
+			name:    "separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7",
+			b:       "one\n2\n3\n4\n5\n6\nseven",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-1\n+one\n 2\n@@ -6,2 +6,2 @@\n 6\n-7\n+seven\n",
+		},
+		{
+			name:    "close changes share a hunk",
+			a:       "1\n2\n3\n4",
+			b:       "one\n2\n3\nfour",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n-4\n+four\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified(tt.a, tt.b, tt.context); got != tt.want {
+				t.Errorf("Unified(%q, %q, %d) =\n%s\nwant\n%s", tt.a, tt.b, tt.context, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeFallsBackOnLargeInputs(t *testing.T) {
+	a := make([]string, 2001)
+	b := make([]string, 2001)
+	for i := range a {
+		a[i], b[i] = "same", "same"
+	}
+	edits := compute(a, b)
+	if len(edits) != len(a)+len(b) {
+		t.Fatalf("got %d edits, want %d", len(edits), len(a)+len(b))
+	}
+	for i, edit := range edits {
+		want := Delete
+		if i >= len(a) {
+			want = Insert
+		}
+		if edit.Op != want {
+			t.Fatalf("edit %d is %s, want %s", i, edit.Op, want)
+		}
+	}
+}
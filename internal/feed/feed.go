@@ -0,0 +1,187 @@
+// Package feed writes Atom and RSS feeds.
+package feed
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// A feed and its entries, newest first
+type Feed struct {
+	Title       string
+	Description string
+	Link        string // Page the feed is about
+	Self        string // URL of the feed itself
+	Updated     time.Time
+	Entries     []Entry
+}
+
+type Entry struct {
+	ID         string
+	Title      string
+	Link       string
+	Author     string
+	Published  time.Time
+	Updated    time.Time
+	HTML       string // Content, as HTML
+	Categories []string
+}
+
+// Set the feed's updated time to that of its latest entry, or to the given
+// time if it has no entries
+func (f *Feed) SetUpdated(fallback time.Time) {
+	f.Updated = fallback
+	for i, entry := range f.Entries {
+		if i == 0 || entry.Updated.After(f.Updated) {
+			f.Updated = entry.Updated
+		}
+	}
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      atomText       `xml:"title"`
+	Link       atomLink       `xml:"link"`
+	Author     *atomAuthor    `xml:"author,omitempty"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Content    atomText       `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    atomText    `xml:"title"`
+	Subtitle *atomText   `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+// Write a feed as Atom
+func Atom(f Feed) ([]byte, error) {
+	out := atomFeed{
+		ID:      f.Self,
+		Title:   atomText{Type: "text", Text: f.Title},
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.Self},
+			{Rel: "alternate", Type: "text/html", Href: f.Link},
+		},
+	}
+	if f.Description != "" {
+		out.Subtitle = &atomText{Type: "text", Text: f.Description}
+	}
+	for _, entry := range f.Entries {
+		e := atomEntry{
+			ID:        entry.ID,
+			Title:     atomText{Type: "text", Text: entry.Title},
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: entry.Link},
+			Published: entry.Published.UTC().Format(time.RFC3339),
+			Updated:   entry.Updated.UTC().Format(time.RFC3339),
+			Content:   atomText{Type: "html", Text: entry.HTML},
+		}
+		if entry.Author != "" {
+			e.Author = &atomAuthor{Name: entry.Author}
+		}
+		for _, category := range entry.Categories {
+			e.Categories = append(e.Categories, atomCategory{Term: category})
+		}
+		out.Entries = append(out.Entries, e)
+	}
+	return marshal(out)
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	Creator     string   `xml:"dc:creator,omitempty"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// Write a feed as RSS 2.0
+func RSS(f Feed) ([]byte, error) {
+	description := f.Description
+	if description == "" {
+		description = f.Title
+	}
+	out := rss{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   description,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+			Self:          atomLink{Rel: "self", Type: "application/rss+xml", Href: f.Self},
+		},
+	}
+	for _, entry := range f.Entries {
+		out.Channel.Items = append(out.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        entry.Link,
+			GUID:        rssGUID{IsPermaLink: entry.ID == entry.Link, Value: entry.ID},
+			Creator:     entry.Author,
+			PubDate:     entry.Published.UTC().Format(time.RFC1123Z),
+			Description: entry.HTML,
+			Categories:  entry.Categories,
+		})
+	}
+	return marshal(out)
+}
+
+// Marshal a feed with an XML declaration. User content is escaped by the
+// encoder, which also replaces characters that are not allowed in XML.
+func marshal(v interface{}) ([]byte, error) {
+	body, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
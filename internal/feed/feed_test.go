@@ -0,0 +1,180 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+// The parts of an Atom feed that hold user content
+type decodedAtom struct {
+	Title    string `xml:"title"`
+	Subtitle string `xml:"subtitle"`
+	Entries  []struct {
+		Title   string `xml:"title"`
+		Content string `xml:"content"`
+		Author  string `xml:"author>name"`
+		Link    struct {
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+		Categories []struct {
+			Term string `xml:"term,attr"`
+		} `xml:"category"`
+	} `xml:"entry"`
+}
+
+// The parts of an RSS feed that hold user content
+type decodedRSS struct {
+	Channel struct {
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+		Items       []struct {
+			Title       string   `xml:"title"`
+			Link        string   `xml:"link"`
+			Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+			Description string   `xml:"description"`
+			Categories  []string `xml:"category"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// A feed with the given text in every field that holds user content
+func feedWith(text string) Feed {
+	published := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	return Feed{
+		Title:       text,
+		Description: text,
+		Link:        "https://example.com/",
+		Self:        "https://example.com/feed",
+		Updated:     published,
+		Entries: []Entry{{
+			ID:         "https://example.com/threads/1",
+			Title:      text,
+			Link:       "https://example.com/threads/1?a=1&b=" + text,
+			Author:     text,
+			Published:  published,
+			Updated:    published,
+			HTML:       text,
+			Categories: []string{text},
+		}},
+	}
+}
+
+var escapingTests = []struct {
+	name string
+	text string
+	want string // The text read back from the feed
+}{
+	{"plain", "Hello world", "Hello world"},
+	{"markup", `<script>alert("hi")</script>`, `<script>alert("hi")</script>`},
+	{"entities", "Fish &amp; chips & 'peas'", "Fish &amp; chips & 'peas'"},
+	{"cdata end", "]]> after", "]]> after"},
+	{"unicode", "Café ☕ 日本", "Café ☕ 日本"},
+	{"control characters", "bell\x07 and nul\x00", "bell� and nul�"},
+}
+
+func TestAtomEscaping(t *testing.T) {
+	for _, tt := range escapingTests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := Atom(feedWith(tt.text))
+			if err != nil {
+				t.Fatalf("Atom failed: %v", err)
+			}
+			if !bytes.HasPrefix(body, []byte(xml.Header)) {
+				t.Errorf("feed does not start with an XML declaration")
+			}
+			var decoded decodedAtom
+			if err := xml.Unmarshal(body, &decoded); err != nil {
+				t.Fatalf("feed is not valid XML: %v\n%s", err, body)
+			}
+			if len(decoded.Entries) != 1 {
+				t.Fatalf("got %d entries, want 1", len(decoded.Entries))
+			}
+			entry := decoded.Entries[0]
+			fields := map[string]string{
+				"title":    decoded.Title,
+				"subtitle": decoded.Subtitle,
+				"entry":    entry.Title,
+				"content":  entry.Content,
+				"author":   entry.Author,
+				"link":     entry.Link.Href,
+				"category": entry.Categories[0].Term,
+			}
+			for field, got := range fields {
+				want := tt.want
+				if field == "link" {
+					want = "https://example.com/threads/1?a=1&b=" + tt.want
+				}
+				if got != want {
+					t.Errorf("%s is %q, want %q", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRSSEscaping(t *testing.T) {
+	for _, tt := range escapingTests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := RSS(feedWith(tt.text))
+			if err != nil {
+				t.Fatalf("RSS failed: %v", err)
+			}
+			var decoded decodedRSS
+			if err := xml.Unmarshal(body, &decoded); err != nil {
+				t.Fatalf("feed is not valid XML: %v\n%s", err, body)
+			}
+			if len(decoded.Channel.Items) != 1 {
+				t.Fatalf("got %d items, want 1", len(decoded.Channel.Items))
+			}
+			item := decoded.Channel.Items[0]
+			fields := map[string]string{
+				"title":       decoded.Channel.Title,
+				"description": decoded.Channel.Description,
+				"item":        item.Title,
+				"creator":     item.Creator,
+				"content":     item.Description,
+				"link":        item.Link,
+				"category":    item.Categories[0],
+			}
+			for field, got := range fields {
+				want := tt.want
+				if field == "link" {
+					want = "https://example.com/threads/1?a=1&b=" + tt.want
+				}
+				if got != want {
+					t.Errorf("%s is %q, want %q", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetUpdated(t *testing.T) {
+	fallback := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	older := fallback.Add(-time.Hour)
+	newer := fallback.Add(time.Hour)
+	tests := []struct {
+		name    string
+		updated []time.Time
+		want    time.Time
+	}{
+		{"no entries", nil, fallback},
+		{"one entry", []time.Time{older}, older},
+		{"latest entry", []time.Time{older, newer}, newer},
+		{"latest entry first", []time.Time{newer, older}, newer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Feed{}
+			for _, updated := range tt.updated {
+				f.Entries = append(f.Entries, Entry{Updated: updated})
+			}
+			f.SetUpdated(fallback)
+			if !f.Updated.Equal(tt.want) {
+				t.Errorf("got %v, want %v", f.Updated, tt.want)
+			}
+		})
+	}
+}
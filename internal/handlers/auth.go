@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	sessionSecret     []byte
+	sessionSecretOnce sync.Once
+)
+
+// Get the secret used to sign session tokens
+func getSessionSecret() []byte {
+	sessionSecretOnce.Do(func() {
+		if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+			sessionSecret = []byte(secret)
+			return
+		}
+
+		// Fall back to a random secret, which invalidates tokens on restart
+		sessionSecret = make([]byte, 32)
+		if _, err := rand.Read(sessionSecret); err != nil {
+			log.Fatalf("Failed to generate session secret: %v", err)
+		}
+	})
+	return sessionSecret
+}
+
+// Sign a value with the session secret
+func signValue(value string) string {
+	mac := hmac.New(sha256.New, getSessionSecret())
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// How long a session token is valid after it is issued
+var sessionLifetime = 7 * 24 * time.Hour
+
+// Set how long session tokens are valid after they are issued
+func SetSessionLifetime(lifetime time.Duration) {
+	sessionLifetime = lifetime
+}
+
+// Issue a session token for a user, returning it with the time it expires. The
+// token is the user ID and expiry signed with the session secret.
+func issueToken(userID int) (string, time.Time) {
+	expiresAt := time.Now().Add(sessionLifetime).Truncate(time.Second)
+	payload := strconv.Itoa(userID) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + signValue("session:"+payload), expiresAt
+}
+
+// Parse a session token and return the user ID it was issued for, unless it
+// is forged or expired
+func parseToken(token string) (int, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return 0, false
+	}
+	payload, signature := token[:i], token[i+1:]
+
+	// Compare signatures in constant time
+	if !hmac.Equal([]byte(signature), []byte(signValue("session:"+payload))) {
+		return 0, false
+	}
+
+	id, expiry, found := strings.Cut(payload, ".")
+	if !found {
+		return 0, false
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return 0, false
+	}
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, false
+	}
+	return userID, true
+}
+
+// Authenticate the request from its bearer token, if one is provided
+func Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		// Reject malformed or forged tokens
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+		userID, ok := parseToken(token)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session token"})
+			return
+		}
+
+		c.Set("userID", userID)
+		c.Next()
+	}
+}
+
+// Reject requests that are not authenticated
+func RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := currentUserID(c); !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Token query parameters, which are left out of the request log
+var tokenParam = regexp.MustCompile(`([?&]token=)[^&]*`)
+
+// Log requests like gin's default logger, but without the values of token
+// query parameters, so session and feed tokens do not end up in the logs
+func Logger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if param.IsOutputColor() {
+			statusColor = param.StatusCodeColor()
+			methodColor = param.MethodColor()
+			resetColor = param.ResetColor()
+		}
+		if param.Latency > time.Minute {
+			param.Latency = param.Latency.Truncate(time.Second)
+		}
+		path := tokenParam.ReplaceAllString(param.Path, "${1}REDACTED")
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, param.StatusCode, resetColor,
+			param.Latency,
+			param.ClientIP,
+			methodColor, param.Method, resetColor,
+			path,
+			param.ErrorMessage,
+		)
+	})
+}
+
+// Get the ID of the authenticated user
+func currentUserID(c *gin.Context) (int, bool) {
+	userID, ok := c.Get("userID")
+	if !ok {
+		return 0, false
+	}
+	return userID.(int), true
+}
+
+// Convert an ID to a nullable value, treating 0 as no ID
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// User roles, from least to most privileged. Guest is the role of visitors who are not logged in.
+const (
+	RoleGuest     = "guest"
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Reject requests from users who do not have one of the given roles
+func RequireRole(db *sql.DB, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+
+		// Look up the user's role
+		var role string
+		err := db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user role"})
+			return
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Set("userRole", role)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	}
+}
+
+// Reject requests from users who are not moderators or admins
+func RequireModerator(db *sql.DB) gin.HandlerFunc {
+	return RequireRole(db, RoleModerator, RoleAdmin)
+}
+
+// Lock a thread or comment that is not deleted and check that the logged-in
+// user may change it, which only its author and moderators can. Responds with
+// an error and returns false otherwise. The table is threads or comments.
+func authorizeChange(c *gin.Context, db *sql.DB, q queryer, table string, id int) bool {
+	notFound := "Thread not found"
+	if table == "comments" {
+		notFound = "Comment not found"
+	}
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+		return false
+	}
+
+	// Look up the author
+	var authorID int
+	err := q.QueryRow("SELECT user_id FROM "+table+" WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up author"})
+		return false
+	}
+	if authorID == userID {
+		return true
+	}
+
+	// Let moderators change anyone's content
+	role, err := currentUserRole(c, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user role"})
+		return false
+	}
+	if !hasRole(role, RoleModerator) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only change your own posts"})
+		return false
+	}
+	return true
+}
+
+// Reject requests for a conversation, given by the id URL parameter, from users
+// who are not participants in it. Other users get the same response as for a
+// conversation that does not exist, so they cannot tell which ones do.
+func RequireParticipant(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+		conversationID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+			return
+		}
+
+		// Look up the user's participation
+		var participant bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2)", conversationID, userID).Scan(&participant)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up conversation"})
+			return
+		}
+		if !participant {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+			return
+		}
+
+		c.Set("conversationID", conversationID)
+		c.Next()
+	}
+}
+
+// Reject requests that change anything from suspended or banned users, telling
+// them when the suspension expires. Reading stays allowed.
+func RejectSuspendedWrites(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		method := c.Request.Method
+		if !ok || method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		suspension, err := activeSuspension(db, userID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up suspension"})
+			return
+		}
+		if suspension != nil {
+			respondSuspended(c, suspension)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type Category struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	Position    int    `json:"position"`
+	ReadRole    string `json:"read_role"`
+	PostRole    string `json:"post_role"`
+}
+
+// Rank of each role, where a higher rank has every permission of a lower one
+var roleRanks = map[string]int{
+	RoleGuest:     0,
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// Check whether a role has at least the rank of the required role
+func hasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// Get the role of the logged-in user, or guest if nobody is logged in
+func currentUserRole(c *gin.Context, db *sql.DB) (string, error) {
+	if role, ok := c.Get("userRole"); ok {
+		return role.(string), nil
+	}
+	userID, ok := currentUserID(c)
+	if !ok {
+		return RoleGuest, nil
+	}
+
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return RoleGuest, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	c.Set("userRole", role)
+	return role, nil
+}
+
+// Columns selected to scan a category
+const categoryColumns = "id, name, slug, description, position, read_role, post_role"
+
+// Scan a row of categoryColumns into a category
+func scanCategory(row interface{ Scan(...interface{}) error }, category *Category) error {
+	return row.Scan(&category.ID, &category.Name, &category.Slug, &category.Description, &category.Position, &category.ReadRole, &category.PostRole)
+}
+
+// Get all categories in display order
+func getCategories(db *sql.DB) ([]Category, error) {
+	rows, err := db.Query("SELECT " + categoryColumns + " FROM categories ORDER BY position, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		var category Category
+		if err := scanCategory(rows, &category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// Get the IDs of the categories the logged-in user can read
+func readableCategoryIDs(c *gin.Context, db *sql.DB) ([]int, error) {
+	role, err := currentUserRole(c, db)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := getCategories(db)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, category := range categories {
+		if hasRole(role, category.ReadRole) {
+			ids = append(ids, category.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Check that the logged-in user may read or post in a category, returning an
+// inputError if the category does not exist. A categoryID of 0 means the
+// default category, which is the first one in display order.
+func checkCategoryAccess(c *gin.Context, db *sql.DB, categoryID int, post bool) (Category, bool, error) {
+	var category Category
+	var err error
+	if categoryID == 0 {
+		err = scanCategory(db.QueryRow("SELECT "+categoryColumns+" FROM categories ORDER BY position, id LIMIT 1"), &category)
+	} else {
+		err = scanCategory(db.QueryRow("SELECT "+categoryColumns+" FROM categories WHERE id = $1", categoryID), &category)
+	}
+	if err == sql.ErrNoRows {
+		return category, false, inputError{"Category not found"}
+	}
+	if err != nil {
+		return category, false, err
+	}
+
+	role, err := currentUserRole(c, db)
+	if err != nil {
+		return category, false, err
+	}
+	allowed := hasRole(role, category.ReadRole)
+	if post {
+		allowed = allowed && hasRole(role, category.PostRole)
+	}
+	return category, allowed, nil
+}
+
+// Check that the logged-in user may read or post in the category of a thread,
+// returning sql.ErrNoRows if the thread does not exist or is deleted. Hidden
+// threads are only found by moderators, who review them.
+func checkThreadAccess(c *gin.Context, db *sql.DB, threadID int, post bool) (bool, error) {
+	var categoryID int
+	var hidden bool
+	err := db.QueryRow("SELECT category_id, hidden_at IS NOT NULL FROM threads WHERE id = $1 AND deleted_at IS NULL", threadID).Scan(&categoryID, &hidden)
+	if err != nil {
+		return false, err
+	}
+	if hidden {
+		role, err := currentUserRole(c, db)
+		if err != nil {
+			return false, err
+		}
+		if !hasRole(role, RoleModerator) {
+			return false, sql.ErrNoRows
+		}
+	}
+	_, allowed, err := checkCategoryAccess(c, db, categoryID, post)
+	return allowed, err
+}
+
+// Validate a category's fields, filling in defaults for empty ones
+func validateCategory(category *Category) error {
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		return inputError{"Category name cannot be empty"}
+	}
+	if category.Slug == "" {
+		category.Slug = slugify(category.Name)
+	}
+	if !slugPattern.MatchString(category.Slug) {
+		return inputError{"Category slug may only contain lowercase letters, digits and dashes"}
+	}
+	if category.ReadRole == "" {
+		category.ReadRole = RoleGuest
+	}
+	if category.PostRole == "" {
+		category.PostRole = RoleGuest
+	}
+	if _, ok := roleRanks[category.ReadRole]; !ok {
+		return inputError{"Invalid read role: " + category.ReadRole}
+	}
+	if _, ok := roleRanks[category.PostRole]; !ok {
+		return inputError{"Invalid post role: " + category.PostRole}
+	}
+	return nil
+}
+
+// Report a category write error, treating unique violations as conflicts
+func categoryWriteError(c *gin.Context, err error) {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "A category with this slug already exists"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save category"})
+}
+
+// Category listing endpoint, limited to the categories the logged-in user can read
+func ListCategories(c *gin.Context, db *sql.DB) {
+	role, err := currentUserRole(c, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	categories, err := getCategories(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve categories"})
+		return
+	}
+
+	// Keep only the readable categories
+	readable := []Category{}
+	for _, category := range categories {
+		if hasRole(role, category.ReadRole) {
+			readable = append(readable, category)
+		}
+	}
+
+	// Return the list of categories
+	c.JSON(http.StatusOK, readable)
+}
+
+// Category creation endpoint
+func CreateCategory(c *gin.Context, db *sql.DB) {
+	// Parse JSON request body into Category struct
+	var category Category
+	if err := c.ShouldBindJSON(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateCategory(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Insert category into database with RETURNING id
+	err = tx.QueryRow("INSERT INTO categories (name, slug, description, position, read_role, post_role) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", category.Name, category.Slug, category.Description, category.Position, category.ReadRole, category.PostRole).Scan(&category.ID)
+	if err != nil {
+		categoryWriteError(c, err)
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogCategoryCreated, TargetType: "category", TargetID: category.ID}, nil); err != nil {
+		log.Printf("Error logging category creation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the added category
+	c.JSON(http.StatusOK, category)
+}
+
+// Update a category by ID
+func UpdateCategory(c *gin.Context, db *sql.DB) {
+	// Parse the category ID from the URL parameter
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
+		return
+	}
+
+	// Parse the request body
+	var category Category
+	if err := c.ShouldBindJSON(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := validateCategory(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	category.ID = categoryID
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Execute SQL to update the category
+	before, err := snapshotTarget(tx, "category", categoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up category"})
+		return
+	}
+	result, err := tx.Exec("UPDATE categories SET name = $1, slug = $2, description = $3, position = $4, read_role = $5, post_role = $6 WHERE id = $7", category.Name, category.Slug, category.Description, category.Position, category.ReadRole, category.PostRole, categoryID)
+	if err != nil {
+		categoryWriteError(c, err)
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+		return
+	}
+
+	// If no rows were affected, the category does not exist
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogCategoryUpdated, TargetType: "category", TargetID: categoryID}, before); err != nil {
+		log.Printf("Error logging category update: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the updated category
+	c.JSON(http.StatusOK, category)
+}
+
+// Delete an empty category by ID
+func DeleteCategory(c *gin.Context, db *sql.DB) {
+	// Parse the category ID from the URL parameter
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Ensure no threads, including soft deleted ones, are left in the category
+	var threadCount int
+	err = tx.QueryRow("SELECT COUNT(*) FROM threads WHERE category_id = $1", categoryID).Scan(&threadCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count threads"})
+		return
+	}
+	if threadCount > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Move or delete the threads in this category first"})
+		return
+	}
+
+	// Execute SQL to delete the category
+	before, err := snapshotTarget(tx, "category", categoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up category"})
+		return
+	}
+	result, err := tx.Exec("DELETE FROM categories WHERE id = $1", categoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete category"})
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify deletion"})
+		return
+	}
+
+	// If no rows were affected, the category does not exist
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogCategoryDeleted, TargetType: "category", TargetID: categoryID}, before); err != nil {
+		log.Printf("Error logging category deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Category deleted successfully"})
+}
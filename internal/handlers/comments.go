@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/CVWO/sample-go-app/internal/pubsub"
 	"github.com/gin-gonic/gin"
 	_ "github.com/glebarez/go-sqlite"
 	_ "github.com/lib/pq"
@@ -18,7 +19,11 @@ type Comment struct {
 	UserID int `json:"user_id"`
 	UserName string `json:"user_name"`
 	Text string `json:"text"`
+	TextHTML string `json:"text_html"`
 	CreatedAt time.Time `json:"created_at"`
+	EditedAt *time.Time `json:"edited_at"`
+	Reactions []Reaction `json:"reactions"`
+	Quote *Quote `json:"quote"`
 }
 
 // Comment creation endpoint
@@ -30,17 +35,96 @@ func CreateComment(c *gin.Context, db *sql.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	userID, ok := contentAuthor(c, db, comment.UserID)
+	if !ok {
+		return
+	}
+	comment.UserID = userID
+
+	// Ensure the user may post in the thread's category
+	allowed, err := checkThreadAccess(c, db, comment.ThreadID, true)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot post in this category"})
+		return
+	}
+
+	// Start a transaction so the comment and its mentions are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
 
 	// Insert comment into database with RETURNING to get the id and created_at
 	var id int
 	var createdAt time.Time
-	err := db.QueryRow("INSERT INTO comments (thread_id, user_id, text) VALUES ($1, $2, $3) RETURNING id, created_at", comment.ThreadID, comment.UserID, comment.Text).Scan(&id, &createdAt)
+	err = tx.QueryRow("INSERT INTO comments (thread_id, user_id, text) VALUES ($1, $2, $3) RETURNING id, created_at", comment.ThreadID, comment.UserID, comment.Text).Scan(&id, &createdAt)
 	if err != nil {
 		log.Printf("Error inserting comment: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// Save the quoted part of another comment, if any
+	if comment.Quote != nil {
+		err := saveQuote(tx, id, comment.ThreadID, comment.UserID, comment.Quote)
+		if _, ok := err.(inputError); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving quote: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save quote"})
+			return
+		}
+	}
+
+	// Save the users mentioned in the comment and notify them
+	mentioned, err := saveMentions(tx, comment.ThreadID, id, comment.UserID, comment.Text)
+	if err != nil {
+		log.Printf("Error saving mentions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mentions"})
+		return
+	}
+
+	// Notify the users watching the thread, then watch it on behalf of the
+	// commenter, who has read their own comment
+	if err := notifyWatchers(tx, comment.ThreadID, id, comment.UserID); err != nil {
+		log.Printf("Error notifying watchers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to notify watchers"})
+		return
+	}
+	if err := autoWatchThread(tx, comment.UserID, comment.ThreadID, id); err != nil {
+		log.Printf("Error watching thread: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to watch thread"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.CommentCreated, ThreadID: comment.ThreadID, CommentID: id, UserID: comment.UserID}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	reindexThread(db, comment.ThreadID)
+	publishEvent(event)
+
 	// // Insert comment into database
 	// result, err := db.Exec("INSERT INTO comments (thread_id, user_id, text) VALUES ($1, $2, $3)", comment.ThreadID, comment.UserID, comment.Text)
 	// if err != nil {
@@ -71,6 +155,8 @@ func CreateComment(c *gin.Context, db *sql.DB) {
         "thread_id":  comment.ThreadID,
         "user_id":    comment.UserID,
         "text":       comment.Text,
+        "text_html":  renderComment(comment.Text, mentioned, comment.Quote),
+        "quote":      comment.Quote,
         "created_at": createdAt,
     })
 }
@@ -98,13 +184,42 @@ func ListComments(c *gin.Context, db *sql.DB) {
 		lastCommentID = 0
 	}
 
+	// Ensure the user may read the thread's category
+	allowed, err := checkThreadAccess(c, db, threadID, false)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot read this category"})
+		return
+	}
+
 	// Query database for comment
-	rows, err := db.Query("SELECT m.id, thread_id, user_id, u.username AS user_name, m.text, m.created_at FROM comments m LEFT JOIN users u ON u.id = m.user_id WHERE thread_id = $1 AND m.id > $2 ORDER BY m.id ASC LIMIT $3", threadID, lastCommentID, limit)
+	viewerID, _ := currentUserID(c)
+	comments, err := queryComments(db, viewerID, "m.thread_id = $1 AND m.id > $2 AND m.deleted_at IS NULL AND m.hidden_at IS NULL ORDER BY m.id ASC LIMIT $3", threadID, lastCommentID, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// Return slice of comments
+	c.JSON(http.StatusOK, comments)
+}
+
+// Query the comments matching a condition, with their reactions, quotes and
+// rendered text
+func queryComments(db *sql.DB, viewerID int, condition string, args ...any) ([]Comment, error) {
+	rows, err := db.Query("SELECT m.id, m.thread_id, m.user_id, u.username AS user_name, m.text, m.created_at, m.edited_at FROM comments m LEFT JOIN users u ON u.id = m.user_id WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	// Create slice of comments
 	var comments []Comment
 
@@ -114,21 +229,56 @@ func ListComments(c *gin.Context, db *sql.DB) {
 		var comment Comment
 
 		// Scan row into comment
-		err := rows.Scan(&comment.ID, &comment.ThreadID, &comment.UserID, &comment.UserName, &comment.Text, &comment.CreatedAt)
+		err := rows.Scan(&comment.ID, &comment.ThreadID, &comment.UserID, &comment.UserName, &comment.Text, &comment.CreatedAt, &comment.EditedAt)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return nil, err
 		}
 
 		// Append comment to slice
 		comments = append(comments, comment)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	// Return slice of comments
-	c.JSON(http.StatusOK, comments)
+	// Fetch the reactions for all listed comments in one query
+	commentIDs := make([]int, len(comments))
+	for i, comment := range comments {
+		commentIDs[i] = comment.ID
+	}
+	reactions, err := getReactions(db, commentIDs, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range comments {
+		comments[i].Reactions = reactionsOrEmpty(reactions[comments[i].ID])
+	}
+
+	// Render the comments with their quotes and mentions linked
+	mentions, err := getCommentMentions(db, commentIDs)
+	if err != nil {
+		return nil, err
+	}
+	quotes, err := getQuotes(db, commentIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range comments {
+		comments[i].Quote = quotes[comments[i].ID]
+		comments[i].TextHTML = renderComment(comments[i].Text, mentions[comments[i].ID], comments[i].Quote)
+	}
+	return comments, nil
 }
 
-// Delete a comment by ID
+// Soft delete a comment, returning the ID of its thread, or sql.ErrNoRows if
+// the comment does not exist or is already deleted
+func softDeleteComment(q queryer, commentID int, deletedBy int) (int, error) {
+	var threadID int
+	err := q.QueryRow("UPDATE comments SET deleted_at = CURRENT_TIMESTAMP, deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL RETURNING thread_id", commentID, nullableID(deletedBy)).Scan(&threadID)
+	return threadID, err
+}
+
+// Soft delete a comment by ID, as its author or a moderator
 func DeleteComment(c *gin.Context, db *sql.DB) {
 	// Parse the comment ID from the URL parameter
 	commentID, err := strconv.Atoi(c.Param("id"))
@@ -137,31 +287,148 @@ func DeleteComment(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	// Execute SQL to delete the comment
-	result, err := db.Exec("DELETE FROM comments WHERE id = $1", commentID)
+	// Start a transaction so the deletion and its log entry are saved together
+	tx, err := db.Begin()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	if !authorizeChange(c, db, tx, "comments", commentID) {
 		return
 	}
 
-	// Check if any rows were affected
-	rowsAffected, err := result.RowsAffected()
+	// Execute SQL to mark the comment as deleted
+	deletedBy, _ := currentUserID(c)
+	before, err := snapshotTarget(tx, "comment", commentID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify deletion"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up comment"})
 		return
 	}
+	threadID, err := softDeleteComment(tx, commentID, deletedBy)
 
-	// If no rows were affected, the comment does not exist
-	if rowsAffected == 0 {
+	// If no rows were returned, the comment does not exist or is already deleted
+	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+		return
+	}
+
+	// Log who deleted the comment
+	if err := logChange(c, tx, moderationLogEntry{Action: LogCommentDeleted, TargetType: "comment", TargetID: commentID}, before); err != nil {
+		log.Printf("Error logging comment deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.CommentDeleted, ThreadID: threadID, CommentID: commentID, UserID: deletedBy}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	reindexComment(db, commentID)
+	publishEvent(event)
+
+	// Notify the author if someone else did this
+	if err := notifyModeration(c, db, ModerationCommentDeleted, 0, commentID); err != nil {
+		log.Printf("Error notifying comment author: %v", err)
+	}
 
 	// Return success message
 	c.JSON(http.StatusOK, gin.H{"message": "Comment deleted successfully"})
 }
 
-// Update a comment by ID
+// Restore a soft deleted comment by ID
+func RestoreComment(c *gin.Context, db *sql.DB) {
+	// Parse the comment ID from the URL parameter
+	commentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+
+	// Start a transaction so the restoration and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Ensure the comment is deleted and its thread is not
+	var threadID int
+	var threadDeleted bool
+	err = tx.QueryRow("SELECT t.id, t.deleted_at IS NOT NULL FROM comments m JOIN threads t ON t.id = m.thread_id WHERE m.id = $1 AND m.deleted_at IS NOT NULL FOR UPDATE OF m", commentID).Scan(&threadID, &threadDeleted)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted comment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up comment"})
+		return
+	}
+	if threadDeleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Restore the comment's thread first"})
+		return
+	}
+
+	// Execute SQL to restore the comment
+	before, err := snapshotTarget(tx, "comment", commentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up comment"})
+		return
+	}
+	_, err = tx.Exec("UPDATE comments SET deleted_at = NULL, deleted_by = NULL WHERE id = $1", commentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore comment"})
+		return
+	}
+
+	// Log who restored the comment
+	if err := logChange(c, tx, moderationLogEntry{Action: LogCommentRestored, TargetType: "comment", TargetID: commentID}, before); err != nil {
+		log.Printf("Error logging comment restoration: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	restoredBy, _ := currentUserID(c)
+	event := pubsub.Event{Type: pubsub.CommentRestored, ThreadID: threadID, CommentID: commentID, UserID: restoredBy}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	reindexComment(db, commentID)
+	publishEvent(event)
+
+	// Notify the author if someone else did this
+	if err := notifyModeration(c, db, ModerationCommentRestored, 0, commentID); err != nil {
+		log.Printf("Error notifying comment author: %v", err)
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Comment restored successfully"})
+}
+
+// Update a comment by ID, as its author or a moderator
 func UpdateComment(c *gin.Context, db *sql.DB) {
     // Parse the comment ID from the URL parameter
     commentID, err := strconv.Atoi(c.Param("id"))
@@ -185,25 +452,64 @@ func UpdateComment(c *gin.Context, db *sql.DB) {
         return
     }
 
-    // Execute SQL to update the comment
-    result, err := db.Exec("UPDATE comments SET text = $1 WHERE id = $2", input.Text, commentID)
+    // Start a transaction so the edit and its revision are saved together
+    tx, err := db.Begin()
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+        return
+    }
+    defer tx.Rollback()
+    if !authorizeChange(c, db, tx, "comments", commentID) {
         return
     }
 
-    // Check if any rows were affected
-    rowsAffected, err := result.RowsAffected()
+    // Record the new text as a revision of the comment
+    editorID, _ := currentUserID(c)
+    changed, err := recordCommentRevision(tx, commentID, input.Text, editorID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+        return
+    }
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record revision"})
         return
     }
 
-    // If no rows were affected, the comment does not exist
-    if rowsAffected == 0 {
-        c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+    // Execute SQL to update the comment if the text changed
+    var threadID, authorID int
+    if changed {
+        err = tx.QueryRow("UPDATE comments SET text = $1, edited_at = CURRENT_TIMESTAMP WHERE id = $2 RETURNING thread_id, user_id", input.Text, commentID).Scan(&threadID, &authorID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+            return
+        }
+
+        // Update the users mentioned in the comment, notifying newly mentioned users
+        if _, err := saveMentions(tx, threadID, commentID, authorID, input.Text); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mentions"})
+            return
+        }
+    }
+
+    // Queue the event's webhooks with the change
+    event := pubsub.Event{Type: pubsub.CommentUpdated, ThreadID: threadID, CommentID: commentID, UserID: editorID}
+    if changed {
+        if err := queueWebhooks(db, tx, event); err != nil {
+            log.Printf("Error queueing webhooks: %v", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+            return
+        }
+    }
+
+    // Commit the transaction
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
         return
     }
+    reindexComment(db, commentID)
+    if changed {
+        publishEvent(event)
+    }
 
     // Return success message
     c.JSON(http.StatusOK, gin.H{"message": "Comment updated successfully"})
@@ -0,0 +1,473 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/mail"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Ways notifications can be delivered by email
+const (
+	DeliveryInstant = "instant"
+	DeliveryDaily   = "daily"
+	DeliveryWeekly  = "weekly"
+	DeliveryOff     = "off"
+)
+
+// Delivery of notification types the user has not chosen one for
+const defaultDelivery = DeliveryDaily
+
+// Time between digests of each frequency
+var digestIntervals = map[string]time.Duration{
+	DeliveryDaily:  24 * time.Hour,
+	DeliveryWeekly: 7 * 24 * time.Hour,
+}
+
+// Notification types users can choose the delivery of
+var notificationTypes = []string{NotificationMention, NotificationReply, NotificationQuote, NotificationModeration}
+
+// Unsubscribe scope covering every notification type
+const unsubscribeAll = "all"
+
+// A user's email address and how each type of notification is delivered to it
+type NotificationPreferences struct {
+	Email    *string           `json:"email"`
+	Delivery map[string]string `json:"delivery"`
+}
+
+// Base URLs used in links in emails and feeds
+type Links struct {
+	API      string // This server, for unsubscribe links
+	Frontend string // The frontend, for links to threads
+	// Address that replies to notifications about a thread are sent to, such as
+	// reply@example.com, or empty if replies are not accepted
+	ReplyAddress string
+}
+
+// Get the logged-in user's notification preferences, filling in the defaults
+func getNotificationPreferences(db *sql.DB, userID int) (NotificationPreferences, error) {
+	preferences := NotificationPreferences{Delivery: make(map[string]string)}
+	for _, kind := range notificationTypes {
+		preferences.Delivery[kind] = defaultDelivery
+	}
+	if err := db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&preferences.Email); err != nil {
+		return preferences, err
+	}
+
+	rows, err := db.Query("SELECT type, delivery FROM notification_preferences WHERE user_id = $1", userID)
+	if err != nil {
+		return preferences, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, delivery string
+		if err := rows.Scan(&kind, &delivery); err != nil {
+			return preferences, err
+		}
+		preferences.Delivery[kind] = delivery
+	}
+	return preferences, rows.Err()
+}
+
+// Set how notifications of the given types are delivered to a user
+func setDelivery(q queryer, userID int, kinds []string, delivery string) error {
+	_, err := q.Exec(`
+	INSERT INTO notification_preferences (user_id, type, delivery)
+	SELECT $1::int, kind, $3::text FROM unnest($2::text[]) AS kind
+	ON CONFLICT (user_id, type) DO UPDATE SET delivery = EXCLUDED.delivery
+	`, userID, pq.Array(kinds), delivery)
+	return err
+}
+
+// Notification preference endpoint for the logged-in user
+func GetNotificationPreferences(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+	preferences, err := getNotificationPreferences(db, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve preferences"})
+		return
+	}
+
+	// Return the preferences
+	c.JSON(http.StatusOK, preferences)
+}
+
+// Update the logged-in user's email address and notification delivery. Omitted
+// fields are left unchanged, and an empty email address stops all emails.
+func UpdateNotificationPreferences(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the request body
+	var input NotificationPreferences
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Validate the email address and deliveries
+	if input.Email != nil && *input.Email != "" {
+		address, err := netmail.ParseAddress(*input.Email)
+		if err != nil || address.Name != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+			return
+		}
+	}
+	for kind, delivery := range input.Delivery {
+		known := false
+		for _, notificationType := range notificationTypes {
+			known = known || kind == notificationType
+		}
+		if !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification type: " + kind})
+			return
+		}
+		if _, ok := digestIntervals[delivery]; !ok && delivery != DeliveryInstant && delivery != DeliveryOff {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery for " + kind + ": " + delivery})
+			return
+		}
+	}
+
+	// Start a transaction so the preferences are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Save the email address, storing an empty one as NULL
+	if input.Email != nil {
+		_, err := tx.Exec("UPDATE users SET email = NULLIF($1, '') WHERE id = $2", strings.TrimSpace(*input.Email), userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save email address"})
+			return
+		}
+	}
+
+	// Save the deliveries
+	for kind, delivery := range input.Delivery {
+		if err := setDelivery(tx, userID, []string{kind}, delivery); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+			return
+		}
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the updated preferences
+	GetNotificationPreferences(c, db)
+}
+
+// Create a token that turns off emails for a notification type, or for every
+// type if the scope is unsubscribeAll. It is signed like session tokens, but
+// over a prefixed value so neither kind of token can be used as the other.
+func unsubscribeToken(userID int, scope string) string {
+	payload := strconv.Itoa(userID) + "." + scope
+	return payload + "." + signValue("unsubscribe:"+payload)
+}
+
+// Parse an unsubscribe token, returning the user ID and scope it was issued for
+func parseUnsubscribeToken(token string) (int, string, bool) {
+	payload, signature, found := cutLast(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signValue("unsubscribe:"+payload))) {
+		return 0, "", false
+	}
+	id, scope, found := strings.Cut(payload, ".")
+	if !found {
+		return 0, "", false
+	}
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, "", false
+	}
+	return userID, scope, true
+}
+
+// Split a string around the last instance of a separator
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// One-click unsubscribe endpoint linked from every email. GET requests come from
+// people clicking the link and get a page, while POST requests come from mail
+// clients implementing RFC 8058 and get JSON.
+func Unsubscribe(c *gin.Context, db *sql.DB) {
+	userID, scope, ok := parseUnsubscribeToken(c.Query("token"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unsubscribe token"})
+		return
+	}
+
+	// Turn off emails for the scope
+	kinds := []string{scope}
+	if scope == unsubscribeAll {
+		kinds = notificationTypes
+	}
+	if err := setDelivery(db, userID, kinds, DeliveryOff); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsubscribe"})
+		return
+	}
+
+	// Confirm the change
+	message := "You will no longer receive emails about " + strings.Join(kinds, ", ") + " notifications."
+	if c.Request.Method == http.MethodGet {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<!DOCTYPE html><title>Unsubscribed</title><p>"+htmltemplate.HTMLEscapeString(message)+"</p>"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// Data shown in notification email templates
+type emailData struct {
+	Username       string
+	Intro          string
+	Items          []emailItem
+	UnsubscribeURL string
+}
+
+type emailItem struct {
+	Message string
+	Link    string
+}
+
+var textEmailTemplate = template.Must(template.New("text").Parse(`Hi {{.Username}},
+
+{{.Intro}}
+{{range .Items}}
+- {{.Message}}
+  {{.Link}}
+{{end}}
+To stop receiving these emails, visit {{.UnsubscribeURL}}
+`))
+
+var htmlEmailTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hi {{.Username}},</p>
+<p>{{.Intro}}</p>
+<ul>
+{{range .Items}}<li><a href="{{.Link}}">{{.Message}}</a></li>
+{{end}}</ul>
+<p style="font-size: small"><a href="{{.UnsubscribeURL}}">Unsubscribe</a> from these emails.</p>
+</body>
+</html>
+`))
+
+// Render an email from the templates
+func renderEmail(to string, subject string, data emailData) (mail.Message, error) {
+	var text, html bytes.Buffer
+	if err := textEmailTemplate.Execute(&text, data); err != nil {
+		return mail.Message{}, err
+	}
+	if err := htmlEmailTemplate.Execute(&html, data); err != nil {
+		return mail.Message{}, err
+	}
+	return mail.Message{
+		To:      to,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}, nil
+}
+
+// A notification waiting to be emailed
+type pendingNotification struct {
+	Notification
+	Delivery string
+}
+
+// A user with notifications waiting to be emailed
+type emailRecipient struct {
+	ID            int
+	Username      string
+	Email         string
+	Notifications []pendingNotification
+}
+
+// Email unread notifications that have not been emailed yet. Instant
+// notifications are sent one per email, while the others are collected into
+// daily or weekly digests, which are sent once their interval has passed since
+// the previous one. Failures for one user are logged and retried on the next run.
+func SendNotificationEmails(ctx context.Context, db *sql.DB, mailer mail.Mailer, links Links) error {
+	recipients, err := getEmailRecipients(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := sendRecipientEmails(ctx, db, mailer, links, recipient); err != nil {
+			log.Printf("Failed to email notifications to user %d: %v", recipient.ID, err)
+		}
+	}
+	return nil
+}
+
+// Get the users with notifications waiting to be emailed
+func getEmailRecipients(ctx context.Context, db *sql.DB) ([]*emailRecipient, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT r.id, r.username, r.email, COALESCE(p.delivery, $1), `+notificationColumns+`
+	FROM notifications n
+	JOIN users r ON r.id = n.user_id AND r.email IS NOT NULL
+	LEFT JOIN notification_preferences p ON p.user_id = n.user_id AND p.type = n.type`+notificationJoins+`
+	WHERE n.read_at IS NULL AND n.emailed_at IS NULL AND COALESCE(p.delivery, $1) <> $2
+	ORDER BY r.id, n.id
+	`, defaultDelivery, DeliveryOff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []*emailRecipient
+	for rows.Next() {
+		var recipient emailRecipient
+		var n pendingNotification
+		err := rows.Scan(&recipient.ID, &recipient.Username, &recipient.Email, &n.Delivery,
+			&n.ID, &n.Type, &n.Detail, &n.Count, &n.ActorID, &n.ActorName, &n.ThreadID, &n.ThreadName, &n.CommentID, &n.ReadAt, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		n.Message = notificationMessage(n.Notification)
+		if len(recipients) == 0 || recipients[len(recipients)-1].ID != recipient.ID {
+			recipients = append(recipients, &recipient)
+		}
+		last := recipients[len(recipients)-1]
+		last.Notifications = append(last.Notifications, n)
+	}
+	return recipients, rows.Err()
+}
+
+// Send a user's instant emails and any digests that are due
+func sendRecipientEmails(ctx context.Context, db *sql.DB, mailer mail.Mailer, links Links, recipient *emailRecipient) error {
+	link := func(n Notification) string {
+		if n.ThreadID == nil {
+			return links.Frontend
+		}
+		threadLink := links.Frontend + "/threads/" + strconv.Itoa(*n.ThreadID)
+		if n.CommentID != nil {
+			threadLink += "#comment-" + strconv.Itoa(*n.CommentID)
+		}
+		return threadLink
+	}
+	unsubscribeURL := func(scope string) string {
+		return links.API + "/unsubscribe?token=" + url.QueryEscape(unsubscribeToken(recipient.ID, scope))
+	}
+
+	// Send each instant notification in its own email
+	digests := make(map[string][]pendingNotification)
+	for _, n := range recipient.Notifications {
+		if n.Delivery != DeliveryInstant {
+			digests[n.Delivery] = append(digests[n.Delivery], n)
+			continue
+		}
+		msg, err := renderEmail(recipient.Email, n.Message, emailData{
+			Username:       recipient.Username,
+			Intro:          "You have a new notification:",
+			Items:          []emailItem{{Message: n.Message, Link: link(n.Notification)}},
+			UnsubscribeURL: unsubscribeURL(n.Type),
+		})
+		if err != nil {
+			return err
+		}
+		if links.ReplyAddress != "" && n.ThreadID != nil {
+			msg.Headers["Reply-To"] = replyAddress(links.ReplyAddress, recipient.ID, *n.ThreadID)
+		}
+		if err := sendNotificationEmail(ctx, db, mailer, msg, []int{n.ID}, recipient.ID, ""); err != nil {
+			return err
+		}
+	}
+
+	// Send the digests that are due
+	for frequency, notifications := range digests {
+		due, err := digestDue(ctx, db, recipient.ID, frequency)
+		if err != nil {
+			return err
+		}
+		if !due {
+			continue
+		}
+
+		data := emailData{
+			Username:       recipient.Username,
+			Intro:          "Here is what you missed since your last " + frequency + " digest:",
+			UnsubscribeURL: unsubscribeURL(unsubscribeAll),
+		}
+		ids := make([]int, len(notifications))
+		for i, n := range notifications {
+			data.Items = append(data.Items, emailItem{Message: n.Message, Link: link(n.Notification)})
+			ids[i] = n.ID
+		}
+		subject := fmt.Sprintf("Your %s digest: %d new notification", frequency, len(ids))
+		if len(ids) > 1 {
+			subject += "s"
+		}
+		msg, err := renderEmail(recipient.Email, subject, data)
+		if err != nil {
+			return err
+		}
+		if err := sendNotificationEmail(ctx, db, mailer, msg, ids, recipient.ID, frequency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check whether a user's digest of a frequency is due. The first digest is
+// due one interval after the user first has notifications for it.
+func digestDue(ctx context.Context, db *sql.DB, userID int, frequency string) (bool, error) {
+	var lastSent time.Time
+	err := db.QueryRowContext(ctx, "SELECT sent_at FROM notification_digests WHERE user_id = $1 AND frequency = $2", userID, frequency).Scan(&lastSent)
+	if err == sql.ErrNoRows {
+		_, err = db.ExecContext(ctx, "INSERT INTO notification_digests (user_id, frequency) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, frequency)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(lastSent) >= digestIntervals[frequency], nil
+}
+
+// Send an email and record that its notifications were emailed, along with
+// the time the digest of the given frequency was sent, if it is one
+func sendNotificationEmail(ctx context.Context, db *sql.DB, mailer mail.Mailer, msg mail.Message, notificationIDs []int, userID int, frequency string) error {
+	if err := mailer.Send(ctx, msg); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "UPDATE notifications SET emailed_at = CURRENT_TIMESTAMP WHERE id = ANY($1)", pq.Array(notificationIDs))
+	if err != nil {
+		return err
+	}
+	if frequency != "" {
+		_, err = db.ExecContext(ctx, "UPDATE notification_digests SET sent_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND frequency = $2", userID, frequency)
+	}
+	return err
+}
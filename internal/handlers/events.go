@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Interval between keepalive messages on idle streams, so proxies do not
+// close them
+const streamKeepalive = 30 * time.Second
+
+// Fans out the events of each thread to the streams and WebSocket clients of
+// this instance
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan *threadEvent]struct{}
+}
+
+var threadEvents = &eventHub{subscribers: make(map[int]map[chan *threadEvent]struct{})}
+
+// An event sent to the subscribers of a thread. The comment it refers to is
+// loaded once, however many subscribers the event is sent to.
+type threadEvent struct {
+	pubsub.Event
+	once     sync.Once
+	comment  *Comment
+	reactors map[string]map[int]bool // The users who reacted to the comment with each emoji
+	err      error
+}
+
+// Subscribe to the events of a thread. The channel is closed when the
+// subscriber falls too far behind or unsubscribes.
+func (h *eventHub) subscribe(threadID int) (<-chan *threadEvent, func()) {
+	ch := make(chan *threadEvent, 16)
+	h.mu.Lock()
+	if h.subscribers[threadID] == nil {
+		h.subscribers[threadID] = make(map[chan *threadEvent]struct{})
+	}
+	h.subscribers[threadID][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() { h.remove(threadID, ch) }
+}
+
+func (h *eventHub) remove(threadID int, ch chan *threadEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[threadID][ch]; !ok {
+		return
+	}
+	delete(h.subscribers[threadID], ch)
+	if len(h.subscribers[threadID]) == 0 {
+		delete(h.subscribers, threadID)
+	}
+	close(ch)
+}
+
+// Send an event to the thread's subscribers without blocking. Subscribers
+// whose buffer is full are dropped, and resume from their last event when
+// they reconnect.
+func (h *eventHub) publish(event pubsub.Event) {
+	shared := &threadEvent{Event: event}
+	h.mu.Lock()
+	var slow []chan *threadEvent
+	for ch := range h.subscribers[event.ThreadID] {
+		select {
+		case ch <- shared:
+		default:
+			slow = append(slow, ch)
+		}
+	}
+	h.mu.Unlock()
+	for _, ch := range slow {
+		h.remove(event.ThreadID, ch)
+	}
+}
+
+var eventBus pubsub.PubSub
+
+// Set the pub/sub that carries events between server instances. Without one,
+// events only reach the clients of the instance that raised them.
+func SetPubSub(ps pubsub.PubSub) {
+	eventBus = ps
+	ps.Subscribe(threadEvents.publish)
+}
+
+// Publish a domain event to every instance. Failures are logged, as the change
+// the event describes has already been saved. Webhook deliveries are queued
+// separately with queueWebhooks, before the change is committed.
+func publishEvent(event pubsub.Event) {
+	if eventBus == nil {
+		threadEvents.publish(event)
+	} else if err := eventBus.Publish(context.Background(), event); err != nil {
+		log.Printf("Error publishing %s event: %v", event.Type, err)
+	}
+}
+
+// Get the data sent to a viewer for an event: the comment it refers to as the
+// viewer sees it, or the event itself if it is not about a comment's content.
+// Returns nil if the comment was deleted or hidden since.
+func (e *threadEvent) data(db *sql.DB, viewerID int) (any, error) {
+	switch e.Type {
+	case pubsub.CommentCreated, pubsub.CommentUpdated, pubsub.CommentRestored, pubsub.ReactionsChanged:
+		e.once.Do(func() { e.comment, e.reactors, e.err = loadEventComment(db, e.CommentID) })
+		if e.err != nil || e.comment == nil {
+			return nil, e.err
+		}
+
+		// Mark the reactions of the viewer on a copy of the shared comment
+		comment := *e.comment
+		comment.Reactions = make([]Reaction, len(e.comment.Reactions))
+		for i, reaction := range e.comment.Reactions {
+			reaction.ReactedByMe = e.reactors[reaction.Emoji][viewerID]
+			comment.Reactions[i] = reaction
+		}
+		return &comment, nil
+	default:
+		return e.Event, nil
+	}
+}
+
+// Load a visible comment for an event along with who reacted to it with each
+// emoji, or nil if the comment was deleted or hidden
+func loadEventComment(db *sql.DB, commentID int) (*Comment, map[string]map[int]bool, error) {
+	comments, err := queryComments(db, 0, "m.id = $1 AND m.deleted_at IS NULL AND m.hidden_at IS NULL", commentID)
+	if err != nil || len(comments) == 0 {
+		return nil, nil, err
+	}
+	rows, err := db.Query("SELECT emoji, user_id FROM comment_reactions WHERE comment_id = $1", commentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	reactors := make(map[string]map[int]bool)
+	for rows.Next() {
+		var emoji string
+		var userID int
+		if err := rows.Scan(&emoji, &userID); err != nil {
+			return nil, nil, err
+		}
+		if reactors[emoji] == nil {
+			reactors[emoji] = make(map[int]bool)
+		}
+		reactors[emoji][userID] = true
+	}
+	return &comments[0], reactors, rows.Err()
+}
+
+// Authenticate the request from a token query parameter, for clients such as
+// EventSource that cannot set the Authorization header
+func authenticateQueryToken(c *gin.Context) bool {
+	token := c.Query("token")
+	if _, ok := currentUserID(c); ok || token == "" {
+		return true
+	}
+	userID, ok := parseToken(token)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid session token"})
+		return false
+	}
+	c.Set("userID", userID)
+	return true
+}
+
+// Stream the events of a thread as Server-Sent Events. Comment created events
+// carry the comment ID as their event ID, so a client that reconnects with a
+// Last-Event-ID header, or a lastEventID query parameter, first receives the
+// comments it missed.
+func StreamThreadEvents(c *gin.Context, db *sql.DB) {
+	if !authenticateQueryToken(c) {
+		return
+	}
+	threadID, ok := readableThreadParam(c, db)
+	if !ok {
+		return
+	}
+	viewerID, _ := currentUserID(c)
+
+	// Parse the ID of the last event the client received, if any
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventID")
+	}
+	lastCommentID := 0
+	if lastEventID != "" {
+		id, err := strconv.Atoi(lastEventID)
+		if err != nil || id < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last event ID"})
+			return
+		}
+		lastCommentID = id
+	}
+
+	// Subscribe before catching up so no event is missed in between
+	events, unsubscribe := threadEvents.subscribe(threadID)
+	defer unsubscribe()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	// Send the comments created since the last event, or start from the
+	// latest comment for a new client
+	replayed := make(map[int]bool)
+	if lastEventID != "" {
+		missed, err := queryComments(db, viewerID, "m.thread_id = $1 AND m.id > $2 AND m.deleted_at IS NULL AND m.hidden_at IS NULL ORDER BY m.id ASC", threadID, lastCommentID)
+		if err != nil {
+			log.Printf("Error loading missed comments: %v", err)
+			return
+		}
+		for _, comment := range missed {
+			c.Render(-1, sse.Event{Id: strconv.Itoa(comment.ID), Event: pubsub.CommentCreated, Data: comment})
+			replayed[comment.ID] = true
+			lastCommentID = comment.ID
+		}
+	} else if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM comments WHERE thread_id = $1", threadID).Scan(&lastCommentID); err != nil {
+		log.Printf("Error loading latest comment: %v", err)
+		return
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// The stream fell behind, so let the client reconnect and catch up
+				return
+			}
+			if event.Type == pubsub.Typing {
+				continue
+			}
+			if event.Type == pubsub.CommentCreated && replayed[event.CommentID] {
+				delete(replayed, event.CommentID)
+				continue
+			}
+			if !writeStreamEvent(c, db, viewerID, event, &lastCommentID) {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// Write an event to the stream, returning false if the stream should end
+func writeStreamEvent(c *gin.Context, db *sql.DB, viewerID int, event *threadEvent, lastCommentID *int) bool {
+	data, err := event.data(db, viewerID)
+	if err != nil {
+		log.Printf("Error loading %s event for stream: %v", event.Type, err)
+		return false
+	}
+	if data == nil {
+		return true
+	}
+
+	// Only new comments advance the event ID
+	message := sse.Event{Event: event.Type, Data: data}
+	if event.Type == pubsub.CommentCreated && event.CommentID > *lastCommentID {
+		message.Id = strconv.Itoa(event.CommentID)
+		*lastCommentID = event.CommentID
+	}
+	c.Render(-1, message)
+	return true
+}
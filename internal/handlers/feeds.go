@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/feed"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Number of entries in a feed unless a limit is given
+const feedSize = 50
+
+var siteLinks Links
+
+// Set the base URLs used in links in feeds
+func SetLinks(links Links) {
+	siteLinks = links
+}
+
+// URL of a thread, or of a comment in it, on the frontend
+func threadURL(threadID int, commentID int) string {
+	link := siteLinks.Frontend + "/threads/" + strconv.Itoa(threadID)
+	if commentID != 0 {
+		link += "#comment-" + strconv.Itoa(commentID)
+	}
+	return link
+}
+
+// Hash of a feed token, which is what is stored in the database
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate a feed request from a feed token query parameter. Feed readers
+// cannot log in, so they are given a feed token instead of the session token,
+// which only works for feeds and can be revoked without logging the user out.
+func authenticateFeedToken(c *gin.Context, db *sql.DB) bool {
+	token := c.Query("token")
+	if _, ok := currentUserID(c); ok || token == "" {
+		return true
+	}
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM feed_tokens WHERE token_hash = $1", hashFeedToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid feed token"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up feed token"})
+		return false
+	}
+	c.Set("userID", userID)
+	return true
+}
+
+// Create a feed token for the logged-in user, replacing their previous one.
+// The token is only shown in the response.
+func CreateFeedToken(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Generate the token
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	token := hex.EncodeToString(secret)
+
+	// Save its hash, replacing the previous token
+	_, err := db.Exec(`
+	INSERT INTO feed_tokens (user_id, token_hash) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = CURRENT_TIMESTAMP
+	`, userID, hashFeedToken(token))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feed token"})
+		return
+	}
+
+	// Return the token
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+// Revoke the logged-in user's feed token
+func RevokeFeedToken(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+	result, err := db.Exec("DELETE FROM feed_tokens WHERE user_id = $1", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke feed token"})
+		return
+	}
+
+	// If no rows were affected, the user has no feed token
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify revocation"})
+		return
+	}
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed token not found"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Feed token revoked successfully"})
+}
+
+// URL of the requested feed, without the feed token of a private feed
+func feedSelfURL(c *gin.Context) string {
+	query := c.Request.URL.Query()
+	query.Del("token")
+	self := siteLinks.API + c.Request.URL.Path
+	if len(query) > 0 {
+		self += "?" + query.Encode()
+	}
+	return self
+}
+
+// The time a thread or comment was last changed
+func lastChanged(createdAt time.Time, editedAt *time.Time) time.Time {
+	if editedAt != nil && editedAt.After(createdAt) {
+		return *editedAt
+	}
+	return createdAt
+}
+
+func threadEntry(thread Thread) feed.Entry {
+	var createdAt time.Time
+	if thread.CreatedAt != nil {
+		createdAt = *thread.CreatedAt
+	}
+	content := "<p>" + thread.NameHTML + "</p>"
+	if len(thread.Tags) > 0 {
+		content += "<p>Tags: " + html.EscapeString(strings.Join(thread.Tags, ", ")) + "</p>"
+	}
+	return feed.Entry{
+		ID:         threadURL(thread.ID, 0),
+		Title:      thread.Name,
+		Link:       threadURL(thread.ID, 0),
+		Author:     thread.UserName,
+		Published:  createdAt,
+		Updated:    lastChanged(createdAt, thread.EditedAt),
+		HTML:       content,
+		Categories: thread.Tags,
+	}
+}
+
+func commentEntry(comment Comment, threadName string) feed.Entry {
+	return feed.Entry{
+		ID:        threadURL(comment.ThreadID, comment.ID),
+		Title:     comment.UserName + " commented on " + threadName,
+		Link:      threadURL(comment.ThreadID, comment.ID),
+		Author:    comment.UserName,
+		Published: comment.CreatedAt,
+		Updated:   lastChanged(comment.CreatedAt, comment.EditedAt),
+		HTML:      comment.TextHTML,
+	}
+}
+
+// Check whether an If-None-Match header matches an ETag, ignoring weakness
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a feed as Atom or RSS, responding with Not Modified if the client
+// already has the current version according to its ETag or Last-Modified time
+func serveFeed(c *gin.Context, f feed.Feed, rss bool) {
+	body, err := feed.Atom(f)
+	contentType := "application/atom+xml; charset=utf-8"
+	if rss {
+		body, err = feed.RSS(f)
+		contentType = "application/rss+xml; charset=utf-8"
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write feed"})
+		return
+	}
+
+	// Let clients cache the feed, but revalidate it every time. Feeds of logged-in
+	// users may include private categories, so shared caches must not keep them.
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	lastModified := f.Updated.UTC().Truncate(time.Second)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	if _, ok := currentUserID(c); ok {
+		c.Header("Cache-Control", "private, no-cache")
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		if etagMatches(match, etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// Parse the thread filter of a feed, which has feedSize entries by default
+func parseFeedFilter(c *gin.Context, db *sql.DB) (threadFilter, bool) {
+	filter, err := parseThreadFilter(c, db)
+	if err != nil {
+		respondWithError(c, err, "Failed to parse filter")
+		return filter, false
+	}
+	if c.Query("limit") == "" {
+		filter.Limit = feedSize
+	}
+	return filter, true
+}
+
+// Build a feed of threads
+func threadsFeed(c *gin.Context, db *sql.DB, filter threadFilter, title string, link string) (feed.Feed, error) {
+	threads, err := queryThreads(db, filter)
+	if err != nil {
+		return feed.Feed{}, err
+	}
+	f := feed.Feed{Title: title, Link: link, Self: feedSelfURL(c)}
+	for _, thread := range threads {
+		f.Entries = append(f.Entries, threadEntry(thread))
+	}
+	f.SetUpdated(time.Unix(0, 0))
+	return f, nil
+}
+
+// Atom feed of the latest threads, accepting the same filters as ListThreads.
+// Feed readers cannot log in, so a feed token may be given as a token query
+// parameter to include private categories.
+func ThreadsFeed(c *gin.Context, db *sql.DB) {
+	if !authenticateFeedToken(c, db) {
+		return
+	}
+	filter, ok := parseFeedFilter(c, db)
+	if !ok {
+		return
+	}
+	f, err := threadsFeed(c, db, filter, "Latest threads", siteLinks.Frontend)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	serveFeed(c, f, false)
+}
+
+// RSS feed of the latest threads with a tag, or a tag nested under it, at
+// /feeds/tags/:name.rss
+func TagFeed(c *gin.Context, db *sql.DB) {
+	if !authenticateFeedToken(c, db) {
+		return
+	}
+	name, found := strings.CutSuffix(c.Param("file"), ".rss")
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+
+	// Resolve the tag, which may be a synonym
+	tags, err := resolveTags(db, []string{name})
+	if _, ok := err.(inputError); ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+	set, err := getTagSet(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+
+	filter, ok := parseFeedFilter(c, db)
+	if !ok {
+		return
+	}
+	filter.Tags = append(filter.Tags, set.descendants(tags[0].ID))
+	link := siteLinks.Frontend + "/?tags=" + url.QueryEscape(tags[0].Name)
+	f, err := threadsFeed(c, db, filter, "Threads tagged "+tags[0].Name, link)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	f.Description = tags[0].Description
+	serveFeed(c, f, true)
+}
+
+// Atom feed of the latest comments in a thread
+func ThreadCommentsFeed(c *gin.Context, db *sql.DB) {
+	if !authenticateFeedToken(c, db) {
+		return
+	}
+	threadID, ok := readableThreadParam(c, db)
+	if !ok {
+		return
+	}
+	viewerID, _ := currentUserID(c)
+
+	// Query the thread and its latest comments the same way as ListComments
+	var name string
+	var createdAt time.Time
+	if err := db.QueryRow("SELECT name, created_at FROM threads WHERE id = $1", threadID).Scan(&name, &createdAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	comments, err := queryComments(db, viewerID, "m.thread_id = $1 AND m.deleted_at IS NULL AND m.hidden_at IS NULL ORDER BY m.id DESC LIMIT $2", threadID, feedSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	f := feed.Feed{Title: "Comments on " + name, Link: threadURL(threadID, 0), Self: feedSelfURL(c)}
+	for _, comment := range comments {
+		f.Entries = append(f.Entries, commentEntry(comment, name))
+	}
+	f.SetUpdated(createdAt)
+	serveFeed(c, f, false)
+}
+
+// Atom feed of the latest threads and comments posted by a user, at
+// /feeds/users/:id.atom
+func UserFeed(c *gin.Context, db *sql.DB) {
+	if !authenticateFeedToken(c, db) {
+		return
+	}
+	id, found := strings.CutSuffix(c.Param("file"), ".atom")
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	viewerID, _ := currentUserID(c)
+
+	// Look up the user
+	var username string
+	err = db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+
+	// Query the user's latest threads and comments in the readable categories
+	readable, err := readableCategoryIDs(c, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	threads, err := queryThreads(db, threadFilter{Categories: readable, Mode: tagModeAll, AuthorID: userID, Sort: "newest", Limit: feedSize})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	comments, err := queryComments(db, viewerID, `m.user_id = $1 AND m.deleted_at IS NULL AND m.hidden_at IS NULL
+	AND m.thread_id IN (SELECT id FROM threads WHERE deleted_at IS NULL AND hidden_at IS NULL AND category_id = ANY($2))
+	ORDER BY m.id DESC LIMIT $3`, userID, pq.Array(readable), feedSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Name the threads the comments are in
+	threadIDs := make([]int, len(comments))
+	for i, comment := range comments {
+		threadIDs[i] = comment.ThreadID
+	}
+	threadNames := make(map[int]string)
+	rows, err := db.Query("SELECT id, name FROM threads WHERE id = ANY($1)", pq.Array(threadIDs))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		threadNames[id] = name
+	}
+
+	// Merge the threads and comments, newest first
+	f := feed.Feed{Title: "Posts by " + username, Link: siteLinks.Frontend + "/users/" + strconv.Itoa(userID), Self: feedSelfURL(c)}
+	for _, thread := range threads {
+		f.Entries = append(f.Entries, threadEntry(thread))
+	}
+	for _, comment := range comments {
+		f.Entries = append(f.Entries, commentEntry(comment, threadNames[comment.ThreadID]))
+	}
+	sort.SliceStable(f.Entries, func(i, j int) bool {
+		return f.Entries[i].Published.After(f.Entries[j].Published)
+	})
+	if len(f.Entries) > feedSize {
+		f.Entries = f.Entries[:feedSize]
+	}
+	f.SetUpdated(time.Unix(0, 0))
+	serveFeed(c, f, false)
+}
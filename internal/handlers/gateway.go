@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Timing and limits of WebSocket connections. The server pings every
+// wsPingInterval and closes connections that send nothing, including pongs,
+// for wsReadTimeout.
+const (
+	wsPingInterval     = 25 * time.Second
+	wsReadTimeout      = 60 * time.Second
+	wsWriteTimeout     = 10 * time.Second
+	wsTypingInterval   = 2 * time.Second
+	wsSendBuffer       = 32
+	wsMaxMessageBytes  = 4096
+	wsMaxSubscriptions = 50
+)
+
+// A message sent over a WebSocket connection in either direction. Clients send
+// subscribe, unsubscribe, typing and pong messages. The server sends comment
+// events, presence, typing, ping and error messages.
+type wsMessage struct {
+	Type      string   `json:"type"`
+	ThreadID  int      `json:"thread_id,omitempty"`
+	CommentID int      `json:"comment_id,omitempty"`
+	Comment   *Comment `json:"comment,omitempty"`
+	Viewers   int      `json:"viewers,omitempty"`
+	UserID    int      `json:"user_id,omitempty"`
+	UserName  string   `json:"user_name,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Types of WebSocket messages besides comment events
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsPresence    = "presence"
+	wsTyping      = pubsub.Typing
+	wsPing        = "ping"
+	wsPong        = "pong"
+	wsError       = "error"
+)
+
+// Tracks the WebSocket clients viewing each thread
+type gateway struct {
+	mu      sync.Mutex
+	viewers map[int]map[*wsClient]struct{}
+}
+
+var realtime = &gateway{viewers: make(map[int]map[*wsClient]struct{})}
+
+// A WebSocket connection and the threads it is subscribed to
+type wsClient struct {
+	conn      *websocket.Conn
+	userID    int
+	userName  string
+	send      chan wsMessage
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Only used by the connection's read loop
+	threads    map[int]chan struct{}
+	lastTyping map[int]time.Time
+}
+
+// Queue a message for the client without blocking. Ephemeral messages, such as
+// presence and typing, are dropped if the client is not keeping up. Otherwise
+// the slow client is disconnected so it can reconnect and catch up.
+func (client *wsClient) enqueue(msg wsMessage, ephemeral bool) {
+	select {
+	case client.send <- msg:
+	case <-client.done:
+	default:
+		if !ephemeral {
+			log.Printf("Closing slow WebSocket client of user %d", client.userID)
+			client.close()
+		}
+	}
+}
+
+func (client *wsClient) close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		client.conn.Close()
+	})
+}
+
+// Write queued messages and pings to the connection until it is closed
+func (client *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	defer client.close()
+	for {
+		var msg wsMessage
+		select {
+		case <-client.done:
+			return
+		case <-ping.C:
+			msg = wsMessage{Type: wsPing}
+		case msg = <-client.send:
+		}
+		client.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := websocket.JSON.Send(client.conn, msg); err != nil {
+			return
+		}
+	}
+}
+
+// Serve a WebSocket connection that streams the live events of the threads it
+// subscribes to, along with how many people are viewing them and who is typing.
+// Browsers cannot set headers on WebSocket requests, so the session token may
+// be given as a token query parameter. Any origin is accepted because
+// connections are authenticated by token rather than by cookie.
+func ServeWebSocket(c *gin.Context, db *sql.DB) {
+	if !authenticateQueryToken(c) {
+		return
+	}
+
+	// Look up the name shown in typing indicators
+	userID, _ := currentUserID(c)
+	var userName string
+	if userID != 0 {
+		if err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&userName); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			return
+		}
+	}
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = wsMaxMessageBytes
+			client := &wsClient{
+				conn:       conn,
+				userID:     userID,
+				userName:   userName,
+				send:       make(chan wsMessage, wsSendBuffer),
+				done:       make(chan struct{}),
+				threads:    make(map[int]chan struct{}),
+				lastTyping: make(map[int]time.Time),
+			}
+			realtime.serve(c, db, client)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+func (g *gateway) serve(c *gin.Context, db *sql.DB, client *wsClient) {
+	go client.writeLoop()
+
+	// Close the connection when the server shuts down
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			client.close()
+		case <-client.done:
+		}
+	}()
+
+	// Leave every thread once the connection ends
+	defer func() {
+		client.close()
+		for threadID := range client.threads {
+			g.unsubscribe(client, threadID)
+		}
+	}()
+
+	// Handle messages until the client disconnects or stops responding
+	for {
+		client.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		var msg wsMessage
+		if err := websocket.JSON.Receive(client.conn, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case wsSubscribe:
+			g.subscribe(c, db, client, msg.ThreadID)
+		case wsUnsubscribe:
+			if _, ok := client.threads[msg.ThreadID]; ok {
+				g.unsubscribe(client, msg.ThreadID)
+			}
+		case wsTyping:
+			g.typing(c, db, client, msg.ThreadID)
+		case wsPong:
+		default:
+			client.enqueue(wsMessage{Type: wsError, Error: "Unknown message type: " + msg.Type}, true)
+		}
+	}
+}
+
+// Subscribe a client to a thread's events if it may read the thread
+func (g *gateway) subscribe(c *gin.Context, db *sql.DB, client *wsClient, threadID int) {
+	if _, ok := client.threads[threadID]; ok {
+		return
+	}
+	if len(client.threads) >= wsMaxSubscriptions {
+		client.enqueue(wsMessage{Type: wsError, ThreadID: threadID, Error: "Too many subscriptions"}, true)
+		return
+	}
+	allowed, err := checkThreadAccess(c, db, threadID, false)
+	if err == sql.ErrNoRows {
+		client.enqueue(wsMessage{Type: wsError, ThreadID: threadID, Error: "Thread not found"}, true)
+		return
+	}
+	if err != nil {
+		client.enqueue(wsMessage{Type: wsError, ThreadID: threadID, Error: "Failed to look up thread"}, true)
+		return
+	}
+	if !allowed {
+		client.enqueue(wsMessage{Type: wsError, ThreadID: threadID, Error: "You cannot read this category"}, true)
+		return
+	}
+
+	// Forward the thread's comment events until the client unsubscribes
+	stopped := make(chan struct{})
+	client.threads[threadID] = stopped
+	events, unsubscribe := threadEvents.subscribe(threadID)
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-client.done:
+				return
+			case event, ok := <-events:
+				if !ok {
+					// The hub dropped the subscription because the client fell behind
+					client.close()
+					return
+				}
+				g.forward(db, client, event)
+			}
+		}
+	}()
+
+	// Join the thread's viewers
+	g.mu.Lock()
+	if g.viewers[threadID] == nil {
+		g.viewers[threadID] = make(map[*wsClient]struct{})
+	}
+	g.viewers[threadID][client] = struct{}{}
+	g.mu.Unlock()
+	g.broadcastPresence(threadID)
+}
+
+// Unsubscribe a client from a thread and leave its viewers
+func (g *gateway) unsubscribe(client *wsClient, threadID int) {
+	close(client.threads[threadID])
+	delete(client.threads, threadID)
+	delete(client.lastTyping, threadID)
+
+	g.mu.Lock()
+	delete(g.viewers[threadID], client)
+	if len(g.viewers[threadID]) == 0 {
+		delete(g.viewers, threadID)
+	}
+	g.mu.Unlock()
+	g.broadcastPresence(threadID)
+}
+
+// Send an event to a client, loading the comment it refers to as the client
+// sees it
+func (g *gateway) forward(db *sql.DB, client *wsClient, event *threadEvent) {
+	// Show other users typing, but not the user themselves
+	if event.Type == pubsub.Typing {
+		if event.UserID != client.userID {
+			client.enqueue(wsMessage{Type: wsTyping, ThreadID: event.ThreadID, UserID: event.UserID, UserName: event.UserName}, true)
+		}
+		return
+	}
+
+	msg := wsMessage{Type: event.Type, ThreadID: event.ThreadID, CommentID: event.CommentID, UserID: event.UserID}
+	data, err := event.data(db, client.userID)
+	if err != nil {
+		log.Printf("Error loading %s event for WebSocket: %v", event.Type, err)
+		return
+	}
+	if data == nil {
+		return
+	}
+	if comment, ok := data.(*Comment); ok {
+		msg.Comment = comment
+	}
+	client.enqueue(msg, false)
+}
+
+// Send the number of people viewing a thread to its viewers. Each logged-in
+// user counts once however many connections they have open. Presence is
+// counted per instance, so viewers connected to other instances are not
+// included.
+func (g *gateway) broadcastPresence(threadID int) {
+	g.mu.Lock()
+	users := make(map[int]bool)
+	anonymous := 0
+	clients := make([]*wsClient, 0, len(g.viewers[threadID]))
+	for client := range g.viewers[threadID] {
+		if client.userID == 0 {
+			anonymous++
+		} else {
+			users[client.userID] = true
+		}
+		clients = append(clients, client)
+	}
+	g.mu.Unlock()
+
+	msg := wsMessage{Type: wsPresence, ThreadID: threadID, Viewers: len(users) + anonymous}
+	for _, client := range clients {
+		client.enqueue(msg, true)
+	}
+}
+
+// Tell a thread's other viewers that a user is typing. Clients should hide the
+// indicator if it is not repeated within a few seconds. Like presence, typing
+// is ephemeral and only reaches the viewers connected to this instance, so it
+// is not published to the other instances.
+func (g *gateway) typing(c *gin.Context, db *sql.DB, client *wsClient, threadID int) {
+	if client.userID == 0 {
+		client.enqueue(wsMessage{Type: wsError, ThreadID: threadID, Error: "Login required"}, true)
+		return
+	}
+	if _, ok := client.threads[threadID]; !ok {
+		client.enqueue(wsMessage{Type: wsError, ThreadID: threadID, Error: "Subscribe to the thread first"}, true)
+		return
+	}
+
+	// Limit how often each client's typing is broadcast
+	now := time.Now()
+	if now.Sub(client.lastTyping[threadID]) < wsTypingInterval {
+		return
+	}
+	client.lastTyping[threadID] = now
+	if allowed, err := checkThreadAccess(c, db, threadID, true); err != nil || !allowed {
+		return
+	}
+	threadEvents.publish(pubsub.Event{Type: pubsub.Typing, ThreadID: threadID, UserID: client.userID, UserName: client.userName})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of inbound requests. Signed requests older than inboundMaxAge are
+// rejected so they cannot be replayed later.
+const (
+	inboundMaxAge       = 5 * time.Minute
+	maxInboundBodyBytes = 1 << 20
+	maxInboundEmail     = 10 << 20
+)
+
+// Read the body of an inbound request and verify that it was signed with the
+// INBOUND_SECRET, the same way outgoing webhooks are signed. Responds with an
+// error and returns false otherwise.
+func readSignedBody(c *gin.Context, limit int64) ([]byte, bool) {
+	secret := os.Getenv("INBOUND_SECRET")
+	if secret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Inbound requests are not configured"})
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+		return nil, false
+	}
+
+	// Check the timestamp, then the signature over it and the body
+	timestamp := c.GetHeader("X-Webhook-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid timestamp"})
+		return nil, false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > inboundMaxAge || age < -inboundMaxAge {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Request timestamp is too old"})
+		return nil, false
+	}
+	if !hmac.Equal([]byte(c.GetHeader("X-Webhook-Signature")), []byte(signWebhook(secret, timestamp, body))) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return nil, false
+	}
+	return body, true
+}
+
+// Run a creation handler on behalf of a user with a JSON request body, so
+// inbound content goes through the same checks and side effects as content
+// posted by the user
+func createAs(c *gin.Context, db *sql.DB, userID int, body []byte, handler func(*gin.Context, *sql.DB)) {
+	c.Set("userID", userID)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handler(c, db)
+}
+
+// Check that a user exists
+func userExists(db *sql.DB, userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+	return exists, err
+}
+
+// Signed inbound webhook for external systems to create threads and comments.
+// The body is {"type": "thread" or "comment", "data": {...}}, where data is the
+// body accepted by POST /threads or POST /comments, and the content is posted
+// as the user given by data.user_id.
+func InboundWebhook(c *gin.Context, db *sql.DB) {
+	body, ok := readSignedBody(c, maxInboundBodyBytes)
+	if !ok {
+		return
+	}
+
+	// Parse the request body and the user to post as
+	var input struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var author struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.Unmarshal(input.Data, &author); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		return
+	}
+	exists, err := userExists(db, author.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Create the thread or comment
+	switch input.Type {
+	case "thread":
+		createAs(c, db, author.UserID, input.Data, CreateThread)
+	case "comment":
+		createAs(c, db, author.UserID, input.Data, CreateComment)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Type must be thread or comment"})
+	}
+}
+
+// Create the token in the reply address of notification emails about a thread.
+// It is lowercase hex so mail servers that change the case of addresses do not
+// break it.
+func replyToken(userID int, threadID int) string {
+	payload := strconv.Itoa(userID) + "." + strconv.Itoa(threadID)
+	mac := hmac.New(sha256.New, getSessionSecret())
+	mac.Write([]byte("reply:" + payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Parse a reply token, returning the user and thread it was issued for
+func parseReplyToken(token string) (int, int, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	threadID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	if !hmac.Equal([]byte(strings.ToLower(token)), []byte(replyToken(userID, threadID))) {
+		return 0, 0, false
+	}
+	return userID, threadID, true
+}
+
+// Plus-address a reply address with a reply token, turning reply@example.com
+// into reply+token@example.com
+func replyAddress(address string, userID int, threadID int) string {
+	local, domain, _ := strings.Cut(address, "@")
+	return local + "+" + replyToken(userID, threadID) + "@" + domain
+}
+
+// Find the reply token in the plus-addressed recipients of an email
+func findReplyToken(recipients []string) (int, int, bool) {
+	for _, recipient := range recipients {
+		local, _, _ := strings.Cut(recipient, "@")
+		if _, token, found := strings.Cut(local, "+"); found {
+			if userID, threadID, ok := parseReplyToken(token); ok {
+				return userID, threadID, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Signed endpoint for inbound emails, posted as raw RFC 5322 messages by the
+// mail provider. A reply to a notification email becomes a comment on its
+// thread, posted as the user the notification was sent to, provided the reply
+// comes from that user's email address.
+func InboundEmail(c *gin.Context, db *sql.DB) {
+	body, ok := readSignedBody(c, maxInboundEmail)
+	if !ok {
+		return
+	}
+
+	// Parse the email and find the thread it replies to
+	email, err := mail.Parse(bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email: " + err.Error()})
+		return
+	}
+	userID, threadID, ok := findReplyToken(email.Recipients)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No valid reply address among the recipients"})
+		return
+	}
+
+	// Ensure the sender is the user the reply address was issued to
+	var userEmail sql.NullString
+	err = db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&userEmail)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+	if !userEmail.Valid || !strings.EqualFold(userEmail.String, email.From) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The sender does not match the reply address"})
+		return
+	}
+
+	// Keep only the new text of the reply
+	text := mail.StripReply(email.Text)
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The reply is empty"})
+		return
+	}
+
+	// Post the reply as a comment
+	comment, err := json.Marshal(gin.H{"thread_id": threadID, "user_id": userID, "text": text})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create comment"})
+		return
+	}
+	createAs(c, db, userID, comment, CreateComment)
+}
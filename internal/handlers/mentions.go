@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"github.com/CVWO/sample-go-app/internal/render"
+	"github.com/lib/pq"
+)
+
+// Common interface of *sql.DB and *sql.Tx, so helpers can run inside or outside a transaction
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Resolve the @mentions in a thread name or comment text and store them,
+// replacing any mentions saved for a previous version of the text. A commentID
+// of 0 means the text is the thread's name. Users who are newly mentioned are
+// notified. Returns the mentioned users keyed by username, for rendering.
+func saveMentions(q queryer, threadID int, commentID int, authorID int, text string) (map[string]int, error) {
+	// Find who was mentioned in the previous version, so they are not notified again
+	previous := make(map[int]bool)
+	rows, err := q.Query("SELECT user_id FROM mentions WHERE thread_id = $1 AND comment_id IS NOT DISTINCT FROM $2", threadID, nullableID(commentID))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		previous[userID] = true
+	}
+	rows.Close()
+
+	// Clear the previous mentions
+	_, err = q.Exec("DELETE FROM mentions WHERE thread_id = $1 AND comment_id IS NOT DISTINCT FROM $2", threadID, nullableID(commentID))
+	if err != nil {
+		return nil, err
+	}
+
+	mentioned := make(map[string]int)
+	usernames := render.Mentions(text)
+	if len(usernames) == 0 {
+		return mentioned, nil
+	}
+
+	// Resolve the usernames, ignoring unknown users and users who blocked the author
+	rows, err = q.Query(`
+	SELECT u.id, u.username
+	FROM users u
+	WHERE u.username = ANY($1)
+	AND NOT EXISTS (SELECT 1 FROM user_blocks b WHERE b.user_id = u.id AND b.blocked_user_id = $2)
+	`, pq.Array(usernames), authorID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var userID int
+		var username string
+		if err := rows.Scan(&userID, &username); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		mentioned[username] = userID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Store the mentions
+	var newlyMentioned []int
+	for _, userID := range mentioned {
+		_, err := q.Exec("INSERT INTO mentions (thread_id, comment_id, user_id, author_id) VALUES ($1, $2, $3, $4)", threadID, nullableID(commentID), userID, authorID)
+		if err != nil {
+			return nil, err
+		}
+		if !previous[userID] {
+			newlyMentioned = append(newlyMentioned, userID)
+		}
+	}
+
+	// Notify the newly mentioned users
+	event := notificationEvent{Type: NotificationMention, ActorID: authorID, ThreadID: threadID, CommentID: commentID}
+	if err := dispatch(q, event, newlyMentioned); err != nil {
+		return nil, err
+	}
+
+	return mentioned, nil
+}
+
+// Get the users mentioned in each of the given comments, keyed by comment ID and then username
+func getCommentMentions(db *sql.DB, commentIDs []int) (map[int]map[string]int, error) {
+	return queryMentions(db, `
+	SELECT m.comment_id, u.username, u.id
+	FROM mentions m
+	JOIN users u ON u.id = m.user_id
+	WHERE m.comment_id = ANY($1)
+	`, commentIDs)
+}
+
+// Get the users mentioned in each of the given thread names, keyed by thread ID and then username
+func getThreadMentions(db *sql.DB, threadIDs []int) (map[int]map[string]int, error) {
+	return queryMentions(db, `
+	SELECT m.thread_id, u.username, u.id
+	FROM mentions m
+	JOIN users u ON u.id = m.user_id
+	WHERE m.thread_id = ANY($1) AND m.comment_id IS NULL
+	`, threadIDs)
+}
+
+// Run a mention query for a set of IDs in a single query
+func queryMentions(db *sql.DB, query string, ids []int) (map[int]map[string]int, error) {
+	mentions := make(map[int]map[string]int)
+	if len(ids) == 0 {
+		return mentions, nil
+	}
+
+	rows, err := db.Query(query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, userID int
+		var username string
+		if err := rows.Scan(&id, &username, &userID); err != nil {
+			return nil, err
+		}
+		if mentions[id] == nil {
+			mentions[id] = make(map[string]int)
+		}
+		mentions[id][username] = userID
+	}
+	return mentions, rows.Err()
+}
@@ -0,0 +1,611 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/render"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// A private conversation between two or more users
+type Conversation struct {
+	ID                int           `json:"id"`
+	Participants      []Participant `json:"participants"`
+	LastMessage       DirectMessage `json:"last_message"`
+	LastReadMessageID *int          `json:"last_read_message_id"`
+	UnreadCount       int           `json:"unread_count"`
+	CreatedAt         time.Time     `json:"created_at"`
+}
+
+type Participant struct {
+	UserID   int    `json:"user_id"`
+	UserName string `json:"user_name"`
+}
+
+// A message in a conversation. The sender is null if their account was deleted.
+type DirectMessage struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	UserID         *int      `json:"user_id"`
+	UserName       *string   `json:"user_name"`
+	Text           string    `json:"text"`
+	TextHTML       string    `json:"text_html"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Limits of conversations and messages. Participants include the user who
+// started the conversation.
+const (
+	maxConversationParticipants = 10
+	maxMessageLength            = 10000
+)
+
+// Conversations and messages returned per page by default and at most
+const (
+	defaultConversationLimit = 20
+	defaultMessageLimit      = 50
+	maxMessageLimit          = 100
+)
+
+// Parse the ?cursor=ID&limit=N parameters of a page, responding with an error
+// and returning false if they are invalid. A cursor of 0 means the first page.
+func parsePage(c *gin.Context, defaultLimit int, maxLimit int) (int, int, bool) {
+	limit := defaultLimit
+	if param := c.Query("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxLimit)})
+			return 0, 0, false
+		}
+	}
+	cursor := 0
+	if param := c.Query("cursor"); param != "" {
+		var err error
+		cursor, err = strconv.Atoi(param)
+		if err != nil || cursor <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return 0, 0, false
+		}
+	}
+	return cursor, limit, true
+}
+
+// Get the ID of the conversation checked by RequireParticipant
+func currentConversationID(c *gin.Context) int {
+	return c.GetInt("conversationID")
+}
+
+// Validate the text of a message, returning it without surrounding whitespace
+func validateMessageText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", inputError{"Message text is required"}
+	}
+	if len(text) > maxMessageLength {
+		return "", inputError{"Message text must be at most " + strconv.Itoa(maxMessageLength) + " bytes"}
+	}
+	return text, nil
+}
+
+// Columns selected to scan a message, from direct_messages m joined with the
+// sender as u
+const messageColumns = "m.id, m.conversation_id, m.user_id, u.username, m.text, m.created_at"
+
+func scanMessage(row interface{ Scan(...interface{}) error }, m *DirectMessage) error {
+	return row.Scan(&m.ID, &m.ConversationID, &m.UserID, &m.UserName, &m.Text, &m.CreatedAt)
+}
+
+// Render the text of messages the same way as comments. Mentions are linked,
+// but the mentioned users are not notified, as they may not be participants.
+func renderMessages(q queryer, messages []DirectMessage) error {
+	var usernames []string
+	for _, message := range messages {
+		usernames = append(usernames, render.Mentions(message.Text)...)
+	}
+
+	// Resolve the mentioned usernames with a single query
+	users := make(map[string]int)
+	if len(usernames) > 0 {
+		rows, err := q.Query("SELECT id, username FROM users WHERE username = ANY($1)", pq.Array(usernames))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var username string
+			if err := rows.Scan(&id, &username); err != nil {
+				rows.Close()
+				return err
+			}
+			users[username] = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for i := range messages {
+		messages[i].TextHTML = render.HTML(messages[i].Text, users)
+	}
+	return nil
+}
+
+// Check whether any of the given users blocked a user, who then cannot send
+// them messages
+func blockedByAny(q queryer, userID int, userIDs []int) (bool, error) {
+	var blocked bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM user_blocks WHERE user_id = ANY($1) AND blocked_user_id = $2)", pq.Array(userIDs), userID).Scan(&blocked)
+	return blocked, err
+}
+
+// Add a message to a conversation. The sender has read their own message, so
+// their read position moves to it.
+func sendMessage(q queryer, conversationID int, userID int, text string) (DirectMessage, error) {
+	message := DirectMessage{ConversationID: conversationID, UserID: &userID, Text: text}
+	err := q.QueryRow(`
+	INSERT INTO direct_messages (conversation_id, user_id, text) VALUES ($1, $2, $3)
+	RETURNING id, created_at, (SELECT username FROM users WHERE id = $2)
+	`, conversationID, userID, text).Scan(&message.ID, &message.CreatedAt, &message.UserName)
+	if err != nil {
+		return message, err
+	}
+	if _, err := q.Exec("UPDATE conversations SET last_message_id = $1 WHERE id = $2", message.ID, conversationID); err != nil {
+		return message, err
+	}
+	_, err = q.Exec("UPDATE conversation_participants SET last_read_message_id = $1 WHERE conversation_id = $2 AND user_id = $3", message.ID, conversationID, userID)
+	if err != nil {
+		return message, err
+	}
+	messages := []DirectMessage{message}
+	err = renderMessages(q, messages)
+	return messages[0], err
+}
+
+// Query the conversations of a user matching a condition, with their latest
+// message, the user's unread count and the participants. The condition is
+// appended to the WHERE clause and may use $2 onwards, followed by ORDER BY
+// and LIMIT. Messages sent by the user never count as unread.
+func queryConversations(db *sql.DB, userID int, condition string, args ...interface{}) ([]Conversation, error) {
+	rows, err := db.Query(`
+	SELECT c.id, c.created_at, p.last_read_message_id,
+		(SELECT COUNT(*) FROM direct_messages d
+		 WHERE d.conversation_id = c.id AND d.id > COALESCE(p.last_read_message_id, 0) AND d.user_id IS DISTINCT FROM p.user_id),
+		`+messageColumns+`
+	FROM conversation_participants p
+	JOIN conversations c ON c.id = p.conversation_id
+	JOIN direct_messages m ON m.id = c.last_message_id
+	LEFT JOIN users u ON u.id = m.user_id
+	WHERE p.user_id = $1 AND `+condition, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	var messages []DirectMessage
+	index := make(map[int]int)
+	for rows.Next() {
+		var conversation Conversation
+		m := &conversation.LastMessage
+		err := rows.Scan(&conversation.ID, &conversation.CreatedAt, &conversation.LastReadMessageID, &conversation.UnreadCount,
+			&m.ID, &m.ConversationID, &m.UserID, &m.UserName, &m.Text, &m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		conversation.Participants = []Participant{}
+		index[conversation.ID] = len(conversations)
+		conversations = append(conversations, conversation)
+		messages = append(messages, conversation.LastMessage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(conversations) == 0 {
+		return conversations, nil
+	}
+
+	// Render the latest messages
+	if err := renderMessages(db, messages); err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		conversations[i].LastMessage = messages[i]
+	}
+
+	// Attach the participants with a single query
+	conversationIDs := make([]int, len(conversations))
+	for i, conversation := range conversations {
+		conversationIDs[i] = conversation.ID
+	}
+	participantRows, err := db.Query(`
+	SELECT p.conversation_id, p.user_id, u.username
+	FROM conversation_participants p
+	JOIN users u ON u.id = p.user_id
+	WHERE p.conversation_id = ANY($1)
+	ORDER BY p.joined_at, u.username
+	`, pq.Array(conversationIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer participantRows.Close()
+	for participantRows.Next() {
+		var conversationID int
+		var participant Participant
+		if err := participantRows.Scan(&conversationID, &participant.UserID, &participant.UserName); err != nil {
+			return nil, err
+		}
+		i := index[conversationID]
+		conversations[i].Participants = append(conversations[i].Participants, participant)
+	}
+	return conversations, participantRows.Err()
+}
+
+// Query a conversation of a user
+func getConversation(db *sql.DB, userID int, conversationID int) (Conversation, error) {
+	conversations, err := queryConversations(db, userID, "c.id = $2", conversationID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if len(conversations) == 0 {
+		return Conversation{}, sql.ErrNoRows
+	}
+	return conversations[0], nil
+}
+
+// Conversation listing endpoint for the logged-in user, ordered by their latest
+// message. Pages are requested with ?cursor=ID&limit=N, where the cursor is the
+// next_cursor of the previous page.
+func ListConversations(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+	cursor, limit, ok := parsePage(c, defaultConversationLimit, maxMessageLimit)
+	if !ok {
+		return
+	}
+
+	// Query database for the page of conversations, fetching one extra to know whether another page follows
+	conversations, err := queryConversations(db, userID, "($2 = 0 OR c.last_message_id < $2) ORDER BY c.last_message_id DESC LIMIT $3", cursor, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return the page of conversations with the cursor of the next page, if any
+	var nextCursor *int
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		nextCursor = &conversations[limit-1].LastMessage.ID
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": conversations, "next_cursor": nextCursor})
+}
+
+// Conversation retrieval endpoint
+func GetConversation(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+	conversation, err := getConversation(db, userID, currentConversationID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, conversation)
+}
+
+// Start a conversation with one or more users with a first message. Starting
+// a one-to-one conversation with someone the user already has one with adds
+// the message to the existing conversation instead.
+func CreateConversation(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse and validate the request body
+	var input struct {
+		UserIDs []int  `json:"user_ids" binding:"required"`
+		Text    string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	text, err := validateMessageText(input.Text)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Collect the other participants without duplicates
+	var recipients []int
+	seen := map[int]bool{userID: true}
+	for _, id := range input.UserIDs {
+		if !seen[id] {
+			seen[id] = true
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A conversation needs at least one other user"})
+		return
+	}
+	if len(recipients)+1 > maxConversationParticipants {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A conversation can have at most " + strconv.Itoa(maxConversationParticipants) + " participants"})
+		return
+	}
+
+	// Ensure the recipients exist and accept messages from the user
+	var found int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ANY($1)", pq.Array(recipients)).Scan(&found); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up users"})
+		return
+	}
+	if found != len(recipients) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	blocked, err := blockedByAny(db, userID, recipients)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up blocks"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot message these users"})
+		return
+	}
+
+	// Start a transaction so the conversation and its first message are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Find an existing one-to-one conversation, or create the conversation
+	var conversationID int
+	status := http.StatusOK
+	err = sql.ErrNoRows
+	if len(recipients) == 1 {
+		err = tx.QueryRow(`
+		SELECT conversation_id FROM conversation_participants
+		WHERE conversation_id IN (SELECT conversation_id FROM conversation_participants WHERE user_id = $1)
+		GROUP BY conversation_id
+		HAVING COUNT(*) = 2 AND BOOL_OR(user_id = $2)
+		ORDER BY conversation_id
+		LIMIT 1
+		`, userID, recipients[0]).Scan(&conversationID)
+	}
+	if err == sql.ErrNoRows {
+		status = http.StatusCreated
+		err = tx.QueryRow("INSERT INTO conversations (created_by) VALUES ($1) RETURNING id", userID).Scan(&conversationID)
+		if err == nil {
+			_, err = tx.Exec(`
+			INSERT INTO conversation_participants (conversation_id, user_id)
+			SELECT $1::int, unnest($2::int[])
+			`, conversationID, pq.Array(append([]int{userID}, recipients...)))
+		}
+	}
+	if err != nil {
+		log.Printf("Error creating conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+
+	// Send the first message
+	if _, err := sendMessage(tx, conversationID, userID, text); err != nil {
+		log.Printf("Error sending message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the conversation
+	conversation, err := getConversation(db, userID, conversationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, conversation)
+}
+
+// Message listing endpoint of a conversation, newest first. Pages are requested
+// with ?cursor=ID&limit=N, where the cursor is the next_cursor of the previous page.
+func ListMessages(c *gin.Context, db *sql.DB) {
+	conversationID := currentConversationID(c)
+	cursor, limit, ok := parsePage(c, defaultMessageLimit, maxMessageLimit)
+	if !ok {
+		return
+	}
+
+	// Query database for the page of messages, fetching one extra to know whether another page follows
+	rows, err := db.Query(`
+	SELECT `+messageColumns+`
+	FROM direct_messages m
+	LEFT JOIN users u ON u.id = m.user_id
+	WHERE m.conversation_id = $1 AND ($2 = 0 OR m.id < $2)
+	ORDER BY m.id DESC
+	LIMIT $3
+	`, conversationID, cursor, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// Create slice of messages
+	messages := []DirectMessage{}
+	for rows.Next() {
+		var message DirectMessage
+		if err := scanMessage(rows, &message); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Render the page of messages and return it with the cursor of the next page, if any
+	var nextCursor *int
+	if len(messages) > limit {
+		messages = messages[:limit]
+		nextCursor = &messages[limit-1].ID
+	}
+	if err := renderMessages(db, messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render messages"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages, "next_cursor": nextCursor})
+}
+
+// Send a message to a conversation. A user who was blocked by the other
+// participant of a one-to-one conversation can no longer send to it.
+func CreateMessage(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+	conversationID := currentConversationID(c)
+
+	// Parse and validate the request body
+	var input struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	text, err := validateMessageText(input.Text)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Ensure the other participant of a one-to-one conversation did not block the user
+	var others []int
+	rows, err := db.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = $1 AND user_id <> $2", conversationID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up participants"})
+		return
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up participants"})
+			return
+		}
+		others = append(others, id)
+	}
+	rows.Close()
+	if len(others) == 1 {
+		blocked, err := blockedByAny(db, userID, others)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up blocks"})
+			return
+		}
+		if blocked {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot message this user"})
+			return
+		}
+	}
+
+	// Start a transaction so the message and the conversation's order are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	message, err := sendMessage(tx, conversationID, userID, text)
+	if err != nil {
+		log.Printf("Error sending message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the message
+	c.JSON(http.StatusCreated, message)
+}
+
+// Mark a conversation as read up to and including a message, or up to its latest
+// message if none is given
+func MarkConversationRead(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+	conversationID := currentConversationID(c)
+
+	// Parse the optional message ID from the request body
+	var input struct {
+		MessageID int `json:"message_id"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	// Ensure the message belongs to the conversation, defaulting to the latest message
+	var lastRead sql.NullInt64
+	var err error
+	if input.MessageID != 0 {
+		err = db.QueryRow("SELECT id FROM direct_messages WHERE id = $1 AND conversation_id = $2", input.MessageID, conversationID).Scan(&lastRead)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Message not found in this conversation"})
+			return
+		}
+	} else {
+		err = db.QueryRow("SELECT last_message_id FROM conversations WHERE id = $1", conversationID).Scan(&lastRead)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up message"})
+		return
+	}
+
+	// Save the read position
+	_, err = db.Exec("UPDATE conversation_participants SET last_read_message_id = $1 WHERE conversation_id = $2 AND user_id = $3", lastRead, conversationID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark conversation as read"})
+		return
+	}
+
+	// Return the new read position
+	response := gin.H{"conversation_id": conversationID, "last_read_message_id": nil}
+	if lastRead.Valid {
+		response["last_read_message_id"] = lastRead.Int64
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Unread message count endpoint for the logged-in user, with the number of
+// conversations that have unread messages
+func CountUnreadMessages(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	var messages, conversations int
+	err := db.QueryRow(`
+	SELECT COUNT(m.id), COUNT(DISTINCT m.conversation_id)
+	FROM conversation_participants p
+	JOIN direct_messages m ON m.conversation_id = p.conversation_id
+		AND m.id > COALESCE(p.last_read_message_id, 0) AND m.user_id IS DISTINCT FROM p.user_id
+	WHERE p.user_id = $1
+	`, userID).Scan(&messages, &conversations)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count messages"})
+		return
+	}
+
+	// Return the counts
+	c.JSON(http.StatusOK, gin.H{"unread_count": messages, "unread_conversations": conversations})
+}
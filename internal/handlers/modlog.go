@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions recorded in the moderation log
+const (
+	LogUserSuspended     = "user_suspended"
+	LogUserBanned        = "user_banned"
+	LogSuspensionLifted  = "suspension_lifted"
+	LogSuspensionExpired = "suspension_expired"
+	LogRoleChanged       = "role_changed"
+	LogThreadDeleted     = "thread_deleted"
+	LogThreadRestored    = "thread_restored"
+	LogCommentDeleted    = "comment_deleted"
+	LogCommentRestored   = "comment_restored"
+	LogReportResolved    = "report_resolved"
+	LogTagCreated        = "tag_created"
+	LogTagUpdated        = "tag_updated"
+	LogTagDeleted        = "tag_deleted"
+	LogTagMerged         = "tag_merged"
+	LogTagSynonymAdded   = "tag_synonym_added"
+	LogTagSynonymDeleted = "tag_synonym_deleted"
+	LogCategoryCreated   = "category_created"
+	LogCategoryUpdated   = "category_updated"
+	LogCategoryDeleted   = "category_deleted"
+	LogWebhookCreated    = "webhook_created"
+	LogWebhookUpdated    = "webhook_updated"
+	LogWebhookDeleted    = "webhook_deleted"
+)
+
+// Tables of the kinds of targets whose rows are snapshotted in the log
+var logTargetTables = map[string]string{
+	"user":     "users",
+	"thread":   "threads",
+	"comment":  "comments",
+	"tag":      "tags",
+	"category": "categories",
+	"webhook":  "webhooks",
+}
+
+// Columns left out of snapshots, because they are derived or secret
+const snapshotExcludedColumns = "'search_vector', 'email', 'password_hash', 'secret'"
+
+// Number of log entries in a page unless a limit is given, and the maximum limit
+const (
+	defaultModerationLogLimit = 50
+	maxModerationLogLimit     = 200
+)
+
+// An entry of the moderation log as returned by the API
+type ModerationLogEntry struct {
+	ID           int             `json:"id"`
+	ActorID      *int            `json:"actor_id"`
+	ActorName    *string         `json:"actor_name"`
+	Action       string          `json:"action"`
+	TargetType   string          `json:"target_type"`
+	TargetID     *int            `json:"target_id"`
+	TargetUserID *int            `json:"target_user_id"`
+	Reason       string          `json:"reason"`
+	Details      json.RawMessage `json:"details"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+	IP           string          `json:"ip"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// An entry to append to the moderation log. A zero ActorID means the action
+// was taken automatically. Details, Before and After are stored as JSON, where
+// Before and After are the state of the target around the change.
+type moderationLogEntry struct {
+	ActorID      int
+	Action       string
+	TargetType   string
+	TargetID     int
+	TargetUserID int
+	Reason       string
+	Details      interface{}
+	Before       interface{}
+	After        interface{}
+	IP           string
+}
+
+// Marshal a value stored as JSON, or return nil to store NULL if there is none
+func logJSON(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Append an entry to the moderation log, usually in the same transaction as
+// the change it records so neither is saved without the other
+func logModeration(q queryer, entry moderationLogEntry) error {
+	details := []byte("{}")
+	if entry.Details != nil {
+		var err error
+		details, err = json.Marshal(entry.Details)
+		if err != nil {
+			return err
+		}
+	}
+	before, err := logJSON(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := logJSON(entry.After)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`
+	INSERT INTO moderation_log (actor_id, action, target_type, target_id, target_user_id, reason, details, before, after, ip)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, nullableID(entry.ActorID), entry.Action, entry.TargetType, nullableID(entry.TargetID), nullableID(entry.TargetUserID), entry.Reason, string(details), before, after, entry.IP)
+	return err
+}
+
+// Returned when logging an action of a request that is not authenticated
+var errNoActor = errors.New("moderated action without an authenticated actor")
+
+// Append an entry for an action of the logged-in user, recording their IP.
+// Every such action must have an actor, so it fails without one, which rolls
+// back the action along with the transaction.
+func logAction(c *gin.Context, q queryer, entry moderationLogEntry) error {
+	actorID, ok := currentUserID(c)
+	if !ok {
+		return errNoActor
+	}
+	entry.ActorID = actorID
+	entry.IP = c.ClientIP()
+	return logModeration(q, entry)
+}
+
+// Snapshot the row of a target as JSON, or return nil if it does not exist
+func snapshotTarget(q queryer, targetType string, targetID int) (json.RawMessage, error) {
+	var snapshot []byte
+	err := q.QueryRow("SELECT to_jsonb(t) - ARRAY["+snapshotExcludedColumns+"] FROM "+logTargetTables[targetType]+" t WHERE id = $1", targetID).Scan(&snapshot)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return snapshot, err
+}
+
+// Log a change to a target of the entry, given the snapshot taken before it.
+// The snapshot after the change is taken here, and changes to content are
+// logged against its author.
+func logChange(c *gin.Context, q queryer, entry moderationLogEntry, before json.RawMessage) error {
+	after, err := snapshotTarget(q, entry.TargetType, entry.TargetID)
+	if err != nil {
+		return err
+	}
+	entry.Before, entry.After = before, after
+	if entry.TargetType == "user" {
+		entry.TargetUserID = entry.TargetID
+	}
+	for _, snapshot := range []json.RawMessage{after, before} {
+		var row struct {
+			UserID int `json:"user_id"`
+		}
+		if entry.TargetUserID == 0 && snapshot != nil && json.Unmarshal(snapshot, &row) == nil {
+			entry.TargetUserID = row.UserID
+		}
+	}
+	return logAction(c, q, entry)
+}
+
+// Columns selected to scan a log entry, from moderation_log l joined with the
+// actor as u
+const moderationLogColumns = "l.id, l.actor_id, u.username, l.action, l.target_type, l.target_id, l.target_user_id, l.reason, l.details, l.before, l.after, l.ip, l.created_at"
+
+func scanModerationLogEntry(row interface{ Scan(...interface{}) error }, entry *ModerationLogEntry) error {
+	var details, before, after []byte
+	if err := row.Scan(&entry.ID, &entry.ActorID, &entry.ActorName, &entry.Action, &entry.TargetType, &entry.TargetID, &entry.TargetUserID, &entry.Reason, &details, &before, &after, &entry.IP, &entry.CreatedAt); err != nil {
+		return err
+	}
+	entry.Details = details
+	if before != nil {
+		entry.Before = before
+	}
+	if after != nil {
+		entry.After = after
+	}
+	return nil
+}
+
+// Parse the filters of the moderation log into a WHERE clause and its args.
+// The actor, target user and target can be filtered by ID, the action and
+// target type by name, and the time with from and to in RFC 3339.
+func parseModerationLogFilter(c *gin.Context) (string, []interface{}, error) {
+	where := "TRUE"
+	var args []interface{}
+	for _, filter := range []struct{ param, column string }{
+		{"actor_id", "l.actor_id"},
+		{"target_user_id", "l.target_user_id"},
+		{"target_id", "l.target_id"},
+	} {
+		if param := c.Query(filter.param); param != "" {
+			id, err := strconv.Atoi(param)
+			if err != nil {
+				return "", nil, inputError{"Invalid " + filter.param}
+			}
+			args = append(args, id)
+			where += " AND " + filter.column + " = $" + strconv.Itoa(len(args))
+		}
+	}
+	for _, filter := range []struct{ param, column string }{
+		{"action", "l.action"},
+		{"target_type", "l.target_type"},
+	} {
+		if param := c.Query(filter.param); param != "" {
+			args = append(args, param)
+			where += " AND " + filter.column + " = $" + strconv.Itoa(len(args))
+		}
+	}
+	for _, filter := range []struct{ param, operator string }{
+		{"from", ">="},
+		{"to", "<"},
+	} {
+		if param := c.Query(filter.param); param != "" {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return "", nil, inputError{filter.param + " must be a time in RFC 3339 format"}
+			}
+			args = append(args, t)
+			where += " AND l.created_at " + filter.operator + " $" + strconv.Itoa(len(args))
+		}
+	}
+	return where, args, nil
+}
+
+// Moderation log endpoint, newest first, accepting the filters of
+// parseModerationLogFilter. Pages are requested with ?cursor=ID&limit=N, where
+// the cursor is the next_cursor of the previous page, or the whole filtered
+// log is exported with ?format=csv.
+func ListModerationLog(c *gin.Context, db *sql.DB) {
+	where, args, err := parseModerationLogFilter(c)
+	if err != nil {
+		respondWithError(c, err, "Failed to parse filter")
+		return
+	}
+	csvExport := c.Query("format") == "csv"
+	if !csvExport && c.Query("format") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be csv"})
+		return
+	}
+
+	// Page the log unless it is exported
+	query := "SELECT " + moderationLogColumns + " FROM moderation_log l LEFT JOIN users u ON u.id = l.actor_id WHERE " + where
+	limit := 0
+	if !csvExport {
+		var cursor int
+		var ok bool
+		cursor, limit, ok = parsePage(c, defaultModerationLogLimit, maxModerationLogLimit)
+		if !ok {
+			return
+		}
+		if cursor != 0 {
+			args = append(args, cursor)
+			query += " AND l.id < $" + strconv.Itoa(len(args))
+		}
+		args = append(args, limit+1)
+		query += " ORDER BY l.id DESC LIMIT $" + strconv.Itoa(len(args))
+	} else {
+		query += " ORDER BY l.id DESC"
+	}
+
+	// Query database for the entries
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// Stream the export row by row, since it is not paged
+	if csvExport {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="moderation-log.csv"`)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"id", "created_at", "actor_id", "actor_name", "action", "target_type", "target_id", "target_user_id", "reason", "ip", "details", "before", "after"})
+		for rows.Next() {
+			var entry ModerationLogEntry
+			if err := scanModerationLogEntry(rows, &entry); err != nil {
+				// The status is already sent, so the export can only be cut short
+				w.Flush()
+				c.Error(err)
+				return
+			}
+			w.Write([]string{
+				strconv.Itoa(entry.ID),
+				entry.CreatedAt.UTC().Format(time.RFC3339),
+				csvID(entry.ActorID),
+				csvText(csvString(entry.ActorName)),
+				entry.Action,
+				entry.TargetType,
+				csvID(entry.TargetID),
+				csvID(entry.TargetUserID),
+				csvText(entry.Reason),
+				entry.IP,
+				string(entry.Details),
+				string(entry.Before),
+				string(entry.After),
+			})
+		}
+		w.Flush()
+		if err := rows.Err(); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+
+	// Create slice of entries
+	entries := []ModerationLogEntry{}
+	for rows.Next() {
+		var entry ModerationLogEntry
+		if err := scanModerationLogEntry(rows, &entry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return the page with the cursor of the next one, if any
+	var nextCursor *int
+	if len(entries) > limit {
+		entries = entries[:limit]
+		nextCursor = &entries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "next_cursor": nextCursor})
+}
+
+// Format an optional ID for a CSV field, leaving it empty if there is none
+func csvID(id *int) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.Itoa(*id)
+}
+
+// Format an optional string for a CSV field, leaving it empty if there is none
+func csvString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// Escape user-written text for a CSV field, so spreadsheets do not evaluate
+// text starting with a formula character
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type Notification struct {
+	ID         int        `json:"id"`
+	Type       string     `json:"type"`
+	Detail     string     `json:"detail"`
+	Count      int        `json:"count"`
+	Message    string     `json:"message"`
+	ActorID    *int       `json:"actor_id"`
+	ActorName  *string    `json:"actor_name"`
+	ThreadID   *int       `json:"thread_id"`
+	ThreadName *string    `json:"thread_name"`
+	CommentID  *int       `json:"comment_id"`
+	ReadAt     *time.Time `json:"read_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Notification types
+const (
+	NotificationMention    = "mention"
+	NotificationReply      = "reply"
+	NotificationQuote      = "quote"
+	NotificationModeration = "moderation"
+)
+
+// Details of moderation notifications, naming the action taken
+const (
+	ModerationCommentDeleted  = "comment_deleted"
+	ModerationCommentRestored = "comment_restored"
+	ModerationThreadDeleted   = "thread_deleted"
+	ModerationThreadRestored  = "thread_restored"
+	ModerationCommentHidden   = "comment_hidden"
+	ModerationThreadHidden    = "thread_hidden"
+	ModerationCommentWarned   = "comment_warned"
+	ModerationThreadWarned    = "thread_warned"
+)
+
+// Notification types whose unread notifications in the same thread are
+// coalesced into one, like "5 new replies in X"
+var coalescedNotifications = map[string]bool{
+	NotificationReply: true,
+}
+
+// Notifications returned per page by default and at most
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+// Something that happened which users are notified of. Zero IDs are stored as NULL.
+type notificationEvent struct {
+	Type      string
+	Detail    string
+	ActorID   int
+	ThreadID  int
+	CommentID int
+}
+
+// Notify users of an event. All notifications are created here, so that the
+// same rules apply to every kind of event:
+//   - users are not notified of their own actions, or of the actions of users they blocked
+//   - users already notified about a comment are not notified about it again,
+//     so being mentioned in a reply does not also count as a reply
+//   - unread notifications of coalesced types in the same thread are merged
+//     into the new one, which carries their combined count
+func dispatch(q queryer, event notificationEvent, recipients []int) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	// Moderation notifications are about what was done to a comment rather than
+	// what it says, so they are left out of the deduplication
+	dedupeCommentID := event.CommentID
+	if event.Type == NotificationModeration {
+		dedupeCommentID = 0
+	}
+
+	// Filter the recipients by the rules above
+	rows, err := q.Query(`
+	SELECT u.id FROM users u
+	WHERE u.id = ANY($1) AND u.id <> $2
+	AND NOT EXISTS (SELECT 1 FROM user_blocks b WHERE b.user_id = u.id AND b.blocked_user_id = $2)
+	AND ($3::int = 0 OR NOT EXISTS (
+		SELECT 1 FROM notifications n WHERE n.user_id = u.id AND n.comment_id = $3::int AND n.type <> $4
+	))
+	`, pq.Array(recipients), event.ActorID, dedupeCommentID, NotificationModeration)
+	if err != nil {
+		return err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		// Replace the user's unread notifications that coalesce with this one
+		previous := "SELECT 0 AS count WHERE FALSE"
+		if coalescedNotifications[event.Type] && event.ThreadID != 0 {
+			previous = "DELETE FROM notifications WHERE user_id = $1 AND type = $2 AND thread_id = $5 AND read_at IS NULL RETURNING count"
+		}
+		_, err := q.Exec(`
+		WITH previous AS (`+previous+`)
+		INSERT INTO notifications (user_id, type, detail, actor_id, thread_id, comment_id, count)
+		SELECT $1::int, $2::text, $3::text, $4::int, $5::int, $6::int, 1 + COALESCE(SUM(count), 0) FROM previous
+		`, userID, event.Type, event.Detail, nullableID(event.ActorID), nullableID(event.ThreadID), nullableID(event.CommentID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Notify the users watching a thread of a new comment in it
+func notifyWatchers(q queryer, threadID int, commentID int, authorID int) error {
+	rows, err := q.Query("SELECT user_id FROM thread_subscriptions WHERE thread_id = $1 AND watching", threadID)
+	if err != nil {
+		return err
+	}
+	var watchers []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		watchers = append(watchers, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return dispatch(q, notificationEvent{Type: NotificationReply, ActorID: authorID, ThreadID: threadID, CommentID: commentID}, watchers)
+}
+
+// Notify the author of a thread or comment that the logged-in user deleted or
+// restored it. Nobody is notified of changes to their own posts or of changes
+// made without logging in. A commentID of 0 means the thread itself.
+func notifyModeration(c *gin.Context, db *sql.DB, detail string, threadID int, commentID int) error {
+	actorID, ok := currentUserID(c)
+	if !ok {
+		return nil
+	}
+	var authorID int
+	var err error
+	if commentID != 0 {
+		err = db.QueryRow("SELECT thread_id, user_id FROM comments WHERE id = $1", commentID).Scan(&threadID, &authorID)
+	} else {
+		err = db.QueryRow("SELECT user_id FROM threads WHERE id = $1", threadID).Scan(&authorID)
+	}
+	if err != nil {
+		return err
+	}
+	return dispatch(db, notificationEvent{Type: NotificationModeration, Detail: detail, ActorID: actorID, ThreadID: threadID, CommentID: commentID}, []int{authorID})
+}
+
+// Columns selected to scan a notification, from notifications n joined with
+// the actor as u and the thread as t
+const notificationColumns = "n.id, n.type, n.detail, n.count, n.actor_id, u.username, n.thread_id, t.name, n.comment_id, n.read_at, n.created_at"
+
+// Joins needed by notificationColumns
+const notificationJoins = `
+	LEFT JOIN users u ON u.id = n.actor_id
+	LEFT JOIN threads t ON t.id = n.thread_id AND t.deleted_at IS NULL`
+
+// Scan a row of notificationColumns into a notification, filling in its message
+func scanNotification(row interface{ Scan(...interface{}) error }, n *Notification) error {
+	if err := row.Scan(&n.ID, &n.Type, &n.Detail, &n.Count, &n.ActorID, &n.ActorName, &n.ThreadID, &n.ThreadName, &n.CommentID, &n.ReadAt, &n.CreatedAt); err != nil {
+		return err
+	}
+	n.Message = notificationMessage(*n)
+	return nil
+}
+
+// Describe a notification in a sentence
+func notificationMessage(n Notification) string {
+	actor := "Someone"
+	if n.ActorName != nil {
+		actor = *n.ActorName
+	}
+	thread := "a deleted thread"
+	if n.ThreadName != nil {
+		thread = `"` + *n.ThreadName + `"`
+	}
+
+	switch n.Type {
+	case NotificationMention:
+		return actor + " mentioned you in " + thread
+	case NotificationReply:
+		if n.Count > 1 {
+			return strconv.Itoa(n.Count) + " new replies in " + thread
+		}
+		return actor + " replied in " + thread
+	case NotificationQuote:
+		return actor + " quoted your comment in " + thread
+	case NotificationModeration:
+		switch n.Detail {
+		case ModerationCommentDeleted:
+			return actor + " deleted your comment in " + thread
+		case ModerationCommentRestored:
+			return actor + " restored your comment in " + thread
+		case ModerationThreadDeleted:
+			return actor + " deleted your thread " + thread
+		case ModerationThreadRestored:
+			return actor + " restored your thread " + thread
+		case ModerationCommentHidden:
+			return "Your comment in " + thread + " was hidden after being reported"
+		case ModerationThreadHidden:
+			return "Your thread " + thread + " was hidden after being reported"
+		case ModerationCommentWarned:
+			return actor + " warned you about your comment in " + thread
+		case ModerationThreadWarned:
+			return actor + " warned you about your thread " + thread
+		}
+	}
+	return "New activity in " + thread
+}
+
+// Notification listing endpoint for the logged-in user, newest first. Pages
+// are requested with ?cursor=ID&limit=N, where the cursor is the next_cursor
+// of the previous page.
+func ListNotifications(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the cursor and page size
+	limit := defaultNotificationLimit
+	if param := c.Query("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxNotificationLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxNotificationLimit)})
+			return
+		}
+	}
+	cursor := 0
+	if param := c.Query("cursor"); param != "" {
+		var err error
+		cursor, err = strconv.Atoi(param)
+		if err != nil || cursor <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+	}
+
+	// Query database for the page of notifications, fetching one extra to know whether another page follows
+	rows, err := db.Query(`
+	SELECT ` + notificationColumns + `
+	FROM notifications n` + notificationJoins + `
+	WHERE n.user_id = $1 AND ($2 = 0 OR n.id < $2)
+	ORDER BY n.id DESC
+	LIMIT $3
+	`, userID, cursor, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// Create slice of notifications
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := scanNotification(rows, &n); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		notifications = append(notifications, n)
+	}
+
+	// Return the page of notifications with the cursor of the next page, if any
+	var nextCursor *int
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		nextCursor = &notifications[limit-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications, "next_cursor": nextCursor})
+}
+
+// Unread notification count endpoint for the logged-in user
+func CountUnreadNotifications(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count notifications"})
+		return
+	}
+
+	// Return the count
+	c.JSON(http.StatusOK, gin.H{"unread_count": count})
+}
+
+// Mark one of the logged-in user's notifications as read
+func MarkNotificationRead(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the notification ID from the URL parameter
+	notificationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	// Execute SQL to mark the notification as read, keeping the time it was first read
+	result, err := db.Exec("UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = $1 AND user_id = $2", notificationID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notification as read"})
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+		return
+	}
+
+	// If no rows were affected, the notification does not exist or belongs to someone else
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+// Mark all of the logged-in user's notifications as read
+func MarkAllNotificationsRead(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Execute SQL to mark the unread notifications as read
+	result, err := db.Exec("UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND read_at IS NULL", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notifications as read"})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+		return
+	}
+
+	// Return the number of notifications marked as read
+	c.JSON(http.StatusOK, gin.H{"marked_read": rowsAffected})
+}
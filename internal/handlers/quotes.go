@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"github.com/CVWO/sample-go-app/internal/render"
+	"github.com/lib/pq"
+)
+
+// A quote of part of another comment in the same thread. Start and End are
+// character offsets into the source comment's text at the time it was quoted.
+type Quote struct {
+	CommentID     int    `json:"comment_id"`
+	Start         int    `json:"start"`
+	End           int    `json:"end"`
+	Text          string `json:"text"`
+	Stale         bool   `json:"stale"`
+	SourceDeleted bool   `json:"source_deleted"`
+}
+
+// Error caused by invalid input, to be reported as a bad request
+type inputError struct {
+	message string
+}
+
+func (e inputError) Error() string {
+	return e.message
+}
+
+// Validate a quote and store it for a comment, snapshotting the quoted text
+func saveQuote(q queryer, commentID int, threadID int, authorID int, quote *Quote) error {
+	// Look up the source comment, which must be in the same thread
+	var sourceThreadID, sourceAuthorID int
+	var sourceText string
+	err := q.QueryRow("SELECT thread_id, user_id, text FROM comments WHERE id = $1 AND deleted_at IS NULL", quote.CommentID).Scan(&sourceThreadID, &sourceAuthorID, &sourceText)
+	if err == sql.ErrNoRows {
+		return inputError{"Quoted comment not found"}
+	}
+	if err != nil {
+		return err
+	}
+	if sourceThreadID != threadID {
+		return inputError{"Quoted comment is in a different thread"}
+	}
+
+	// Validate the quoted range
+	source := []rune(sourceText)
+	if quote.Start < 0 || quote.End > len(source) || quote.Start >= quote.End {
+		return inputError{"Invalid quote range"}
+	}
+	quote.Text = string(source[quote.Start:quote.End])
+
+	// Store the quote
+	_, err = q.Exec("INSERT INTO comment_quotes (comment_id, source_comment_id, start_offset, end_offset, quoted_text) VALUES ($1, $2, $3, $4, $5)", commentID, quote.CommentID, quote.Start, quote.End, quote.Text)
+	if err != nil {
+		return err
+	}
+
+	// Notify the author of the quoted comment
+	event := notificationEvent{Type: NotificationQuote, ActorID: authorID, ThreadID: threadID, CommentID: commentID}
+	return dispatch(q, event, []int{sourceAuthorID})
+}
+
+// Get the quotes in each of the given comments in a single query, keyed by comment ID.
+// Quotes whose source was deleted or no longer contains the quoted text are marked stale.
+func getQuotes(db *sql.DB, commentIDs []int) (map[int]*Quote, error) {
+	quotes := make(map[int]*Quote)
+	if len(commentIDs) == 0 {
+		return quotes, nil
+	}
+
+	rows, err := db.Query(`
+	SELECT q.comment_id, q.source_comment_id, q.start_offset, q.end_offset, q.quoted_text, s.text, s.deleted_at IS NOT NULL
+	FROM comment_quotes q
+	LEFT JOIN comments s ON s.id = q.source_comment_id
+	WHERE q.comment_id = ANY($1)
+	`, pq.Array(commentIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var commentID int
+		var sourceID sql.NullInt64
+		var sourceText sql.NullString
+		var sourceDeleted sql.NullBool
+		quote := &Quote{}
+		if err := rows.Scan(&commentID, &sourceID, &quote.Start, &quote.End, &quote.Text, &sourceText, &sourceDeleted); err != nil {
+			return nil, err
+		}
+		quote.CommentID = int(sourceID.Int64)
+
+		// The source is gone if it was purged or soft deleted
+		quote.SourceDeleted = !sourceText.Valid || sourceDeleted.Bool
+		if quote.SourceDeleted {
+			quote.Stale = true
+		} else {
+			// The quote is stale if the quoted range no longer holds the quoted text
+			source := []rune(sourceText.String)
+			quote.Stale = quote.End > len(source) || string(source[quote.Start:quote.End]) != quote.Text
+		}
+
+		quotes[commentID] = quote
+	}
+	return quotes, rows.Err()
+}
+
+// Render a comment's text, preceded by its quote if it has one
+func renderComment(text string, mentioned map[string]int, quote *Quote) string {
+	if quote == nil {
+		return render.HTML(text, mentioned)
+	}
+
+	sourceID := quote.CommentID
+	if quote.SourceDeleted {
+		sourceID = 0
+	}
+	return render.Quote(sourceID, quote.Text, quote.Stale) + render.HTML(text, mentioned)
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+// Default set of emojis users can react with
+var defaultReactionEmojis = []string{"👍", "❤️", "😂", "🎉", "😮", "😢"}
+
+var (
+	reactionEmojis     []string
+	reactionEmojisOnce sync.Once
+)
+
+// Get the configured set of reaction emojis, in display order
+func getReactionEmojis() []string {
+	reactionEmojisOnce.Do(func() {
+		reactionEmojis = defaultReactionEmojis
+
+		// Override the defaults with a comma-separated list if provided
+		if configured := os.Getenv("REACTION_EMOJIS"); configured != "" {
+			var emojis []string
+			for _, emoji := range strings.Split(configured, ",") {
+				if emoji = strings.TrimSpace(emoji); emoji != "" {
+					emojis = append(emojis, emoji)
+				}
+			}
+			if len(emojis) > 0 {
+				reactionEmojis = emojis
+			}
+		}
+	})
+	return reactionEmojis
+}
+
+// Check whether an emoji is in the configured reaction set
+func isReactionEmoji(emoji string) bool {
+	for _, allowed := range getReactionEmojis() {
+		if emoji == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Reaction emoji listing endpoint
+func ListReactionEmojis(c *gin.Context) {
+	c.JSON(http.StatusOK, getReactionEmojis())
+}
+
+// Add a reaction to a comment
+func AddReaction(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the comment ID from the URL parameter
+	commentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+
+	// Parse the request body
+	var input struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Validate the emoji
+	if !isReactionEmoji(input.Emoji) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reaction: " + input.Emoji})
+		return
+	}
+
+	// Ensure the comment exists and is visible
+	var threadID int
+	err = db.QueryRow("SELECT thread_id FROM comments WHERE id = $1 AND deleted_at IS NULL AND hidden_at IS NULL", commentID).Scan(&threadID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up comment"})
+		return
+	}
+
+	// Ensure the user may read the comment's thread
+	allowed, err := checkThreadAccess(c, db, threadID, false)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot read this category"})
+		return
+	}
+
+	// Start a transaction so the reaction and its webhooks are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Insert the reaction, ignoring duplicates so the request is idempotent
+	_, err = tx.Exec("INSERT INTO comment_reactions (comment_id, user_id, emoji) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", commentID, userID, input.Emoji)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add reaction"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.ReactionsChanged, ThreadID: threadID, CommentID: commentID, UserID: userID}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	publishEvent(event)
+
+	// Return the updated reactions for the comment
+	reactions, err := getReactions(db, []int{commentID}, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reactions"})
+		return
+	}
+	c.JSON(http.StatusOK, reactionsOrEmpty(reactions[commentID]))
+}
+
+// Remove a reaction from a comment
+func RemoveReaction(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the comment ID from the URL parameter
+	commentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+
+	// Start a transaction so the removal and its webhooks are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Execute SQL to delete the reaction
+	var threadID int
+	err = tx.QueryRow("DELETE FROM comment_reactions r USING comments m WHERE m.id = r.comment_id AND r.comment_id = $1 AND r.user_id = $2 AND r.emoji = $3 RETURNING m.thread_id", commentID, userID, c.Param("emoji")).Scan(&threadID)
+
+	// If no rows were returned, the user had not reacted with this emoji
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reaction not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove reaction"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.ReactionsChanged, ThreadID: threadID, CommentID: commentID, UserID: userID}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	publishEvent(event)
+
+	// Return the updated reactions for the comment
+	reactions, err := getReactions(db, []int{commentID}, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reactions"})
+		return
+	}
+	c.JSON(http.StatusOK, reactionsOrEmpty(reactions[commentID]))
+}
+
+// Get aggregated reactions for a set of comments in a single query, keyed by comment ID.
+// A viewerID of 0 means the viewer is anonymous, so reacted_by_me is always false.
+func getReactions(db *sql.DB, commentIDs []int, viewerID int) (map[int][]Reaction, error) {
+	reactions := make(map[int][]Reaction)
+	if len(commentIDs) == 0 {
+		return reactions, nil
+	}
+
+	rows, err := db.Query(`
+	SELECT comment_id, emoji, COUNT(*), BOOL_OR(user_id = $2)
+	FROM comment_reactions
+	WHERE comment_id = ANY($1)
+	GROUP BY comment_id, emoji
+	`, pq.Array(commentIDs), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Collect the reactions per comment
+	for rows.Next() {
+		var commentID int
+		var reaction Reaction
+		if err := rows.Scan(&commentID, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return nil, err
+		}
+		reactions[commentID] = append(reactions[commentID], reaction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Order each comment's reactions by the configured emoji order,
+	// putting emojis that are no longer configured last
+	order := make(map[string]int)
+	for i, emoji := range getReactionEmojis() {
+		order[emoji] = i
+	}
+	position := func(emoji string) int {
+		if i, ok := order[emoji]; ok {
+			return i
+		}
+		return len(order)
+	}
+	for _, list := range reactions {
+		sort.SliceStable(list, func(i, j int) bool {
+			return position(list[i].Emoji) < position(list[j].Emoji)
+		})
+	}
+
+	return reactions, nil
+}
+
+// Return an empty slice instead of nil so the JSON is an empty array
+func reactionsOrEmpty(reactions []Reaction) []Reaction {
+	if reactions == nil {
+		return []Reaction{}
+	}
+	return reactions
+}
@@ -0,0 +1,729 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// A thread or comment in the moderation queue, with the reports about it
+// aggregated. Reports and notes are only included for a single item.
+type ReportedItem struct {
+	ID             int            `json:"id"`
+	ThreadID       int            `json:"thread_id"`
+	ThreadName     string         `json:"thread_name"`
+	CommentID      *int           `json:"comment_id"`
+	AuthorID       *int           `json:"author_id"`
+	AuthorName     *string        `json:"author_name"`
+	Content        string         `json:"content"` // Thread name or comment text
+	Hidden         bool           `json:"hidden"`
+	Deleted        bool           `json:"deleted"`
+	Status         string         `json:"status"`
+	Resolution     *string        `json:"resolution"`
+	ReportCount    int            `json:"report_count"`
+	Reasons        map[string]int `json:"reasons"`
+	ClaimedBy      *int           `json:"claimed_by"`
+	ClaimedByName  *string        `json:"claimed_by_name"`
+	ClaimedAt      *time.Time     `json:"claimed_at"`
+	ResolvedBy     *int           `json:"resolved_by"`
+	ResolvedAt     *time.Time     `json:"resolved_at"`
+	CreatedAt      time.Time      `json:"created_at"`
+	LastReportedAt time.Time      `json:"last_reported_at"`
+	Reports        []Report       `json:"reports,omitempty"`
+	Notes          []ReportNote   `json:"notes,omitempty"`
+}
+
+// A user's report of a thread or comment. The reporter is only shown to moderators.
+type Report struct {
+	ID           int       `json:"id"`
+	ReporterID   *int      `json:"reporter_id"`
+	ReporterName *string   `json:"reporter_name"`
+	Reason       string    `json:"reason"`
+	Details      string    `json:"details"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// An internal comment by a moderator on a reported item
+type ReportNote struct {
+	ID        int       `json:"id"`
+	UserID    *int      `json:"user_id"`
+	UserName  *string   `json:"user_name"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Reasons users can give for a report
+var reportReasons = map[string]bool{
+	"spam":          true,
+	"harassment":    true,
+	"hate":          true,
+	"inappropriate": true,
+	"off_topic":     true,
+	"other":         true,
+}
+
+// Statuses of reported items
+const (
+	reportOpen     = "open"
+	reportResolved = "resolved"
+)
+
+// Actions moderators take to resolve a reported item, and the resolution each records
+var reportActions = map[string]string{
+	"dismiss": "dismissed",
+	"delete":  "deleted",
+	"warn":    "warned",
+}
+
+// Limits of report details and notes
+const (
+	maxReportDetailsLength = 1000
+	maxReportNoteLength    = 5000
+)
+
+// Reported items returned per page by default and at most
+const (
+	defaultReportedItemLimit = 20
+	maxReportedItemLimit     = 100
+)
+
+// Number of reports after which content is hidden until a moderator reviews
+// it. 0 turns off hiding.
+var reportHideThreshold = 3
+
+// Set the number of reports after which content is hidden
+func SetReportHideThreshold(threshold int) {
+	reportHideThreshold = threshold
+}
+
+// Columns selected to scan a reported item, from reported_items i with the
+// joins in reportedItemJoins
+const reportedItemColumns = `i.id, i.thread_id, t.name, i.comment_id, i.author_id, a.username,
+	COALESCE(m.text, t.name),
+	CASE WHEN i.comment_id IS NULL THEN t.hidden_at ELSE m.hidden_at END IS NOT NULL,
+	CASE WHEN i.comment_id IS NULL THEN t.deleted_at ELSE m.deleted_at END IS NOT NULL,
+	i.status, i.resolution, i.claimed_by, cu.username, i.claimed_at, i.resolved_by, i.resolved_at, i.created_at,
+	(SELECT COUNT(*) FROM reports r WHERE r.item_id = i.id),
+	COALESCE((SELECT MAX(r.created_at) FROM reports r WHERE r.item_id = i.id), i.created_at)`
+
+// Joins needed by reportedItemColumns
+const reportedItemJoins = `
+	JOIN threads t ON t.id = i.thread_id
+	LEFT JOIN comments m ON m.id = i.comment_id
+	LEFT JOIN users a ON a.id = i.author_id
+	LEFT JOIN users cu ON cu.id = i.claimed_by`
+
+func scanReportedItem(row interface{ Scan(...interface{}) error }, item *ReportedItem) error {
+	item.Reasons = map[string]int{}
+	return row.Scan(&item.ID, &item.ThreadID, &item.ThreadName, &item.CommentID, &item.AuthorID, &item.AuthorName,
+		&item.Content, &item.Hidden, &item.Deleted,
+		&item.Status, &item.Resolution, &item.ClaimedBy, &item.ClaimedByName, &item.ClaimedAt, &item.ResolvedBy, &item.ResolvedAt, &item.CreatedAt,
+		&item.ReportCount, &item.LastReportedAt)
+}
+
+// Count the reasons given for reported items with a single query
+func attachReportReasons(db *sql.DB, items []ReportedItem) error {
+	itemIDs := make([]int, len(items))
+	index := make(map[int]int)
+	for i, item := range items {
+		itemIDs[i] = item.ID
+		index[item.ID] = i
+	}
+	rows, err := db.Query("SELECT item_id, reason, COUNT(*) FROM reports WHERE item_id = ANY($1) GROUP BY item_id, reason", pq.Array(itemIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var itemID, count int
+		var reason string
+		if err := rows.Scan(&itemID, &reason, &count); err != nil {
+			return err
+		}
+		items[index[itemID]].Reasons[reason] = count
+	}
+	return rows.Err()
+}
+
+// Hide or show a reported thread or comment. A commentID of 0 means the thread
+// itself. Returns whether the content changed.
+func setContentHidden(q queryer, threadID int, commentID int, hidden bool) (bool, error) {
+	table, id := "threads", threadID
+	if commentID != 0 {
+		table, id = "comments", commentID
+	}
+	var result sql.Result
+	var err error
+	if hidden {
+		result, err = q.Exec("UPDATE "+table+" SET hidden_at = CURRENT_TIMESTAMP WHERE id = $1 AND hidden_at IS NULL", id)
+	} else {
+		result, err = q.Exec("UPDATE "+table+" SET hidden_at = NULL WHERE id = $1 AND hidden_at IS NOT NULL", id)
+	}
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// Report a thread, or a comment if a comment ID is given, to the moderators.
+// Content reported by enough users is hidden until a moderator reviews it.
+func CreateReport(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse and validate the request body
+	var input struct {
+		ThreadID  int    `json:"thread_id"`
+		CommentID int    `json:"comment_id"`
+		Reason    string `json:"reason"`
+		Details   string `json:"details"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !reportReasons[input.Reason] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reason: " + input.Reason})
+		return
+	}
+	input.Details = strings.TrimSpace(input.Details)
+	if len(input.Details) > maxReportDetailsLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Details must be at most " + strconv.Itoa(maxReportDetailsLength) + " bytes"})
+		return
+	}
+
+	// Look up the reported content and its author
+	threadID := input.ThreadID
+	var authorID int
+	var err error
+	if input.CommentID != 0 {
+		err = db.QueryRow("SELECT thread_id, user_id FROM comments WHERE id = $1 AND deleted_at IS NULL", input.CommentID).Scan(&threadID, &authorID)
+	} else {
+		err = db.QueryRow("SELECT user_id FROM threads WHERE id = $1 AND deleted_at IS NULL", threadID).Scan(&authorID)
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up content"})
+		return
+	}
+	if authorID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot report your own post"})
+		return
+	}
+
+	// Ensure the user may read the content
+	allowed, err := checkThreadAccess(c, db, threadID, false)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot read this category"})
+		return
+	}
+
+	// Start a transaction so the report and any hiding are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Add the report to the content's open item in the queue, opening one if needed
+	var itemID int
+	err = tx.QueryRow(`
+	INSERT INTO reported_items (thread_id, comment_id, author_id) VALUES ($1, $2, $3)
+	ON CONFLICT (thread_id, (COALESCE(comment_id, 0))) WHERE status = 'open' DO UPDATE SET author_id = EXCLUDED.author_id
+	RETURNING id
+	`, threadID, nullableID(input.CommentID), nullableID(authorID)).Scan(&itemID)
+	if err != nil {
+		log.Printf("Error opening reported item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save report"})
+		return
+	}
+	result, err := tx.Exec(`
+	INSERT INTO reports (item_id, reporter_id, reason, details) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (item_id, reporter_id) DO NOTHING
+	`, itemID, userID, input.Reason, input.Details)
+	if err != nil {
+		log.Printf("Error saving report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save report"})
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already reported this"})
+		return
+	}
+
+	// Hide the content once enough users reported it
+	hidden := false
+	if reportHideThreshold > 0 {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM reports WHERE item_id = $1", itemID).Scan(&count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count reports"})
+			return
+		}
+		if count >= reportHideThreshold {
+			hidden, err = setContentHidden(tx, threadID, input.CommentID, true)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hide content"})
+				return
+			}
+		}
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Take hidden content out of search and tell its author
+	if hidden {
+		reindexThread(db, threadID)
+		detail := ModerationThreadHidden
+		if input.CommentID != 0 {
+			detail = ModerationCommentHidden
+		}
+		event := notificationEvent{Type: NotificationModeration, Detail: detail, ThreadID: threadID, CommentID: input.CommentID}
+		if err := dispatch(db, event, []int{authorID}); err != nil {
+			log.Printf("Error notifying author of hidden content: %v", err)
+		}
+	}
+
+	// Return success message
+	c.JSON(http.StatusCreated, gin.H{"message": "Report submitted successfully"})
+}
+
+// Moderation queue endpoint, listing the open reported items oldest first, or
+// the resolved ones with ?status=resolved. Pages are requested with
+// ?cursor=ID&limit=N, where the cursor is the next_cursor of the previous page.
+func ListReportedItems(c *gin.Context, db *sql.DB) {
+	status := c.DefaultQuery("status", reportOpen)
+	if status != reportOpen && status != reportResolved {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be open or resolved"})
+		return
+	}
+	cursor, limit, ok := parsePage(c, defaultReportedItemLimit, maxReportedItemLimit)
+	if !ok {
+		return
+	}
+
+	// Query database for the page of items, fetching one extra to know whether another page follows
+	rows, err := db.Query(`
+	SELECT `+reportedItemColumns+`
+	FROM reported_items i`+reportedItemJoins+`
+	WHERE i.status = $1 AND i.id > $2
+	ORDER BY i.id
+	LIMIT $3
+	`, status, cursor, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// Create slice of items
+	items := []ReportedItem{}
+	for rows.Next() {
+		var item ReportedItem
+		if err := scanReportedItem(rows, &item); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return the page of items with the cursor of the next page, if any
+	var nextCursor *int
+	if len(items) > limit {
+		items = items[:limit]
+		nextCursor = &items[limit-1].ID
+	}
+	if err := attachReportReasons(db, items); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "next_cursor": nextCursor})
+}
+
+// Parse the reported item ID from the URL parameter, responding with an error
+// and returning false if it is invalid
+func reportedItemParam(c *gin.Context) (int, bool) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return 0, false
+	}
+	return itemID, true
+}
+
+// Query a reported item with its reports and notes
+func getReportedItem(db *sql.DB, itemID int) (ReportedItem, error) {
+	var item ReportedItem
+	err := scanReportedItem(db.QueryRow("SELECT "+reportedItemColumns+" FROM reported_items i"+reportedItemJoins+" WHERE i.id = $1", itemID), &item)
+	if err != nil {
+		return item, err
+	}
+	items := []ReportedItem{item}
+	if err := attachReportReasons(db, items); err != nil {
+		return item, err
+	}
+	item = items[0]
+
+	// Attach the reports
+	item.Reports = []Report{}
+	rows, err := db.Query(`
+	SELECT r.id, r.reporter_id, u.username, r.reason, r.details, r.created_at
+	FROM reports r
+	LEFT JOIN users u ON u.id = r.reporter_id
+	WHERE r.item_id = $1
+	ORDER BY r.id
+	`, itemID)
+	if err != nil {
+		return item, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var report Report
+		if err := rows.Scan(&report.ID, &report.ReporterID, &report.ReporterName, &report.Reason, &report.Details, &report.CreatedAt); err != nil {
+			return item, err
+		}
+		item.Reports = append(item.Reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return item, err
+	}
+
+	// Attach the notes
+	item.Notes = []ReportNote{}
+	noteRows, err := db.Query(`
+	SELECT n.id, n.user_id, u.username, n.text, n.created_at
+	FROM report_notes n
+	LEFT JOIN users u ON u.id = n.user_id
+	WHERE n.item_id = $1
+	ORDER BY n.id
+	`, itemID)
+	if err != nil {
+		return item, err
+	}
+	defer noteRows.Close()
+	for noteRows.Next() {
+		var note ReportNote
+		if err := noteRows.Scan(&note.ID, &note.UserID, &note.UserName, &note.Text, &note.CreatedAt); err != nil {
+			return item, err
+		}
+		item.Notes = append(item.Notes, note)
+	}
+	return item, noteRows.Err()
+}
+
+// Reported item retrieval endpoint, with the individual reports and notes
+func GetReportedItem(c *gin.Context, db *sql.DB) {
+	itemID, ok := reportedItemParam(c)
+	if !ok {
+		return
+	}
+	item, err := getReportedItem(db, itemID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+// Respond to a claim or resolution of an item that was not updated, explaining why
+func respondToUnchangedItem(c *gin.Context, db *sql.DB, itemID int) {
+	var status string
+	err := db.QueryRow("SELECT status FROM reported_items WHERE id = $1", itemID).Scan(&status)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up item"})
+		return
+	}
+	if status != reportOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": "The item is already resolved"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "The item is claimed by another moderator"})
+}
+
+// Claim an open item, so other moderators know it is being reviewed
+func ClaimReportedItem(c *gin.Context, db *sql.DB) {
+	itemID, ok := reportedItemParam(c)
+	if !ok {
+		return
+	}
+	userID, _ := currentUserID(c)
+
+	// Execute SQL to claim the item unless another moderator claimed it
+	result, err := db.Exec(`
+	UPDATE reported_items SET claimed_by = $2, claimed_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND status = 'open' AND (claimed_by IS NULL OR claimed_by = $2)
+	`, itemID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim item"})
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		respondToUnchangedItem(c, db, itemID)
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Item claimed successfully"})
+}
+
+// Release the logged-in moderator's claim on an item
+func UnclaimReportedItem(c *gin.Context, db *sql.DB) {
+	itemID, ok := reportedItemParam(c)
+	if !ok {
+		return
+	}
+	userID, _ := currentUserID(c)
+
+	// Execute SQL to release the claim
+	result, err := db.Exec("UPDATE reported_items SET claimed_by = NULL, claimed_at = NULL WHERE id = $1 AND status = 'open' AND claimed_by = $2", itemID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release item"})
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You have not claimed this item"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Item released successfully"})
+}
+
+// Resolve an open item by dismissing the reports, deleting the content or
+// warning its author, with an optional note. The content is shown again
+// unless it was deleted, and the author is notified of deletions and warnings.
+func ResolveReportedItem(c *gin.Context, db *sql.DB) {
+	itemID, ok := reportedItemParam(c)
+	if !ok {
+		return
+	}
+	userID, _ := currentUserID(c)
+
+	// Parse and validate the request body
+	var input struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	resolution, ok := reportActions[input.Action]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be dismiss, delete or warn"})
+		return
+	}
+	input.Note = strings.TrimSpace(input.Note)
+	if len(input.Note) > maxReportNoteLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Note must be at most " + strconv.Itoa(maxReportNoteLength) + " bytes"})
+		return
+	}
+
+	// Start a transaction so the item and its content are updated together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Resolve the item unless it is resolved or claimed by another moderator
+	var threadID, commentID int
+	var comment sql.NullInt64
+	err = tx.QueryRow(`
+	UPDATE reported_items SET status = 'resolved', resolution = $3, resolved_by = $2, resolved_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND status = 'open' AND (claimed_by IS NULL OR claimed_by = $2)
+	RETURNING thread_id, comment_id
+	`, itemID, userID, resolution).Scan(&threadID, &comment)
+	if err == sql.ErrNoRows {
+		respondToUnchangedItem(c, db, itemID)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve item"})
+		return
+	}
+	commentID = int(comment.Int64)
+
+	// Snapshot the content so the log shows what the resolution changed
+	targetType, targetID := "thread", threadID
+	if commentID != 0 {
+		targetType, targetID = "comment", commentID
+	}
+	before, err := snapshotTarget(tx, targetType, targetID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up content"})
+		return
+	}
+
+	// Delete the content if requested, ignoring content that is already deleted
+	deleted := false
+	if input.Action == "delete" {
+		if commentID != 0 {
+			_, err = softDeleteComment(tx, commentID, userID)
+		} else {
+			err = softDeleteThread(tx, threadID, userID)
+		}
+		deleted = err == nil
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete content"})
+			return
+		}
+	}
+
+	// Show the content again, so it is visible if it is ever restored
+	shown, err := setContentHidden(tx, threadID, commentID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to show content"})
+		return
+	}
+
+	// Save the note
+	if input.Note != "" {
+		if _, err := tx.Exec("INSERT INTO report_notes (item_id, user_id, text) VALUES ($1, $2, $3)", itemID, userID, input.Note); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save note"})
+			return
+		}
+	}
+
+	// Log the resolution, with the note as its reason
+	err = logChange(c, tx, moderationLogEntry{
+		Action:     LogReportResolved,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Reason:     input.Note,
+		Details:    gin.H{"item_id": itemID, "resolution": resolution},
+	}, before)
+	if err != nil {
+		log.Printf("Error logging resolution: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Queue the webhooks of the deletion with the change
+	var event pubsub.Event
+	if deleted {
+		event = pubsub.Event{Type: pubsub.ThreadDeleted, ThreadID: threadID, UserID: userID}
+		if commentID != 0 {
+			event.Type, event.CommentID = pubsub.CommentDeleted, commentID
+		}
+		if err := queueWebhooks(db, tx, event); err != nil {
+			log.Printf("Error queueing webhooks: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+			return
+		}
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	if deleted || shown {
+		reindexThread(db, threadID)
+	}
+
+	// Publish deletions and notify the author
+	var detail string
+	switch {
+	case deleted && commentID != 0:
+		publishEvent(event)
+		detail = ModerationCommentDeleted
+	case deleted:
+		publishEvent(event)
+		detail = ModerationThreadDeleted
+	case input.Action == "warn" && commentID != 0:
+		detail = ModerationCommentWarned
+	case input.Action == "warn":
+		detail = ModerationThreadWarned
+	}
+	if detail != "" {
+		if err := notifyModeration(c, db, detail, threadID, commentID); err != nil {
+			log.Printf("Error notifying author: %v", err)
+		}
+	}
+
+	// Return the resolved item
+	item, err := getReportedItem(db, itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+// Add an internal note to a reported item, visible only to moderators
+func CreateReportNote(c *gin.Context, db *sql.DB) {
+	itemID, ok := reportedItemParam(c)
+	if !ok {
+		return
+	}
+	userID, _ := currentUserID(c)
+
+	// Parse and validate the request body
+	var input struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	input.Text = strings.TrimSpace(input.Text)
+	if input.Text == "" || len(input.Text) > maxReportNoteLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Note must be between 1 and " + strconv.Itoa(maxReportNoteLength) + " bytes"})
+		return
+	}
+
+	// Insert the note, checking that the item exists
+	note := ReportNote{UserID: &userID, Text: input.Text}
+	err := db.QueryRow(`
+	INSERT INTO report_notes (item_id, user_id, text)
+	SELECT id, $2::int, $3::text FROM reported_items WHERE id = $1
+	RETURNING id, created_at, (SELECT username FROM users WHERE id = $2::int)
+	`, itemID, userID, input.Text).Scan(&note.ID, &note.CreatedAt, &note.UserName)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save note"})
+		return
+	}
+
+	// Return the note
+	c.JSON(http.StatusCreated, note)
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/diff"
+	"github.com/gin-gonic/gin"
+)
+
+type Revision struct {
+	Version      int         `json:"version"`
+	Text         string      `json:"text"`
+	EditedBy     *int        `json:"edited_by"`
+	EditedByName *string     `json:"edited_by_name"`
+	CreatedAt    *time.Time  `json:"created_at"`
+	Diff         interface{} `json:"diff,omitempty"`
+}
+
+// Lines of context shown around changes in unified diffs
+const revisionDiffContext = 3
+
+// Record a new revision of a comment's text, keeping the original text as the
+// first revision. Returns false without recording anything if the text is unchanged.
+func recordCommentRevision(tx *sql.Tx, commentID int, text string, editorID int) (bool, error) {
+	// Lock the comment so concurrent edits are recorded in order
+	var current string
+	var authorID int
+	var createdAt time.Time
+	err := tx.QueryRow("SELECT text, user_id, created_at FROM comments WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", commentID).Scan(&current, &authorID, &createdAt)
+	if err != nil {
+		return false, err
+	}
+	if current == text {
+		return false, nil
+	}
+
+	// Save the original version the first time the comment is edited
+	_, err = tx.Exec(`
+	INSERT INTO comment_revisions (comment_id, text, edited_by, created_at)
+	SELECT $1::int, $2::text, $3::int, $4::timestamptz
+	WHERE NOT EXISTS (SELECT 1 FROM comment_revisions WHERE comment_id = $1::int)
+	`, commentID, current, authorID, createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	// Save the new version
+	_, err = tx.Exec("INSERT INTO comment_revisions (comment_id, text, edited_by) VALUES ($1, $2, $3)", commentID, text, nullableID(editorID))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Record a new revision of a thread's name, keeping the original name as the
+// first revision. Returns false without recording anything if the name is unchanged.
+func recordThreadRevision(tx *sql.Tx, threadID int, name string, editorID int) (bool, error) {
+	// Lock the thread so concurrent edits are recorded in order
+	var current string
+	var authorID int
+	var createdAt time.Time
+	err := tx.QueryRow("SELECT name, user_id, created_at FROM threads WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", threadID).Scan(&current, &authorID, &createdAt)
+	if err != nil {
+		return false, err
+	}
+	if current == name {
+		return false, nil
+	}
+
+	// Save the original version the first time the thread is edited
+	_, err = tx.Exec(`
+	INSERT INTO thread_revisions (thread_id, name, edited_by, created_at)
+	SELECT $1::int, $2::text, $3::int, $4::timestamptz
+	WHERE NOT EXISTS (SELECT 1 FROM thread_revisions WHERE thread_id = $1::int)
+	`, threadID, current, authorID, createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	// Save the new version
+	_, err = tx.Exec("INSERT INTO thread_revisions (thread_id, name, edited_by) VALUES ($1, $2, $3)", threadID, name, nullableID(editorID))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Comment revision listing endpoint
+func ListCommentRevisions(c *gin.Context, db *sql.DB) {
+	listRevisions(c, db, "Comment", `
+	SELECT t.category_id, m.deleted_at IS NULL AND m.hidden_at IS NULL AND t.deleted_at IS NULL AND t.hidden_at IS NULL
+	FROM comments m JOIN threads t ON t.id = m.thread_id WHERE m.id = $1
+	`, `
+	SELECT r.text, r.edited_by, u.username, r.created_at
+	FROM comment_revisions r
+	LEFT JOIN users u ON u.id = r.edited_by
+	WHERE r.comment_id = $1
+	ORDER BY r.id ASC
+	`, `
+	SELECT m.text, m.user_id, u.username, m.created_at
+	FROM comments m
+	LEFT JOIN users u ON u.id = m.user_id
+	WHERE m.id = $1
+	`)
+}
+
+// Thread revision listing endpoint
+func ListThreadRevisions(c *gin.Context, db *sql.DB) {
+	listRevisions(c, db, "Thread", `
+	SELECT category_id, deleted_at IS NULL AND hidden_at IS NULL FROM threads WHERE id = $1
+	`, `
+	SELECT r.name, r.edited_by, u.username, r.created_at
+	FROM thread_revisions r
+	LEFT JOIN users u ON u.id = r.edited_by
+	WHERE r.thread_id = $1
+	ORDER BY r.id ASC
+	`, `
+	SELECT t.name, t.user_id, u.username, t.created_at
+	FROM threads t
+	LEFT JOIN users u ON u.id = t.user_id
+	WHERE t.id = $1
+	`)
+}
+
+// List the revisions of an item along with the diff from each version to the next.
+// The item's category and whether it is visible, read with categoryQuery, must
+// be readable by the user. Deleted and hidden items, or items in deleted and
+// hidden threads, are only visible to moderators. Items that were never edited have a single revision read with currentQuery.
+func listRevisions(c *gin.Context, db *sql.DB, kind string, categoryQuery string, revisionsQuery string, currentQuery string) {
+	// Parse the ID from the URL parameter
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + kind + " ID"})
+		return
+	}
+
+	// Parse the diff format, which is either unified or words
+	format := c.DefaultQuery("format", "unified")
+	if format != "unified" && format != "words" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid diff format: " + format})
+		return
+	}
+
+	// Ensure the user may read the item's category
+	var categoryID int
+	var visible bool
+	err = db.QueryRow(categoryQuery, id).Scan(&categoryID, &visible)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": kind + " not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Hide the history of deleted and hidden items from everyone but moderators
+	if !visible {
+		role, err := currentUserRole(c, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !hasRole(role, RoleModerator) {
+			c.JSON(http.StatusNotFound, gin.H{"error": kind + " not found"})
+			return
+		}
+	}
+	_, allowed, err := checkCategoryAccess(c, db, categoryID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot read this category"})
+		return
+	}
+
+	// Query database for revisions
+	rows, err := db.Query(revisionsQuery, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		revision := Revision{Version: len(revisions) + 1}
+		if err := rows.Scan(&revision.Text, &revision.EditedBy, &revision.EditedByName, &revision.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// If the item was never edited, its current version is the only revision
+	if len(revisions) == 0 {
+		revision := Revision{Version: 1}
+		err := db.QueryRow(currentQuery, id).Scan(&revision.Text, &revision.EditedBy, &revision.EditedByName, &revision.CreatedAt)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": kind + " not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+
+	// Diff each revision against the one before it
+	for i := 1; i < len(revisions); i++ {
+		if format == "words" {
+			revisions[i].Diff = diff.Words(revisions[i-1].Text, revisions[i].Text)
+		} else {
+			revisions[i].Diff = diff.Unified(revisions[i-1].Text, revisions[i].Text, revisionDiffContext)
+		}
+	}
+
+	// Return the revisions
+	c.JSON(http.StatusOK, revisions)
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/search"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Largest page of search results that can be requested
+const maxSearchLimit = 100
+
+// The engine used by the search endpoint
+var searchEngine search.Engine
+
+// Set the engine used by the search endpoint
+func SetSearchEngine(engine search.Engine) {
+	searchEngine = engine
+}
+
+// Search endpoint, matching threads and comments in the categories the
+// logged-in user can read. The q parameter uses the query language of search.Parse.
+func Search(c *gin.Context, db *sql.DB) {
+	if searchEngine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search is not available"})
+		return
+	}
+
+	// Parse the query, pointing out where a malformed query went wrong
+	expr, err := search.Parse(c.Query("q"))
+	if parseErr, ok := err.(*search.ParseError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": parseErr.Error(), "position": parseErr.Offset})
+		return
+	}
+	if len(expr.Clauses) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query cannot be empty"})
+		return
+	}
+	query, err := buildSearchQuery(c, db, expr)
+	if err != nil {
+		respondWithError(c, err, "Failed to parse search query")
+		return
+	}
+
+	// Run the search
+	results, err := searchEngine.Search(c.Request.Context(), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search"})
+		return
+	}
+
+	// Return the page of results along with the query in its canonical form
+	c.JSON(http.StatusOK, gin.H{
+		"query":   expr.String(),
+		"results": results.Results,
+		"total":   results.Total,
+	})
+}
+
+// Build a search query from a parsed query and the filters in the request's
+// query parameters
+func buildSearchQuery(c *gin.Context, db *sql.DB, expr *search.Expr) (search.Query, error) {
+	query := search.Query{Limit: 20}
+
+	// Match threads tagged with any of the given tags or their descendants
+	tagGroup := func(names []string) error {
+		tags, err := resolveTags(db, names)
+		if err != nil {
+			return err
+		}
+		set, err := getTagSet(db)
+		if err != nil {
+			return err
+		}
+		var group []int
+		for _, tag := range tags {
+			group = append(group, set.descendants(tag.ID)...)
+		}
+		query.Tags = append(query.Tags, group)
+		return nil
+	}
+
+	// Apply the clauses of the parsed query
+	for _, clause := range expr.Clauses {
+		switch clause := clause.(type) {
+		case search.Term:
+			query.Terms = append(query.Terms, clause)
+		case search.AuthorFilter:
+			query.Authors = append(query.Authors, clause.Username)
+		case search.TagFilter:
+			if err := tagGroup([]string{clause.Name}); err != nil {
+				return query, err
+			}
+		case search.InFilter:
+			if query.In != "" && query.In != clause.Field {
+				return query, inputError{"in:title and in:body cannot be combined"}
+			}
+			query.In = clause.Field
+		case search.DateFilter:
+			if clause.Before && (query.To.IsZero() || clause.Date.Before(query.To)) {
+				query.To = clause.Date
+			}
+			if from := clause.Date.AddDate(0, 0, 1); !clause.Before && from.After(query.From) {
+				query.From = from
+			}
+		case search.IsFilter:
+			query.Unanswered = query.Unanswered || clause.State == search.IsUnanswered
+		}
+	}
+
+	// Apply the filters given as query parameters, where the to date is inclusive
+	if param := c.Query("tags"); param != "" {
+		if err := tagGroup(splitList(param)); err != nil {
+			return query, err
+		}
+	}
+	if param := c.Query("author"); param != "" {
+		query.Authors = append(query.Authors, param)
+	}
+	if param := c.Query("from"); param != "" {
+		from, err := time.Parse(search.DateLayout, param)
+		if err != nil {
+			return query, inputError{"Invalid from date, expected YYYY-MM-DD"}
+		}
+		if from.After(query.From) {
+			query.From = from
+		}
+	}
+	if param := c.Query("to"); param != "" {
+		to, err := time.Parse(search.DateLayout, param)
+		if err != nil {
+			return query, inputError{"Invalid to date, expected YYYY-MM-DD"}
+		}
+		if to = to.AddDate(0, 0, 1); query.To.IsZero() || to.Before(query.To) {
+			query.To = to
+		}
+	}
+
+	// Parse the page
+	if param := c.Query("limit"); param != "" {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			return query, inputError{"Limit must be between 1 and " + strconv.Itoa(maxSearchLimit)}
+		}
+		query.Limit = limit
+	}
+	if param := c.Query("offset"); param != "" {
+		offset, err := strconv.Atoi(param)
+		if err != nil || offset < 0 {
+			return query, inputError{"Offset must be a non-negative number"}
+		}
+		query.Offset = offset
+	}
+
+	// Only search the categories the user can read
+	categoryIDs, err := readableCategoryIDs(c, db)
+	if err != nil {
+		return query, err
+	}
+	query.CategoryIDs = categoryIDs
+	return query, nil
+}
+
+// Update the search index after a thread or its comments changed. Engines that
+// read the database directly need no updates, so this only affects indexers.
+// Failures are logged rather than failing the request, since the change has
+// already been committed.
+func reindexThread(db *sql.DB, threadID int) {
+	indexer, ok := searchEngine.(search.Indexer)
+	if !ok {
+		return
+	}
+	if err := indexThread(context.Background(), db, indexer, threadID); err != nil {
+		log.Printf("Failed to reindex thread %d: %v", threadID, err)
+	}
+}
+
+// Update the search index after a comment changed
+func reindexComment(db *sql.DB, commentID int) {
+	if _, ok := searchEngine.(search.Indexer); !ok {
+		return
+	}
+	var threadID int
+	if err := db.QueryRow("SELECT thread_id FROM comments WHERE id = $1", commentID).Scan(&threadID); err != nil {
+		log.Printf("Failed to reindex comment %d: %v", commentID, err)
+		return
+	}
+	reindexThread(db, threadID)
+}
+
+// Update the search index after a change affecting many threads, such as a tag merge
+func reindexAll(db *sql.DB) {
+	if err := ReindexSearch(context.Background(), db); err != nil {
+		log.Printf("Failed to rebuild search index: %v", err)
+	}
+}
+
+// Replace the indexed documents of a thread with its current contents
+func indexThread(ctx context.Context, db *sql.DB, indexer search.Indexer, threadID int) error {
+	if err := indexer.RemoveThread(ctx, threadID); err != nil {
+		return err
+	}
+
+	// Look up the thread, which is left out of the index if it is deleted or hidden
+	thread := search.Document{Kind: search.KindThread, ThreadID: threadID}
+	var tags pq.Int64Array
+	err := db.QueryRowContext(ctx, `
+	SELECT t.name, t.user_id, COALESCE(u.username, ''), t.category_id, t.created_at,
+		ARRAY(SELECT tag_id FROM thread_tags WHERE thread_id = t.id)
+	FROM threads t
+	LEFT JOIN users u ON u.id = t.user_id
+	WHERE t.id = $1 AND t.deleted_at IS NULL AND t.hidden_at IS NULL
+	`, threadID).Scan(&thread.Title, &thread.AuthorID, &thread.Author, &thread.CategoryID, &thread.CreatedAt, &tags)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		thread.Tags = append(thread.Tags, int(tag))
+	}
+	thread.Body = thread.Title
+	if err := indexer.Index(ctx, thread); err != nil {
+		return err
+	}
+
+	// Index the thread's comments
+	rows, err := db.QueryContext(ctx, `
+	SELECT m.id, m.text, m.user_id, COALESCE(u.username, ''), m.created_at
+	FROM comments m
+	LEFT JOIN users u ON u.id = m.user_id
+	WHERE m.thread_id = $1 AND m.deleted_at IS NULL AND m.hidden_at IS NULL
+	`, threadID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		comment := thread
+		comment.Kind = search.KindComment
+		if err := rows.Scan(&comment.CommentID, &comment.Body, &comment.AuthorID, &comment.Author, &comment.CreatedAt); err != nil {
+			return err
+		}
+		if err := indexer.Index(ctx, comment); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Rebuild the search index from the database. Does nothing unless the search
+// engine is an indexer.
+func ReindexSearch(ctx context.Context, db *sql.DB) error {
+	indexer, ok := searchEngine.(search.Indexer)
+	if !ok {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id FROM threads WHERE deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	var threadIDs []int
+	for rows.Next() {
+		var threadID int
+		if err := rows.Scan(&threadID); err != nil {
+			rows.Close()
+			return err
+		}
+		threadIDs = append(threadIDs, threadID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, threadID := range threadIDs {
+		if err := indexThread(ctx, db, indexer, threadID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
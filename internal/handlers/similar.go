@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Most similar threads returned by default and at most
+const (
+	defaultSimilarLimit = 5
+	maxSimilarLimit     = 20
+)
+
+// A thread whose name is similar to a proposed one
+type SimilarThread struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	CategoryID   int       `json:"category_id"`
+	CommentCount int       `json:"comment_count"`
+	Similarity   float64   `json:"similarity"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Check whether creating a thread requires confirming that it is not a duplicate
+// of the similar threads, which is enabled by setting DUPLICATE_CHECK=confirm
+func duplicateCheckEnabled() bool {
+	return os.Getenv("DUPLICATE_CHECK") == "confirm"
+}
+
+// Whether the pg_trgm extension is installed, checked once it is first needed
+var trigramCheck struct {
+	sync.Mutex
+	checked   bool
+	available bool
+}
+
+// Check whether the pg_trgm extension is installed. It is missing if the
+// database user was not allowed to create it, in which case no threads are
+// found to be similar.
+func trigramsAvailable(db *sql.DB) (bool, error) {
+	trigramCheck.Lock()
+	defer trigramCheck.Unlock()
+	if !trigramCheck.checked {
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')").Scan(&trigramCheck.available)
+		if err != nil {
+			return false, err
+		}
+		trigramCheck.checked = true
+		if !trigramCheck.available {
+			log.Println("The pg_trgm extension is not installed, so no similar threads are suggested")
+		}
+	}
+	return trigramCheck.available, nil
+}
+
+// Find the threads readable by the logged-in user whose names are most similar
+// to the given name, using trigram similarity
+func findSimilarThreads(c *gin.Context, db *sql.DB, name string, limit int) ([]SimilarThread, error) {
+	threads := []SimilarThread{}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return threads, nil
+	}
+	available, err := trigramsAvailable(db)
+	if err != nil || !available {
+		return threads, err
+	}
+	categoryIDs, err := readableCategoryIDs(c, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// The % operator uses the trigram index to find names above the similarity threshold
+	rows, err := db.Query(`
+	SELECT t.id, t.name, t.category_id, t.created_at, similarity(t.name, $1) AS similarity,
+		(SELECT COUNT(*) FROM comments WHERE comments.thread_id = t.id AND comments.deleted_at IS NULL)
+	FROM threads t
+	WHERE t.name % $1 AND t.deleted_at IS NULL AND t.hidden_at IS NULL AND t.category_id = ANY($2)
+	ORDER BY similarity DESC, t.id DESC
+	LIMIT $3
+	`, name, pq.Array(categoryIDs), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var thread SimilarThread
+		if err := rows.Scan(&thread.ID, &thread.Name, &thread.CategoryID, &thread.CreatedAt, &thread.Similarity, &thread.CommentCount); err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	return threads, rows.Err()
+}
+
+// Similar thread listing endpoint, for suggesting existing threads before a new one is created
+func ListSimilarThreads(c *gin.Context, db *sql.DB) {
+	// Parse the proposed title and the number of threads to return
+	title := c.Query("title")
+	if strings.TrimSpace(title) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Title cannot be empty"})
+		return
+	}
+	limit := defaultSimilarLimit
+	if param := c.Query("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxSimilarLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxSimilarLimit)})
+			return
+		}
+	}
+
+	// Find the similar threads
+	threads, err := findSimilarThreads(c, db, title, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar threads"})
+		return
+	}
+
+	// Return the similar threads, most similar first
+	c.JSON(http.StatusOK, threads)
+}
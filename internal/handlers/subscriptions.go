@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Read state of a thread for the logged-in user
+type threadReadState struct {
+	Watching             bool
+	UnreadCount          int
+	FirstUnreadCommentID *int
+}
+
+// Watch a thread on behalf of a user who posted in it, unless they unwatched
+// it before, and mark their own comment as read. A lastReadCommentID of 0
+// leaves the read position unchanged.
+func autoWatchThread(q queryer, userID int, threadID int, lastReadCommentID int) error {
+	_, err := q.Exec(`
+	INSERT INTO thread_subscriptions (user_id, thread_id, watching, last_read_comment_id)
+	SELECT id, $2::int, TRUE, NULLIF($3::int, 0) FROM users WHERE id = $1
+	ON CONFLICT (user_id, thread_id) DO UPDATE SET
+		watching = COALESCE(thread_subscriptions.watching, TRUE),
+		last_read_comment_id = GREATEST(thread_subscriptions.last_read_comment_id, EXCLUDED.last_read_comment_id)
+	`, userID, threadID, lastReadCommentID)
+	return err
+}
+
+// Get the read state of the given threads for a user with a single query. Comments
+// newer than the last one the user read are unread, so every comment of a thread
+// the user never read is unread.
+func getReadStates(db *sql.DB, userID int, threadIDs []int) (map[int]threadReadState, error) {
+	rows, err := db.Query(`
+	SELECT t.id, COALESCE(BOOL_OR(s.watching), FALSE), COUNT(m.id), MIN(m.id)
+	FROM unnest($2::int[]) AS t(id)
+	LEFT JOIN thread_subscriptions s ON s.thread_id = t.id AND s.user_id = $1
+	LEFT JOIN comments m ON m.thread_id = t.id AND m.deleted_at IS NULL AND m.hidden_at IS NULL AND m.id > COALESCE(s.last_read_comment_id, 0)
+	GROUP BY t.id
+	`, userID, pq.Array(threadIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[int]threadReadState)
+	for rows.Next() {
+		var threadID int
+		var state threadReadState
+		var firstUnread sql.NullInt64
+		if err := rows.Scan(&threadID, &state.Watching, &state.UnreadCount, &firstUnread); err != nil {
+			return nil, err
+		}
+		if firstUnread.Valid {
+			id := int(firstUnread.Int64)
+			state.FirstUnreadCommentID = &id
+		}
+		states[threadID] = state
+	}
+	return states, rows.Err()
+}
+
+// Parse the thread ID from the URL and ensure the logged-in user can read the thread,
+// responding with an error and returning false otherwise
+func readableThreadParam(c *gin.Context, db *sql.DB) (int, bool) {
+	threadID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid thread ID"})
+		return 0, false
+	}
+	allowed, err := checkThreadAccess(c, db, threadID, false)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return 0, false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot read this category"})
+		return 0, false
+	}
+	return threadID, true
+}
+
+// Watch a thread
+func WatchThread(c *gin.Context, db *sql.DB) {
+	setWatching(c, db, true)
+}
+
+// Stop watching a thread. The thread is then no longer watched automatically
+// when the user comments on it.
+func UnwatchThread(c *gin.Context, db *sql.DB) {
+	setWatching(c, db, false)
+}
+
+func setWatching(c *gin.Context, db *sql.DB, watching bool) {
+	threadID, ok := readableThreadParam(c, db)
+	if !ok {
+		return
+	}
+	userID, _ := currentUserID(c)
+
+	// Insert or update the user's subscription
+	_, err := db.Exec(`
+	INSERT INTO thread_subscriptions (user_id, thread_id, watching) VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, thread_id) DO UPDATE SET watching = EXCLUDED.watching
+	`, userID, threadID, watching)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription"})
+		return
+	}
+
+	// Return the new subscription state
+	c.JSON(http.StatusOK, gin.H{"thread_id": threadID, "watching": watching})
+}
+
+// Mark a thread as read up to and including a comment, or up to its latest comment
+// if none is given. Marking an earlier comment marks the later ones unread again.
+func MarkThreadRead(c *gin.Context, db *sql.DB) {
+	threadID, ok := readableThreadParam(c, db)
+	if !ok {
+		return
+	}
+	userID, _ := currentUserID(c)
+
+	// Parse the optional comment ID from the request body
+	var input struct {
+		CommentID int `json:"comment_id"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	// Ensure the comment belongs to the thread, defaulting to the latest comment
+	var lastRead sql.NullInt64
+	var err error
+	if input.CommentID != 0 {
+		err = db.QueryRow("SELECT id FROM comments WHERE id = $1 AND thread_id = $2", input.CommentID, threadID).Scan(&lastRead)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Comment not found in this thread"})
+			return
+		}
+	} else {
+		err = db.QueryRow("SELECT MAX(id) FROM comments WHERE thread_id = $1", threadID).Scan(&lastRead)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up comment"})
+		return
+	}
+
+	// Save the read position
+	_, err = db.Exec(`
+	INSERT INTO thread_subscriptions (user_id, thread_id, last_read_comment_id) VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, thread_id) DO UPDATE SET last_read_comment_id = EXCLUDED.last_read_comment_id
+	`, userID, threadID, lastRead)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark thread as read"})
+		return
+	}
+
+	// Return the new read position, which is null if the thread has no comments
+	response := gin.H{"thread_id": threadID, "last_read_comment_id": nil}
+	if lastRead.Valid {
+		response["last_read_comment_id"] = lastRead.Int64
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A suspension of a user. Suspensions without an expiry are permanent bans.
+type Suspension struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	Reason        string     `json:"reason"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	Permanent     bool       `json:"permanent"`
+	CreatedBy     *int       `json:"created_by"`
+	CreatedByName *string    `json:"created_by_name"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LiftedAt      *time.Time `json:"lifted_at"`
+	LiftedBy      *int       `json:"lifted_by"`
+}
+
+// Maximum length of the reason for a suspension
+const maxSuspensionReasonLength = 1000
+
+// Columns selected to scan a suspension, from user_suspensions s joined with
+// the moderator who created it as u
+const suspensionColumns = "s.id, s.user_id, s.reason, s.expires_at, s.created_by, u.username, s.created_at, s.lifted_at, s.lifted_by"
+
+func scanSuspension(row interface{ Scan(...interface{}) error }, s *Suspension) error {
+	if err := row.Scan(&s.ID, &s.UserID, &s.Reason, &s.ExpiresAt, &s.CreatedBy, &s.CreatedByName, &s.CreatedAt, &s.LiftedAt, &s.LiftedBy); err != nil {
+		return err
+	}
+	s.Permanent = s.ExpiresAt == nil
+	return nil
+}
+
+// Get the active suspension of a user, or nil if they are not suspended. A
+// suspension that expired is no longer active, even before the job lifting
+// expired suspensions has run.
+func activeSuspension(q queryer, userID int) (*Suspension, error) {
+	var suspension Suspension
+	err := scanSuspension(q.QueryRow(`
+	SELECT `+suspensionColumns+`
+	FROM user_suspensions s
+	LEFT JOIN users u ON u.id = s.created_by
+	WHERE s.user_id = $1 AND s.lifted_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > CURRENT_TIMESTAMP)
+	`, userID), &suspension)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &suspension, nil
+}
+
+// Respond that a suspended user cannot do what they requested
+func respondSuspended(c *gin.Context, suspension *Suspension) {
+	message := "Your account is banned: " + suspension.Reason
+	if suspension.ExpiresAt != nil {
+		message = "Your account is suspended until " + suspension.ExpiresAt.UTC().Format(time.RFC3339) + ": " + suspension.Reason
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":           message,
+		"reason":          suspension.Reason,
+		"suspended_until": suspension.ExpiresAt,
+		"permanent":       suspension.Permanent,
+	})
+}
+
+// Get the author of new content, which is always the logged-in user, and check
+// that they are not suspended. A user_id given in the request body must be
+// theirs. Responds with an error and returns false otherwise. Inbound content
+// is posted on behalf of users without passing RejectSuspendedWrites, so
+// creation handlers check suspensions themselves.
+func contentAuthor(c *gin.Context, db *sql.DB, bodyUserID int) (int, bool) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+		return 0, false
+	}
+	if bodyUserID != 0 && bodyUserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only post as yourself"})
+		return 0, false
+	}
+	suspension, err := activeSuspension(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up suspension"})
+		return 0, false
+	}
+	if suspension != nil {
+		respondSuspended(c, suspension)
+		return 0, false
+	}
+	return userID, true
+}
+
+// Parse the ID of the user from the URL parameter and look up their role,
+// responding with an error and returning false if they do not exist
+func suspendedUserParam(c *gin.Context, db *sql.DB) (int, string, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, "", false
+	}
+	var role string
+	err = db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return 0, "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return 0, "", false
+	}
+	return userID, role, true
+}
+
+// Suspend a user until a time given as expires_at, or ban them permanently with
+// permanent set to true. Moderators can only suspend users with a lower role
+// than their own. A new suspension replaces the user's active one.
+func SuspendUser(c *gin.Context, db *sql.DB) {
+	actorID, _ := currentUserID(c)
+	userID, targetRole, ok := suspendedUserParam(c, db)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var input struct {
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Permanent bool       `json:"permanent"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+	if input.Reason == "" || len(input.Reason) > maxSuspensionReasonLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason must be between 1 and " + strconv.Itoa(maxSuspensionReasonLength) + " bytes"})
+		return
+	}
+	if input.Permanent == (input.ExpiresAt != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either expires_at for a suspension or permanent for a ban"})
+		return
+	}
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	// Ensure the target's role is lower than the moderator's
+	actorRole, err := currentUserRole(c, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user role"})
+		return
+	}
+	if hasRole(targetRole, actorRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only suspend users with a lower role than yours"})
+		return
+	}
+
+	// Start a transaction so the suspension and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Replace the user's active suspension, if any
+	previous, err := activeSuspension(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up suspension"})
+		return
+	}
+	result, err := tx.Exec("UPDATE user_suspensions SET lifted_at = CURRENT_TIMESTAMP, lifted_by = $2 WHERE user_id = $1 AND lifted_at IS NULL", userID, actorID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace suspension"})
+		return
+	}
+	replaced, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+		return
+	}
+
+	// Insert the suspension and log it
+	var suspensionID int
+	err = tx.QueryRow("INSERT INTO user_suspensions (user_id, reason, expires_at, created_by) VALUES ($1, $2, $3, $4) RETURNING id", userID, input.Reason, input.ExpiresAt, actorID).Scan(&suspensionID)
+	if err != nil {
+		log.Printf("Error suspending user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to suspend user"})
+		return
+	}
+	suspension, err := activeSuspension(tx, userID)
+	if err != nil || suspension == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up suspension"})
+		return
+	}
+	action := LogUserSuspended
+	if input.Permanent {
+		action = LogUserBanned
+	}
+	entry := moderationLogEntry{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   userID,
+		Reason:     input.Reason,
+		Details:    gin.H{"suspension_id": suspensionID, "expires_at": input.ExpiresAt, "replaced_active": replaced > 0},
+		After:      suspension,
+	}
+	if previous != nil {
+		entry.Before = previous
+	}
+	if err := logAction(c, tx, entry); err != nil {
+		log.Printf("Error logging suspension: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log suspension"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the suspension
+	c.JSON(http.StatusCreated, suspension)
+}
+
+// Lift a user's active suspension or ban early, with an optional reason
+func LiftSuspension(c *gin.Context, db *sql.DB) {
+	actorID, _ := currentUserID(c)
+	userID, _, ok := suspendedUserParam(c, db)
+	if !ok {
+		return
+	}
+
+	// Parse the optional reason from the request body
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+	if len(input.Reason) > maxSuspensionReasonLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason must be at most " + strconv.Itoa(maxSuspensionReasonLength) + " bytes"})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lift the active suspension
+	suspension, err := activeSuspension(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up suspension"})
+		return
+	}
+	if suspension == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not suspended"})
+		return
+	}
+	result, err := tx.Exec("UPDATE user_suspensions SET lifted_at = CURRENT_TIMESTAMP, lifted_by = $2 WHERE id = $1 AND lifted_at IS NULL", suspension.ID, actorID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lift suspension"})
+		return
+	}
+
+	// If no rows were affected, the suspension was lifted concurrently
+	if lifted, err := result.RowsAffected(); err != nil || lifted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not suspended"})
+		return
+	}
+	err = logAction(c, tx, moderationLogEntry{
+		Action:     LogSuspensionLifted,
+		TargetType: "user",
+		TargetID:   userID,
+		Reason:     input.Reason,
+		Details:    gin.H{"suspension_id": suspension.ID},
+		Before:     suspension,
+	})
+	if err != nil {
+		log.Printf("Error logging lifted suspension: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Suspension lifted successfully"})
+}
+
+// Suspension history endpoint of a user, newest first
+func ListSuspensions(c *gin.Context, db *sql.DB) {
+	userID, _, ok := suspendedUserParam(c, db)
+	if !ok {
+		return
+	}
+
+	// Query database for the user's suspensions
+	rows, err := db.Query(`
+	SELECT `+suspensionColumns+`
+	FROM user_suspensions s
+	LEFT JOIN users u ON u.id = s.created_by
+	WHERE s.user_id = $1
+	ORDER BY s.id DESC
+	`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// Create slice of suspensions
+	suspensions := []Suspension{}
+	for rows.Next() {
+		var suspension Suspension
+		if err := scanSuspension(rows, &suspension); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		suspensions = append(suspensions, suspension)
+	}
+
+	// Return slice of suspensions
+	c.JSON(http.StatusOK, suspensions)
+}
+
+// Lift the suspensions that expired, logging each of them. Suspensions are
+// lifted at the time they expired rather than when the job noticed.
+func LiftExpiredSuspensions(ctx context.Context, db *sql.DB) error {
+	result, err := db.ExecContext(ctx, `
+	WITH lifted AS (
+		UPDATE user_suspensions SET lifted_at = expires_at
+		WHERE lifted_at IS NULL AND expires_at <= CURRENT_TIMESTAMP
+		RETURNING id, user_id, reason, expires_at
+	)
+	INSERT INTO moderation_log (action, target_type, target_id, target_user_id, reason, details)
+	SELECT $1, 'user', user_id, user_id, reason, json_build_object('suspension_id', id, 'expires_at', expires_at) FROM lifted
+	`, LogSuspensionExpired)
+	if err != nil {
+		return err
+	}
+	if lifted, err := result.RowsAffected(); err == nil && lifted > 0 {
+		log.Printf("Lifted %d expired suspensions", lifted)
+	}
+	return nil
+}
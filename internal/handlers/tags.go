@@ -0,0 +1,874 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type Tag struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Slug        string   `json:"slug"`
+	Colour      string   `json:"colour"`
+	Description string   `json:"description"`
+	ParentID    *int     `json:"parent_id"`
+	Synonyms    []string `json:"synonyms"`
+}
+
+var (
+	slugPattern   = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	colourPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+	nonSlugChars  = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// All tags along with lookups by name and by parent
+type tagSet struct {
+	tags     []Tag
+	byID     map[int]Tag
+	byName   map[string]Tag // Includes synonyms, mapped to their canonical tag
+	children map[int][]int
+}
+
+// How long a cached tag set is used before being reloaded. Each server keeps
+// its own cache, so this bounds how long another server's tag changes can take
+// to show up.
+const tagCacheTTL = time.Minute
+
+// Cached copy of the tags and synonyms tables, loaded on first use and cleared whenever tags change.
+// The generation is bumped on every invalidation so that a load which started
+// before it does not store a stale set.
+var tagCache struct {
+	sync.RWMutex
+	set        *tagSet
+	loadedAt   time.Time
+	generation int
+}
+
+// Get the set of tags from the cache or the database
+func getTagSet(db *sql.DB) (*tagSet, error) {
+	tagCache.RLock()
+	set := tagCache.set
+	loadedAt := tagCache.loadedAt
+	generation := tagCache.generation
+	tagCache.RUnlock()
+	if set != nil && time.Since(loadedAt) < tagCacheTTL {
+		return set, nil
+	}
+
+	// Load the tags from the database
+	rows, err := db.Query("SELECT id, name, slug, colour, description, parent_id FROM tags ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	set = &tagSet{
+		tags:     []Tag{},
+		byID:     make(map[int]Tag),
+		byName:   make(map[string]Tag),
+		children: make(map[int][]int),
+	}
+	for rows.Next() {
+		tag := Tag{Synonyms: []string{}}
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Slug, &tag.Colour, &tag.Description, &tag.ParentID); err != nil {
+			return nil, err
+		}
+		set.tags = append(set.tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Load the synonyms and attach them to their tags
+	synonyms := make(map[int][]string)
+	synonymRows, err := db.Query("SELECT name, tag_id FROM tag_synonyms ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer synonymRows.Close()
+	for synonymRows.Next() {
+		var name string
+		var tagID int
+		if err := synonymRows.Scan(&name, &tagID); err != nil {
+			return nil, err
+		}
+		synonyms[tagID] = append(synonyms[tagID], name)
+	}
+	if err := synonymRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Index the tags
+	for i := range set.tags {
+		tag := &set.tags[i]
+		if names, ok := synonyms[tag.ID]; ok {
+			tag.Synonyms = names
+		}
+		set.byID[tag.ID] = *tag
+		set.byName[tag.Name] = *tag
+		for _, name := range tag.Synonyms {
+			set.byName[name] = *tag
+		}
+		if tag.ParentID != nil {
+			set.children[*tag.ParentID] = append(set.children[*tag.ParentID], tag.ID)
+		}
+	}
+
+	// Only cache the set if the tags have not changed since the load started
+	tagCache.Lock()
+	if tagCache.generation == generation {
+		tagCache.set = set
+		tagCache.loadedAt = time.Now()
+	}
+	tagCache.Unlock()
+	return set, nil
+}
+
+// Get all tags, ordered by ID
+func getTags(db *sql.DB) ([]Tag, error) {
+	set, err := getTagSet(db)
+	if err != nil {
+		return nil, err
+	}
+	return set.tags, nil
+}
+
+// Get the IDs of a tag and all tags nested under it. Each tag is visited once,
+// so a cycle in the hierarchy cannot make this loop forever.
+func (set *tagSet) descendants(tagID int) []int {
+	ids := []int{tagID}
+	visited := map[int]bool{tagID: true}
+	for i := 0; i < len(ids); i++ {
+		for _, child := range set.children[ids[i]] {
+			if !visited[child] {
+				visited[child] = true
+				ids = append(ids, child)
+			}
+		}
+	}
+	return ids
+}
+
+// Lock the tags table against concurrent writes until the end of the
+// transaction, while still allowing reads. Changes to the hierarchy take this
+// lock so that checks against it cannot be invalidated by a concurrent change.
+func lockTags(q queryer) error {
+	_, err := q.Exec("LOCK TABLE tags IN SHARE ROW EXCLUSIVE MODE")
+	return err
+}
+
+// Check whether a tag is the given tag or one of its ancestors, reading the
+// hierarchy from the database rather than the cache, which may be stale
+func isTagAncestor(q queryer, ancestorID int, tagID int) (bool, error) {
+	var ancestor bool
+	err := q.QueryRow(`
+	WITH RECURSIVE ancestors (id, parent_id) AS (
+		SELECT id, parent_id FROM tags WHERE id = $2
+		UNION
+		SELECT t.id, t.parent_id FROM tags t JOIN ancestors a ON t.id = a.parent_id
+	)
+	SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $1)
+	`, ancestorID, tagID).Scan(&ancestor)
+	return ancestor, err
+}
+
+// Clear the tag cache so the next lookup reloads it from the database
+func invalidateTagCache() {
+	tagCache.Lock()
+	tagCache.set = nil
+	tagCache.generation++
+	tagCache.Unlock()
+}
+
+// Look up tags by name or synonym, returning the canonical tags without duplicates.
+// Returns an inputError for any name that is not a tag or synonym.
+func resolveTags(db *sql.DB, names []string) ([]Tag, error) {
+	set, err := getTagSet(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved []Tag
+	seen := make(map[int]bool)
+	for _, name := range names {
+		tag, ok := set.byName[name]
+		if !ok {
+			return nil, inputError{"Invalid tag: " + name}
+		}
+		if !seen[tag.ID] {
+			seen[tag.ID] = true
+			resolved = append(resolved, tag)
+		}
+	}
+	return resolved, nil
+}
+
+// Associate tags with a thread
+func saveThreadTags(q queryer, threadID int, tags []Tag) error {
+	for _, tag := range tags {
+		_, err := q.Exec("INSERT INTO thread_tags (thread_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", threadID, tag.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Turn a tag name into a URL-friendly slug
+func slugify(name string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// Validate a tag's fields, filling in the slug from the name if it is empty
+func validateTag(tag *Tag) error {
+	tag.Name = strings.TrimSpace(tag.Name)
+	if tag.Name == "" {
+		return inputError{"Tag name cannot be empty"}
+	}
+	if tag.Slug == "" {
+		tag.Slug = slugify(tag.Name)
+	}
+	if !slugPattern.MatchString(tag.Slug) {
+		return inputError{"Tag slug may only contain lowercase letters, digits and dashes"}
+	}
+	if tag.Colour != "" && !colourPattern.MatchString(tag.Colour) {
+		return inputError{"Tag colour must be a hex colour such as #1E90FF"}
+	}
+	return nil
+}
+
+// Validate a tag's parent, which must exist and must not be the tag itself or
+// nested under it. A tagID of 0 means the tag is new.
+func validateTagParent(db *sql.DB, tagID int, parentID *int) error {
+	if parentID == nil {
+		return nil
+	}
+	set, err := getTagSet(db)
+	if err != nil {
+		return err
+	}
+	if _, ok := set.byID[*parentID]; !ok {
+		return inputError{"Parent tag not found"}
+	}
+	if tagID != 0 {
+		for _, id := range set.descendants(tagID) {
+			if id == *parentID {
+				return inputError{"A tag cannot be nested under itself"}
+			}
+		}
+	}
+	return nil
+}
+
+// Check that a name is not already used by a tag or synonym other than the given tag
+func validateTagNameAvailable(db *sql.DB, tagID int, name string) error {
+	set, err := getTagSet(db)
+	if err != nil {
+		return err
+	}
+	if tag, ok := set.byName[name]; ok && tag.ID != tagID {
+		return inputError{"The name " + name + " is already used by the tag " + tag.Name}
+	}
+	return nil
+}
+
+// Respond with a bad request for input errors and an internal error otherwise
+func respondWithError(c *gin.Context, err error, message string) {
+	if _, ok := err.(inputError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// Report a tag write error, treating unique violations as conflicts
+func tagWriteError(c *gin.Context, err error) {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "A tag with this name or slug already exists"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save tag"})
+}
+
+// Tags listing endpoint, including how many threads have each tag
+func ListTags(c *gin.Context, db *sql.DB) {
+	set, err := getTagSet(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+	tags := set.tags
+	readable, err := readableCategoryIDs(c, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve categories"})
+		return
+	}
+
+	// Pair each tag with itself and the tags nested under it, so that a tag's
+	// count includes the threads that filtering by it returns
+	var tagIDs, descendantIDs []int
+	for _, tag := range tags {
+		for _, id := range set.descendants(tag.ID) {
+			tagIDs = append(tagIDs, tag.ID)
+			descendantIDs = append(descendantIDs, id)
+		}
+	}
+
+	// Count the visible threads per tag, which changes too often to cache
+	rows, err := db.Query(`
+	SELECT pairs.tag_id, COUNT(DISTINCT threads.id)
+	FROM unnest($1::int[], $2::int[]) AS pairs (tag_id, descendant_id)
+	JOIN thread_tags ON thread_tags.tag_id = pairs.descendant_id
+	JOIN threads ON threads.id = thread_tags.thread_id
+	WHERE threads.deleted_at IS NULL AND threads.hidden_at IS NULL AND threads.category_id = ANY($3)
+	GROUP BY pairs.tag_id
+	`, pq.Array(tagIDs), pq.Array(descendantIDs), pq.Array(readable))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count threads"})
+		return
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var tagID, count int
+		if err := rows.Scan(&tagID, &count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count threads"})
+			return
+		}
+		counts[tagID] = count
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count threads"})
+		return
+	}
+
+	// Return the list of tags with their thread counts
+	type tagWithCount struct {
+		Tag
+		ThreadCount int `json:"thread_count"`
+	}
+	list := make([]tagWithCount, len(tags))
+	for i, tag := range tags {
+		list[i] = tagWithCount{tag, counts[tag.ID]}
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// Tag creation endpoint
+func CreateTag(c *gin.Context, db *sql.DB) {
+	// Parse JSON request body into Tag struct
+	var tag Tag
+	if err := c.ShouldBindJSON(&tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTag(&tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTagNameAvailable(db, 0, tag.Name); err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+	if err := validateTagParent(db, 0, tag.ParentID); err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+	tag.Synonyms = []string{}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Insert tag into database with RETURNING id
+	err = tx.QueryRow("INSERT INTO tags (name, slug, colour, description, parent_id) VALUES ($1, $2, $3, $4, $5) RETURNING id", tag.Name, tag.Slug, tag.Colour, tag.Description, tag.ParentID).Scan(&tag.ID)
+	if err != nil {
+		tagWriteError(c, err)
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogTagCreated, TargetType: "tag", TargetID: tag.ID}, nil); err != nil {
+		log.Printf("Error logging tag creation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	invalidateTagCache()
+
+	// Return the added tag
+	c.JSON(http.StatusOK, tag)
+}
+
+// Update a tag by ID
+func UpdateTag(c *gin.Context, db *sql.DB) {
+	// Parse the tag ID from the URL parameter
+	tagID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag ID"})
+		return
+	}
+
+	// Parse the request body. Only the fields present are changed, and a
+	// parent_id of null moves the tag to the top level.
+	var input struct {
+		Name        *string         `json:"name"`
+		Slug        *string         `json:"slug"`
+		Colour      *string         `json:"colour"`
+		Description *string         `json:"description"`
+		ParentID    json.RawMessage `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var parentID *int
+	if input.ParentID != nil {
+		if err := json.Unmarshal(input.ParentID, &parentID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent ID"})
+			return
+		}
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the hierarchy before reading the tag, so concurrent updates cannot
+	// nest two tags under each other or overwrite each other's fields
+	if err := lockTags(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock tags"})
+		return
+	}
+	tag := Tag{ID: tagID}
+	err = tx.QueryRow("SELECT name, slug, colour, description, parent_id FROM tags WHERE id = $1", tagID).Scan(&tag.Name, &tag.Slug, &tag.Colour, &tag.Description, &tag.ParentID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tag"})
+		return
+	}
+
+	// Apply the changes and validate the result
+	if input.Name != nil {
+		tag.Name = *input.Name
+	}
+	if input.Slug != nil {
+		tag.Slug = *input.Slug
+	}
+	if input.Colour != nil {
+		tag.Colour = *input.Colour
+	}
+	if input.Description != nil {
+		tag.Description = *input.Description
+	}
+	if input.ParentID != nil {
+		tag.ParentID = parentID
+	}
+	if err := validateTag(&tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTagNameAvailable(db, tagID, tag.Name); err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+	if err := validateTagParent(db, tagID, tag.ParentID); err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+	if tag.ParentID != nil {
+		cycle, err := isTagAncestor(tx, tagID, *tag.ParentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check tag parent"})
+			return
+		}
+		if cycle {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A tag cannot be nested under itself"})
+			return
+		}
+	}
+
+	// Execute SQL to update the tag
+	before, err := snapshotTarget(tx, "tag", tagID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tag"})
+		return
+	}
+	_, err = tx.Exec("UPDATE tags SET name = $1, slug = $2, colour = $3, description = $4, parent_id = $5 WHERE id = $6", tag.Name, tag.Slug, tag.Colour, tag.Description, tag.ParentID, tagID)
+	if err != nil {
+		tagWriteError(c, err)
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogTagUpdated, TargetType: "tag", TargetID: tagID}, before); err != nil {
+		log.Printf("Error logging tag update: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	invalidateTagCache()
+
+	// Return the updated tag with its synonyms
+	set, err := getTagSet(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+	c.JSON(http.StatusOK, set.byID[tagID])
+}
+
+// Delete a tag by ID, removing it from all threads
+func DeleteTag(c *gin.Context, db *sql.DB) {
+	// Parse the tag ID from the URL parameter
+	tagID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag ID"})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Execute SQL to delete the tag. Its thread_tags rows are removed by the cascade.
+	before, err := snapshotTarget(tx, "tag", tagID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tag"})
+		return
+	}
+	result, err := tx.Exec("DELETE FROM tags WHERE id = $1", tagID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tag"})
+		return
+	}
+
+	// Remove the tag from the webhooks filtered on it. A webhook left without
+	// tags is deactivated, rather than starting to receive every thread.
+	_, err = tx.Exec("UPDATE webhooks SET tag_ids = array_remove(tag_ids, $1::int), active = active AND cardinality(tag_ids) > 1 WHERE $1::int = ANY(tag_ids)", tagID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhooks"})
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify deletion"})
+		return
+	}
+
+	// If no rows were affected, the tag does not exist
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogTagDeleted, TargetType: "tag", TargetID: tagID}, before); err != nil {
+		log.Printf("Error logging tag deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	invalidateTagCache()
+	reindexAll(db)
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Tag deleted successfully"})
+}
+
+// Add a synonym that is mapped to a tag
+func AddTagSynonym(c *gin.Context, db *sql.DB) {
+	// Parse the tag ID from the URL parameter
+	tagID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag ID"})
+		return
+	}
+
+	// Parse the request body
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Synonym cannot be empty"})
+		return
+	}
+
+	// Ensure the name is not already a tag or synonym
+	if err := validateTagNameAvailable(db, 0, input.Name); err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Insert the synonym
+	_, err = tx.Exec("INSERT INTO tag_synonyms (name, tag_id) VALUES ($1, $2)", input.Name, tagID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err != nil {
+		tagWriteError(c, err)
+		return
+	}
+	err = logAction(c, tx, moderationLogEntry{Action: LogTagSynonymAdded, TargetType: "tag", TargetID: tagID, After: gin.H{"name": input.Name, "tag_id": tagID}})
+	if err != nil {
+		log.Printf("Error logging synonym: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	invalidateTagCache()
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Synonym added successfully"})
+}
+
+// Remove a synonym from a tag
+func DeleteTagSynonym(c *gin.Context, db *sql.DB) {
+	// Parse the tag ID from the URL parameter
+	tagID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag ID"})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Execute SQL to delete the synonym
+	result, err := tx.Exec("DELETE FROM tag_synonyms WHERE tag_id = $1 AND name = $2", tagID, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete synonym"})
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify deletion"})
+		return
+	}
+
+	// If no rows were affected, the synonym does not exist
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Synonym not found"})
+		return
+	}
+	err = logAction(c, tx, moderationLogEntry{Action: LogTagSynonymDeleted, TargetType: "tag", TargetID: tagID, Before: gin.H{"name": c.Param("name"), "tag_id": tagID}})
+	if err != nil {
+		log.Printf("Error logging synonym deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	invalidateTagCache()
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Synonym deleted successfully"})
+}
+
+// Merge a tag into another tag. Threads, child tags and synonyms move to the
+// target tag, and the merged tag's name becomes a synonym of the target.
+func MergeTag(c *gin.Context, db *sql.DB) {
+	// Parse the tag ID from the URL parameter
+	sourceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag ID"})
+		return
+	}
+
+	// Parse the ID of the tag to merge into from the request body
+	var input struct {
+		Into int `json:"into"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if input.Into == sourceID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tag cannot be merged into itself"})
+		return
+	}
+
+	// Ensure both tags exist, and that the target is not nested under the source
+	set, err := getTagSet(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+	if _, ok := set.byID[sourceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if _, ok := set.byID[input.Into]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Target tag not found"})
+		return
+	}
+	for _, id := range set.descendants(sourceID) {
+		if id == input.Into {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A tag cannot be merged into a tag nested under it"})
+			return
+		}
+	}
+
+	// Start a transaction so the merge happens all at once
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Check again with the hierarchy locked that both tags exist and that the
+	// target is not nested under the source, since the children of the source
+	// move to the target
+	if err := lockTags(tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock tags"})
+		return
+	}
+	var sourceName string
+	err = tx.QueryRow("SELECT name FROM tags WHERE id = $1", sourceID).Scan(&sourceName)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tag"})
+		return
+	}
+	var targetExists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tags WHERE id = $1)", input.Into).Scan(&targetExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tag"})
+		return
+	}
+	if !targetExists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Target tag not found"})
+		return
+	}
+	nested, err := isTagAncestor(tx, sourceID, input.Into)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check tags"})
+		return
+	}
+	if nested {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tag cannot be merged into a tag nested under it"})
+		return
+	}
+
+	// Snapshot the merged tag, which is deleted
+	before, err := snapshotTarget(tx, "tag", sourceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tag"})
+		return
+	}
+
+	statements := []string{
+		// Move the threads, skipping those that already have the target tag
+		"INSERT INTO thread_tags (thread_id, tag_id) SELECT thread_id, $2 FROM thread_tags WHERE tag_id = $1 ON CONFLICT DO NOTHING",
+		"DELETE FROM thread_tags WHERE tag_id = $1",
+		// Move the child tags and synonyms
+		"UPDATE tags SET parent_id = $2 WHERE parent_id = $1",
+		"UPDATE tag_synonyms SET tag_id = $2 WHERE tag_id = $1",
+		// Filter the webhooks on the target instead, without listing it twice
+		"UPDATE webhooks SET tag_ids = array_remove(tag_ids, $1::int) || CASE WHEN $2::int = ANY(tag_ids) THEN '{}'::int[] ELSE ARRAY[$2::int] END WHERE $1::int = ANY(tag_ids)",
+		// Delete the merged tag
+		"DELETE FROM tags WHERE id = $1",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, sourceID, input.Into); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge tags"})
+			return
+		}
+	}
+
+	// Keep the merged tag's name working as a synonym of the target
+	_, err = tx.Exec("INSERT INTO tag_synonyms (name, tag_id) VALUES ($1, $2)", sourceName, input.Into)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge tags"})
+		return
+	}
+
+	// Log the merge
+	if err := logChange(c, tx, moderationLogEntry{Action: LogTagMerged, TargetType: "tag", TargetID: sourceID, Details: gin.H{"into": input.Into}}, before); err != nil {
+		log.Printf("Error logging tag merge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	invalidateTagCache()
+	reindexAll(db)
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Tags merged successfully"})
+}
@@ -6,135 +6,457 @@ import (
 	"net/http"
 	"strings"
 	"strconv"
+	"time"
 
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/CVWO/sample-go-app/internal/render"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	_ "github.com/glebarez/go-sqlite"
-	_ "github.com/lib/pq"
 )
 
 type Thread struct {
 	ID int `json:"id"`
 	Name string `json:"name"`
+	NameHTML string `json:"name_html"`
 	UserID int `json:"user_id"`
+	UserName string `json:"user_name"`
 	Tags []string `json:"tags"`
+	CategoryID int `json:"category_id"`
+	CreatedAt *time.Time `json:"created_at"`
+	EditedAt *time.Time `json:"edited_at"`
+	// Read state for the logged-in user, omitted for guests
+	Watching *bool `json:"watching,omitempty"`
+	UnreadCount *int `json:"unread_count,omitempty"`
+	FirstUnreadCommentID *int `json:"first_unread_comment_id,omitempty"`
 }
 
 // Thread creation endpoint
 func CreateThread(c *gin.Context, db *sql.DB) {
-	// Predefined list of allowed tags
-    predefinedTags := map[string]bool{
-        "School":             true,
-        "Work":               true,
-        "Interests and Hobbies": true,
-        "Miscellaneous":      true,
-    }
+	// Parse JSON request body into Channel struct, along with whether to skip
+	// the duplicate check
+	var input struct {
+		Thread
+		ConfirmDuplicateCheck bool `json:"confirm_duplicate_check"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	thread := input.Thread
+	userID, ok := contentAuthor(c, db, thread.UserID)
+	if !ok {
+		return
+	}
+	thread.UserID = userID
 
-	// Parse JSON request body into Channel struct
-	var thread Thread
-	if err := c.ShouldBindJSON(&thread); err != nil {
+	// Validate the tags against the tags table
+	tags, err := resolveTags(db, thread.Tags)
+	if _, ok := err.(inputError); ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+
+	// Ensure the user may post in the category, defaulting to the first category
+	category, allowed, err := checkCategoryAccess(c, db, thread.CategoryID, true)
+	if err != nil {
+		respondWithError(c, err, "Failed to look up category")
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot post in this category"})
+		return
+	}
+
+	// If the duplicate check is enabled, refuse to create a thread similar to
+	// existing ones until the user confirms it is not a duplicate
+	if duplicateCheckEnabled() && !input.ConfirmDuplicateCheck {
+		similar, err := findSimilarThreads(c, db, thread.Name, defaultSimilarLimit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar threads"})
+			return
+		}
+		if len(similar) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":           "Similar threads already exist. Set confirm_duplicate_check to create the thread anyway.",
+				"similar_threads": similar,
+			})
+			return
+		}
+	}
+
+	// Start a transaction so the thread, its mentions, tags and watch are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
 
 	// Insert thread into database with RETURNING id
 	var threadID int
-	err := db.QueryRow("INSERT INTO threads (name, user_id) VALUES ($1, $2) RETURNING id", thread.Name, thread.UserID).Scan(&threadID)
+	err = tx.QueryRow("INSERT INTO threads (name, user_id, category_id) VALUES ($1, $2, $3) RETURNING id", thread.Name, thread.UserID, category.ID).Scan(&threadID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// If there are tags, associate them with the thread
-	var savedTags []string
-	if len(thread.Tags) > 0 {
-		for _, tag := range thread.Tags {
-			// Validate the tag
-			if !predefinedTags[tag] {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag: " + tag})
-				return
-			}
+	// Save the users mentioned in the thread name and notify them
+	mentioned, err := saveMentions(tx, threadID, 0, thread.UserID, thread.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mentions"})
+		return
+	}
 
-			// Get the tag ID from the database
-			var tagID int
-			err := db.QueryRow("SELECT id FROM tags WHERE name = $1", tag).Scan(&tagID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Tag not found: " + tag})
-				return
-			}
+	// Associate the tags with the thread in the thread_tags table
+	if err := saveThreadTags(tx, threadID, tags); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-			// Associate the tag with the thread in the thread_tags table
-			log.Printf("Associating thread ID %d with tag ID %d", threadID, tagID)
-			_, err = db.Exec("INSERT INTO thread_tags (thread_id, tag_id) VALUES ($1, $2)", threadID, tagID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+	// Watch the thread on behalf of its author
+	if err := autoWatchThread(tx, thread.UserID, threadID, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to watch thread"})
+		return
+	}
 
-			// Add the tag to the savedTags slice
-			savedTags = append(savedTags, tag)
-		}
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.ThreadCreated, ThreadID: threadID, UserID: thread.UserID}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	reindexThread(db, threadID)
+	publishEvent(event)
+
+	savedTags := []string{}
+	for _, tag := range tags {
+		savedTags = append(savedTags, tag.Name)
 	}
 
 	// Return the added thread
     c.JSON(http.StatusOK, gin.H{
         "id":         threadID,
         "name":       thread.Name,
+        "name_html":  render.HTML(thread.Name, mentioned),
         "user_id":    thread.UserID,
 		"tags":       savedTags,
+		"category_id": category.ID,
     })
 }
 
-// Thread listing endpoint
+// Ways of combining the tags in a thread filter
+const (
+	tagModeAll = "all"
+	tagModeAny = "any"
+)
+
+// Orders in which threads can be listed
+var threadSortOrders = map[string]string{
+	"newest":   "threads.id DESC",
+	"oldest":   "threads.id ASC",
+	"name":     "threads.name ASC, threads.id ASC",
+	"activity": "(SELECT MAX(created_at) FROM comments WHERE comments.thread_id = threads.id AND comments.deleted_at IS NULL) DESC NULLS LAST, threads.id DESC",
+}
+
+// Filter, order and page of threads to list, parsed from query parameters like
+// ?category=general&tags=Work,School&mode=any&exclude=Miscellaneous&watching=true&sort=newest&limit=20&offset=40.
+// Threads are limited to the categories the user can read, and each tag is
+// expanded to the IDs of the tag and its descendants.
+type threadFilter struct {
+	Categories []int
+	Tags       [][]int
+	Mode       string
+	Exclude    []int
+	WatchedBy  int // Only threads watched by this user if not 0
+	AuthorID   int // Only threads started by this user if not 0
+	Sort       string
+	Limit      int
+	Offset     int
+}
+
+// Split a comma-separated query parameter, ignoring empty items
+func splitList(param string) []string {
+	var items []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Parse a thread filter from the request's query parameters
+func parseThreadFilter(c *gin.Context, db *sql.DB) (threadFilter, error) {
+	filter := threadFilter{
+		Mode: c.DefaultQuery("mode", tagModeAll),
+		Sort: c.DefaultQuery("sort", "newest"),
+	}
+
+	if filter.Mode != tagModeAll && filter.Mode != tagModeAny {
+		return filter, inputError{"Invalid tag mode: " + filter.Mode}
+	}
+	if _, ok := threadSortOrders[filter.Sort]; !ok {
+		return filter, inputError{"Invalid sort order: " + filter.Sort}
+	}
+
+	// Limit the threads to the readable categories, or to the requested one by ID or slug
+	readable, err := readableCategoryIDs(c, db)
+	if err != nil {
+		return filter, err
+	}
+	filter.Categories = readable
+	if requested := c.Query("category"); requested != "" {
+		categories, err := getCategories(db)
+		if err != nil {
+			return filter, err
+		}
+		filter.Categories = []int{}
+		for _, category := range categories {
+			if requested == category.Slug || requested == strconv.Itoa(category.ID) {
+				for _, id := range readable {
+					if id == category.ID {
+						filter.Categories = []int{id}
+					}
+				}
+			}
+		}
+		if len(filter.Categories) == 0 {
+			return filter, inputError{"Category not found: " + requested}
+		}
+	}
+
+	// Resolve the tags and synonyms in the filter, expanding each to include its descendants
+	set, err := getTagSet(db)
+	if err != nil {
+		return filter, err
+	}
+	tags, err := resolveTags(db, splitList(c.Query("tags")))
+	if err != nil {
+		return filter, err
+	}
+	for _, tag := range tags {
+		filter.Tags = append(filter.Tags, set.descendants(tag.ID))
+	}
+	excluded, err := resolveTags(db, splitList(c.Query("exclude")))
+	if err != nil {
+		return filter, err
+	}
+	for _, tag := range excluded {
+		filter.Exclude = append(filter.Exclude, set.descendants(tag.ID)...)
+	}
+
+	// Limit the threads to the ones the logged-in user watches
+	if c.Query("watching") == "true" {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return filter, inputError{"Log in to list watched threads"}
+		}
+		filter.WatchedBy = userID
+	}
+
+	// Parse optional limit and offset, defaulting to the first 100 threads
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	filter.Limit = limit
+	filter.Offset = offset
+
+	return filter, nil
+}
+
+// Build the SQL conditions and arguments that select the threads matching a filter
+func (filter threadFilter) where() (string, []interface{}) {
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	conditions := []string{
+		"threads.deleted_at IS NULL",
+		"threads.hidden_at IS NULL",
+		"threads.category_id = ANY(" + arg(pq.Array(filter.Categories)) + ")",
+	}
+
+	// Threads having a tag, or one of its descendants, from a set of tag IDs
+	hasTag := func(tagIDs []int) string {
+		return `EXISTS (
+		SELECT 1 FROM thread_tags
+		WHERE thread_tags.thread_id = threads.id AND thread_tags.tag_id = ANY(` + arg(pq.Array(tagIDs)) + `)
+		)`
+	}
+
+	// Threads having all, or any, of the given tags
+	if len(filter.Tags) > 0 {
+		if filter.Mode == tagModeAny {
+			var tagIDs []int
+			for _, ids := range filter.Tags {
+				tagIDs = append(tagIDs, ids...)
+			}
+			conditions = append(conditions, hasTag(tagIDs))
+		} else {
+			for _, ids := range filter.Tags {
+				conditions = append(conditions, hasTag(ids))
+			}
+		}
+	}
+
+	// Threads having none of the excluded tags
+	if len(filter.Exclude) > 0 {
+		conditions = append(conditions, "NOT "+hasTag(filter.Exclude))
+	}
+
+	// Threads started by a user
+	if filter.AuthorID != 0 {
+		conditions = append(conditions, "threads.user_id = "+arg(filter.AuthorID))
+	}
+
+	// Threads watched by a user
+	if filter.WatchedBy != 0 {
+		conditions = append(conditions, `EXISTS (
+		SELECT 1 FROM thread_subscriptions
+		WHERE thread_subscriptions.thread_id = threads.id AND thread_subscriptions.user_id = `+arg(filter.WatchedBy)+` AND thread_subscriptions.watching
+		)`)
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// Thread listing endpoint, optionally filtered by tags
 func ListThreads(c *gin.Context, db *sql.DB) {
-	// Query to get threads along with their associated tags
+	// Parse the filter from the query parameters
+	filter, err := parseThreadFilter(c, db)
+	if _, ok := err.(inputError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	threads, err := queryThreads(db, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Add the read state of each thread for the logged-in user
+	if userID, ok := currentUserID(c); ok {
+		ids := make([]int, len(threads))
+		for i, thread := range threads {
+			ids[i] = thread.ID
+		}
+		states, err := getReadStates(db, userID, ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for i := range threads {
+			state := states[threads[i].ID]
+			threads[i].Watching = &state.Watching
+			threads[i].UnreadCount = &state.UnreadCount
+			threads[i].FirstUnreadCommentID = state.FirstUnreadCommentID
+		}
+	}
+
+	// Return slice of threads
+	c.JSON(http.StatusOK, threads)
+}
+
+// Query the threads matching a filter along with their tags and rendered names
+func queryThreads(db *sql.DB, filter threadFilter) ([]Thread, error) {
+	where, args := filter.where()
+	args = append(args, filter.Limit, filter.Offset)
+
+	// Query to get the matching threads along with their associated tags
 	query := `
-	SELECT threads.id, threads.name, threads.user_id, string_agg(tags.name, ', ') AS tags
+	SELECT threads.id, threads.name, threads.user_id, COALESCE(users.username, ''), threads.category_id, threads.created_at, threads.edited_at,
+		array_remove(array_agg(tags.name ORDER BY tags.name), NULL) AS tags
 	FROM threads
+	LEFT JOIN users ON users.id = threads.user_id
 	LEFT JOIN thread_tags ON threads.id = thread_tags.thread_id
 	LEFT JOIN tags ON thread_tags.tag_id = tags.id
-	GROUP BY threads.id
-	`
+	WHERE ` + where + `
+	GROUP BY threads.id, users.username
+	ORDER BY ` + threadSortOrders[filter.Sort] + `
+	LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
 
 	// Query database for threads
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
 	// Create slice of threads
-	var threads []Thread
+	threads := []Thread{}
 
 	// Iterate over rows
 	for rows.Next() {
 		// Create new thread
 		var thread Thread
-		var tags sql.NullString // Use sql.NullString to handle NULL values
+		var tags pq.StringArray
 
 		// Scan row into thread
-		err := rows.Scan(&thread.ID, &thread.Name, &thread.UserID, &tags)
+		err := rows.Scan(&thread.ID, &thread.Name, &thread.UserID, &thread.UserName, &thread.CategoryID, &thread.CreatedAt, &thread.EditedAt, &tags)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return nil, err
+		}
+		thread.Tags = []string(tags)
+		if thread.Tags == nil {
+			thread.Tags = []string{}
 		}
-
-		// Check if tags is null, and if not, split the concatenated tags
-        if tags.Valid && tags.String != "" {
-            thread.Tags = strings.Split(tags.String, ",")
-        } else {
-            // If tags are null or empty, return an empty array
-            thread.Tags = []string{}
-        }
 
 		// Append thread to slice
 		threads = append(threads, thread)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	// Return slice of threads
-	c.JSON(http.StatusOK, threads)
+	// Render the thread names with their mentions linked
+	if err := renderThreadNames(db, threads); err != nil {
+		return nil, err
+	}
+	return threads, nil
 }
 
-// Delete a thread by ID
+// Soft delete a thread and its comments, returning sql.ErrNoRows if the thread
+// does not exist or is already deleted. The comments share the thread's
+// deleted_at, which is how restoring the thread finds them again.
+func softDeleteThread(q queryer, threadID int, deletedBy int) error {
+	result, err := q.Exec("UPDATE threads SET deleted_at = CURRENT_TIMESTAMP, deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL", threadID, nullableID(deletedBy))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = q.Exec("UPDATE comments SET deleted_at = CURRENT_TIMESTAMP, deleted_by = $2 WHERE thread_id = $1 AND deleted_at IS NULL", threadID, nullableID(deletedBy))
+	return err
+}
+
+// Soft delete a thread and its comments by ID, as its author or a moderator
 func DeleteThread(c *gin.Context, db *sql.DB) {
 	// Parse the thread ID from the URL parameter
 	threadID, err := strconv.Atoi(c.Param("id"))
@@ -143,47 +465,151 @@ func DeleteThread(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	// Execute SQL to delete comments associated with the thread
-	_, err = db.Exec("DELETE FROM comments WHERE thread_id = $1", threadID)
+	// Start a transaction so the thread and its comments are deleted together
+	tx, err := db.Begin()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete associated comments"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+	if !authorizeChange(c, db, tx, "threads", threadID) {
 		return
 	}
 
-	// Execute SQL to delete the thread
-	result, err := db.Exec("DELETE FROM threads WHERE id = $1", threadID)
+	// Mark the thread and its comments as deleted
+	deletedBy, _ := currentUserID(c)
+	before, err := snapshotTarget(tx, "thread", threadID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete thread"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
 		return
 	}
+	err = softDeleteThread(tx, threadID, deletedBy)
 
-	// Check if any rows were affected
-	rowsAffected, err := result.RowsAffected()
+	// If no rows were affected, the thread does not exist or is already deleted
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify deletion"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete thread"})
 		return
 	}
 
-	// If no rows were affected, the thread does not exist
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+	// Log who deleted the thread
+	if err := logChange(c, tx, moderationLogEntry{Action: LogThreadDeleted, TargetType: "thread", TargetID: threadID}, before); err != nil {
+		log.Printf("Error logging thread deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.ThreadDeleted, ThreadID: threadID, UserID: deletedBy}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
 		return
 	}
 
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	reindexThread(db, threadID)
+	publishEvent(event)
+
+	// Notify the author if someone else did this
+	if err := notifyModeration(c, db, ModerationThreadDeleted, threadID, 0); err != nil {
+		log.Printf("Error notifying thread author: %v", err)
+	}
+
 	// Return success message
 	c.JSON(http.StatusOK, gin.H{"message": "Thread deleted successfully"})
 }
 
-// Update a thread name and/or tags by ID
-func UpdateThread(c *gin.Context, db *sql.DB) {
-	// Predefined list of allowed tags
-	predefinedTags := map[string]bool{
-		"School":             true,
-		"Work":               true,
-		"Interests and Hobbies": true,
-		"Miscellaneous":      true,
+// Restore a soft deleted thread along with the comments deleted with it
+func RestoreThread(c *gin.Context, db *sql.DB) {
+	// Parse the thread ID from the URL parameter
+	threadID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid thread ID"})
+		return
 	}
 
+	// Start a transaction so the thread and its comments are restored together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Ensure the thread exists and is deleted
+	err = tx.QueryRow("SELECT id FROM threads WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE", threadID).Scan(&threadID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted thread not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	before, err := snapshotTarget(tx, "thread", threadID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+
+	// Restore the comments that were deleted along with the thread, leaving
+	// comments that had been deleted individually before it
+	_, err = tx.Exec("UPDATE comments SET deleted_at = NULL, deleted_by = NULL WHERE thread_id = $1 AND deleted_at = (SELECT deleted_at FROM threads WHERE id = $1)", threadID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore associated comments"})
+		return
+	}
+
+	// Restore the thread
+	_, err = tx.Exec("UPDATE threads SET deleted_at = NULL, deleted_by = NULL WHERE id = $1", threadID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore thread"})
+		return
+	}
+
+	// Log who restored the thread
+	if err := logChange(c, tx, moderationLogEntry{Action: LogThreadRestored, TargetType: "thread", TargetID: threadID}, before); err != nil {
+		log.Printf("Error logging thread restoration: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Queue the event's webhooks with the change
+	restoredBy, _ := currentUserID(c)
+	event := pubsub.Event{Type: pubsub.ThreadRestored, ThreadID: threadID, UserID: restoredBy}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	reindexThread(db, threadID)
+	publishEvent(event)
+
+	// Notify the author if someone else did this
+	if err := notifyModeration(c, db, ModerationThreadRestored, threadID, 0); err != nil {
+		log.Printf("Error notifying thread author: %v", err)
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Thread restored successfully"})
+}
+
+// Update a thread name and/or tags by ID, as its author or a moderator
+func UpdateThread(c *gin.Context, db *sql.DB) {
     // Parse the thread ID from the URL parameter
     threadID, err := strconv.Atoi(c.Param("id"))
     if err != nil {
@@ -195,6 +621,7 @@ func UpdateThread(c *gin.Context, db *sql.DB) {
     var input struct {
         Name string `json:"name"`
 		Tags []string `json:"tags"`
+		CategoryID int `json:"category_id"`
     }
 
     if err := c.ShouldBindJSON(&input); err != nil {
@@ -202,6 +629,34 @@ func UpdateThread(c *gin.Context, db *sql.DB) {
         return
     }
 
+	// Ensure the user may post in the thread's category
+	allowed, err := checkThreadAccess(c, db, threadID, true)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thread"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot post in this category"})
+		return
+	}
+
+	// If the thread is being moved, ensure the user may also post in the new category
+	if input.CategoryID != 0 {
+		_, allowed, err := checkCategoryAccess(c, db, input.CategoryID, true)
+		if err != nil {
+			respondWithError(c, err, "Failed to look up category")
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot post in this category"})
+			return
+		}
+	}
+
 	// Start a transaction
     tx, err := db.Begin()
     if err != nil {
@@ -215,25 +670,45 @@ func UpdateThread(c *gin.Context, db *sql.DB) {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Thread name cannot be empty"})
         return
     }
-
-    // Execute SQL to update the thread name
-    result, err := db.Exec("UPDATE threads SET name = $1 WHERE id = $2", input.Name, threadID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update thread name"})
+    if !authorizeChange(c, db, tx, "threads", threadID) {
         return
     }
 
-    // Check if any rows were affected
-    rowsAffected, err := result.RowsAffected()
+    // Record the new name as a revision of the thread
+    editorID, _ := currentUserID(c)
+    changed, err := recordThreadRevision(tx, threadID, input.Name, editorID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
+        return
+    }
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record revision"})
         return
     }
 
-    // If no rows were affected, the thread does not exist
-    if rowsAffected == 0 {
-        c.JSON(http.StatusNotFound, gin.H{"error": "Thread not found"})
-        return
+    // Execute SQL to update the thread name if it changed
+    if changed {
+        var authorID int
+        err = tx.QueryRow("UPDATE threads SET name = $1, edited_at = CURRENT_TIMESTAMP WHERE id = $2 RETURNING user_id", input.Name, threadID).Scan(&authorID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update thread name"})
+            return
+        }
+
+        // Update the users mentioned in the thread name, notifying newly mentioned users
+        if _, err := saveMentions(tx, threadID, 0, authorID, input.Name); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mentions"})
+            return
+        }
+    }
+
+	// Move the thread to the new category if one was given
+    if input.CategoryID != 0 {
+        _, err = tx.Exec("UPDATE threads SET category_id = $1 WHERE id = $2", input.CategoryID, threadID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move thread"})
+            return
+        }
     }
 
 	// Delete existing tags for the thread
@@ -243,144 +718,55 @@ func UpdateThread(c *gin.Context, db *sql.DB) {
         return
     }
 
-	// Update the thread tags if provided
-    if len(input.Tags) > 0 {
-        // Validate tags
-        for _, tag := range input.Tags {
-            if !predefinedTags[tag] {
-                c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tag: " + tag})
-                return
-            }
-        }
-
-		// Insert new tags
-        for _, tag := range input.Tags {
-            var tagID int
-            err := tx.QueryRow("SELECT id FROM tags WHERE name = $1", tag).Scan(&tagID)
-            if err != nil {
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Tag not found in database: " + tag})
-                return
-            }
-
-            _, err = tx.Exec("INSERT INTO thread_tags (thread_id, tag_id) VALUES ($1, $2)", threadID, tagID)
-            if err != nil {
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
-                return
-            }
-        }
+	// Validate the new tags against the tags table and associate them with the thread
+    tags, err := resolveTags(db, input.Tags)
+    if _, ok := err.(inputError); ok {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+        return
+    }
+    if err := saveThreadTags(tx, threadID, tags); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+        return
     }
 
+	// Queue the event's webhooks with the change
+	event := pubsub.Event{Type: pubsub.ThreadUpdated, ThreadID: threadID, UserID: editorID}
+	if err := queueWebhooks(db, tx, event); err != nil {
+		log.Printf("Error queueing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue webhooks"})
+		return
+	}
+
 	// Commit the transaction
     if err := tx.Commit(); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
         return
     }
+    reindexThread(db, threadID)
+    publishEvent(event)
 
     // Return success message
     c.JSON(http.StatusOK, gin.H{"message": "Thread updated successfully"})
 }
 
-// Tags listing endpoint
-func ListTags(c *gin.Context, db *sql.DB) {
-	// Query the database to get all tags
-	rows, err := db.Query("SELECT name FROM tags")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
-		return
+// Render the names of the given threads, linking the users mentioned in them
+func renderThreadNames(db *sql.DB, threads []Thread) error {
+	threadIDs := make([]int, len(threads))
+	for i, thread := range threads {
+		threadIDs[i] = thread.ID
 	}
-	defer rows.Close()
 
-	// Create a slice to hold the tags
-	var tags []string
-
-	// Iterate over the rows to extract tag names
-	for rows.Next() {
-		var tagName string
-		if err := rows.Scan(&tagName); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan tags"})
-			return
-		}
-		tags = append(tags, tagName)
+	// Fetch the mentions for all threads in one query
+	mentions, err := getThreadMentions(db, threadIDs)
+	if err != nil {
+		return err
 	}
-
-	// Return the list of tags
-	c.JSON(http.StatusOK, tags)
+	for i := range threads {
+		threads[i].NameHTML = render.HTML(threads[i].Name, mentions[threads[i].ID])
+	}
+	return nil
 }
-
-// Threads listing by tags endpoint
-func GetThreadsByTags(c *gin.Context, db *sql.DB) {
-    // Get tags from query parameters
-    tagsParam := c.Query("tags")
-    if tagsParam == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Tags parameter is required"})
-        return
-    }
-
-    // Split the tags into a slice
-    tags := strings.Split(tagsParam, ",")
-    placeholders := make([]string, len(tags))
-    for i := range tags {
-        placeholders[i] = "$" + strconv.Itoa(i+1)
-    }
-
-    // Create a query to get threads filtered by tags
-    query := `
-    SELECT threads.id, threads.name, threads.user_id, string_agg(tags.name, ', ') AS tags
-    FROM threads
-    LEFT JOIN thread_tags ON threads.id = thread_tags.thread_id
-    LEFT JOIN tags ON thread_tags.tag_id = tags.id
-    WHERE threads.id IN (
-        SELECT thread_tags.thread_id
-        FROM thread_tags
-        LEFT JOIN tags ON thread_tags.tag_id = tags.id
-        WHERE tags.name IN (` + strings.Join(placeholders, ", ") + `)
-        GROUP BY thread_tags.thread_id
-        HAVING COUNT(DISTINCT tags.name) = $` + strconv.Itoa(len(tags)+1) + `
-    )
-    GROUP BY threads.id
-    `
-
-    // Convert tags to []interface{} for use with Query
-    queryArgs := make([]interface{}, len(tags) + 1)
-    for i, tag := range tags {
-        queryArgs[i] = tag
-    }
-	queryArgs[len(tags)] = len(tags)
-
-    // Execute the query
-    //args := append(tags, strconv.Itoa(len(tags)))
-    rows, err := db.Query(query, queryArgs...)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-	defer rows.Close()
-
-    // Create a slice to store the threads
-    var threads []Thread
-
-    // Iterate over rows
-    for rows.Next() {
-        var thread Thread
-        var tags sql.NullString
-
-        // Scan the row into thread and tags
-        if err := rows.Scan(&thread.ID, &thread.Name, &thread.UserID, &tags); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return
-        }
-
-        // If tags are valid, split them into a slice
-        if tags.Valid && tags.String != "" {
-            thread.Tags = strings.Split(tags.String, ",")
-        } else {
-            thread.Tags = []string{}
-        }
-
-        // Append the thread to the slice
-        threads = append(threads, thread)
-    }
-
-    // Return the filtered threads
-    c.JSON(http.StatusOK, threads)
-}
\ No newline at end of file
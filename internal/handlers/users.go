@@ -2,11 +2,15 @@ package handlers
 
 import (
     "database/sql"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/glebarez/go-sqlite"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
@@ -14,65 +18,307 @@ type User struct {
 	Username string `json:"username"`
 }
 
+// Length limits of passwords. bcrypt ignores anything past 72 bytes.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// Credentials given to sign up or log in
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Respond with a new session token for a user, and whether they have a
+// password yet
+func respondWithSession(c *gin.Context, userID int, passwordSet bool) {
+	token, expiresAt := issueToken(userID)
+	c.JSON(http.StatusOK, gin.H{"id": userID, "token": token, "expires_at": expiresAt, "password_set": passwordSet})
+}
+
+// Check that a password is within the length limits
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return inputError{"Password must be between " + strconv.Itoa(minPasswordLength) + " and " + strconv.Itoa(maxPasswordLength) + " bytes"}
+	}
+	return nil
+}
+
 // User creation endpoint
 func CreateUser(c *gin.Context, db *sql.DB) {
-	// Parse JSON request body into User struct
-	var user User
-	if err := c.ShouldBindJSON(&user); err != nil {
+	// Parse JSON request body into credentials
+	var input credentials
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Username = strings.TrimSpace(input.Username)
+	if input.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+		return
+	}
+	if err := validatePassword(input.Password); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Check if the username already exists
-    var count int
-    err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = $1", user.Username).Scan(&count)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check username availability"})
-        return
-    }
-
-    if count > 0 {
-        c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
-        return
-    }
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = $1", input.Username).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check username availability"})
+		return
+	}
+
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+		return
+	}
+
+	// Hash the password
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
 
 	// Insert user into database and return the inserted ID
-    var id int
-    err = db.QueryRow("INSERT INTO users (username) VALUES ($1) RETURNING id", user.Username).Scan(&id)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-
-	// Return ID of newly inserted user
-	c.JSON(http.StatusOK, gin.H{"id": id})
+	var id int
+	err = db.QueryRow("INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id", input.Username, string(hash)).Scan(&id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return ID of newly inserted user along with a session token
+	respondWithSession(c, id, true)
 }
 
 // Login endpoint
 func Login(c *gin.Context, db *sql.DB) {
-	// Parse JSON request body into User struct
-	var user User
-	if err := c.ShouldBindJSON(&user); err != nil {
+	// Parse JSON request body into credentials
+	var input credentials
+	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Query database for user
-	row := db.QueryRow("SELECT id FROM users WHERE username = $1", user.Username)
-
-	// Get ID of user
 	var id int
-	err := row.Scan(&id)
-	if err != nil {
-		// Check if user was not found
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username"})
-			return
-		}
-		// Return error if other error occurred
+	var hash sql.NullString
+	err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = $1", strings.TrimSpace(input.Username)).Scan(&id, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check the password, giving the same error for unknown users, so the
+	// response does not reveal which usernames exist. Accounts created before
+	// passwords were required log in with their username alone until they set
+	// a password with SetPassword.
+	if err == sql.ErrNoRows || (hash.Valid && bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(input.Password)) != nil) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	// Return ID of user along with a session token
+	respondWithSession(c, id, hash.Valid)
+}
+
+// Set the password of the logged-in user's account, for accounts created
+// before passwords were required. Once set, it is needed to log in.
+func SetPassword(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the user ID from the URL parameter
+	targetID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if targetID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only set your own password"})
+		return
+	}
+
+	// Parse and check the new password
+	var input struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := validatePassword(input.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Hash the password
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	// Store the hash unless the account already has a password
+	result, err := db.Exec("UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash IS NULL", string(hash), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set password"})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify update"})
+		return
+	}
+	if rowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Password is already set"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Password set successfully"})
+}
+
+// User profile endpoint
+func GetUser(c *gin.Context, db *sql.DB) {
+	// Parse the user ID from the URL parameter
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Query database for user
+	var user User
+	err = db.QueryRow("SELECT id, username FROM users WHERE id = $1", userID).Scan(&user.ID, &user.Username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return the user
+	c.JSON(http.StatusOK, user)
+}
+
+// Block a user, so their mentions of the logged-in user are ignored
+func BlockUser(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the ID of the user to block from the URL parameter
+	blockedUserID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if blockedUserID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot block yourself"})
+		return
+	}
+
+	// Insert the block, ignoring duplicates so the request is idempotent
+	_, err = db.Exec("INSERT INTO user_blocks (user_id, blocked_user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, blockedUserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "User blocked successfully"})
+}
+
+// Unblock a user
+func UnblockUser(c *gin.Context, db *sql.DB) {
+	userID, _ := currentUserID(c)
+
+	// Parse the ID of the user to unblock from the URL parameter
+	blockedUserID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Execute SQL to delete the block
+	_, err = db.Exec("DELETE FROM user_blocks WHERE user_id = $1 AND blocked_user_id = $2", userID, blockedUserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked successfully"})
+}
+
+// Change the role of a user. Admins cannot change their own role, so the last
+// admin cannot lock everyone out by demoting themselves.
+func UpdateUserRole(c *gin.Context, db *sql.DB) {
+	// Parse the user ID from the URL parameter
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if actorID, _ := currentUserID(c); userID == actorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
 	}
 
-	// Return ID of user
-	c.JSON(http.StatusOK, gin.H{"id": id})
-}
\ No newline at end of file
+	// Parse and validate the request body
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if _, ok := roleRanks[input.Role]; !ok || input.Role == RoleGuest {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be user, moderator or admin"})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Ensure the user exists
+	before, err := snapshotTarget(tx, "user", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+	if before == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Execute SQL to update the role and log the change
+	_, err = tx.Exec("UPDATE users SET role = $1 WHERE id = $2", input.Role, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogRoleChanged, TargetType: "user", TargetID: userID}, before); err != nil {
+		log.Printf("Error logging role change: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the user's new role
+	c.JSON(http.StatusOK, gin.H{"id": userID, "role": input.Role})
+}
@@ -0,0 +1,771 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/CVWO/sample-go-app/internal/pubsub"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Event types that webhooks can subscribe to
+var webhookEventTypes = map[string]bool{
+	pubsub.ThreadCreated:    true,
+	pubsub.ThreadUpdated:    true,
+	pubsub.ThreadDeleted:    true,
+	pubsub.ThreadRestored:   true,
+	pubsub.CommentCreated:   true,
+	pubsub.CommentUpdated:   true,
+	pubsub.CommentDeleted:   true,
+	pubsub.CommentRestored:  true,
+	pubsub.ReactionsChanged: true,
+}
+
+// Statuses of webhook deliveries
+const (
+	webhookPending   = "pending"
+	webhookSucceeded = "succeeded"
+	webhookFailed    = "failed"
+)
+
+// Retry policy and limits of webhook deliveries. A failed delivery is retried
+// after webhookBackoff, doubling with each attempt up to webhookMaxBackoff, and
+// given up after webhookMaxAttempts.
+const (
+	webhookMaxAttempts       = 8
+	webhookBackoff           = 30 * time.Second
+	webhookMaxBackoff        = 6 * time.Hour
+	webhookTimeout           = 10 * time.Second
+	webhookLease             = 5 * time.Minute
+	webhookBatchSize         = 20
+	defaultWebhookDeliveries = 20
+	maxWebhookDeliveries     = 100
+)
+
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Tags       []string  `json:"tags"` // Only threads with one of these tags, or a tag nested under them, are sent. Empty for all threads.
+	Active     bool      `json:"active"`
+	Secret     string    `json:"secret,omitempty"` // Only returned when the webhook is created
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+// Body of a webhook request
+type webhookPayload struct {
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	ActorID   int             `json:"actor_id,omitempty"`
+	Thread    webhookThread   `json:"thread"`
+	Comment   *webhookComment `json:"comment,omitempty"`
+}
+
+type webhookThread struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	CategoryID int       `json:"category_id"`
+	UserID     int       `json:"user_id"`
+	UserName   string    `json:"user_name"`
+	Tags       []string  `json:"tags"`
+	CreatedAt  time.Time `json:"created_at"`
+	Deleted    bool      `json:"deleted"`
+}
+
+type webhookComment struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	Deleted   bool      `json:"deleted"`
+}
+
+// Columns selected to scan a webhook
+const webhookColumns = "id, url, event_types, tag_ids, active, created_at"
+
+// Scan a webhook, naming its tags
+func scanWebhook(row interface{ Scan(...interface{}) error }, set *tagSet, webhook *Webhook) error {
+	var tagIDs pq.Int64Array
+	if err := row.Scan(&webhook.ID, &webhook.URL, (*pq.StringArray)(&webhook.EventTypes), &tagIDs, &webhook.Active, &webhook.CreatedAt); err != nil {
+		return err
+	}
+	webhook.Tags = []string{}
+	for _, id := range tagIDs {
+		if tag, ok := set.byID[int(id)]; ok {
+			webhook.Tags = append(webhook.Tags, tag.Name)
+		}
+	}
+	return nil
+}
+
+// Validate a webhook's fields, returning the IDs of its tags
+func validateWebhook(db *sql.DB, webhook *Webhook) ([]int, error) {
+	parsed, err := url.Parse(webhook.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, inputError{"Webhook URL must be an http or https URL"}
+	}
+	if !isPublicHost(parsed.Hostname()) {
+		return nil, inputError{"Webhook URL must not point to a local or private address"}
+	}
+	if len(webhook.EventTypes) == 0 {
+		return nil, inputError{"Webhook must subscribe to at least one event type"}
+	}
+	for _, eventType := range webhook.EventTypes {
+		if !webhookEventTypes[eventType] {
+			return nil, inputError{"Invalid event type: " + eventType}
+		}
+	}
+	tags, err := resolveTags(db, webhook.Tags)
+	if err != nil {
+		return nil, err
+	}
+	tagIDs := []int{}
+	webhook.Tags = []string{}
+	for _, tag := range tags {
+		tagIDs = append(tagIDs, tag.ID)
+		webhook.Tags = append(webhook.Tags, tag.Name)
+	}
+	return tagIDs, nil
+}
+
+// Webhook listing endpoint
+func ListWebhooks(c *gin.Context, db *sql.DB) {
+	set, err := getTagSet(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+	rows, err := db.Query("SELECT " + webhookColumns + " FROM webhooks ORDER BY id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		if err := scanWebhook(rows, set, &webhook); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	// Return the list of webhooks
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// Webhook creation endpoint. The response includes the secret used to sign
+// deliveries, which is generated if none is given and not shown again.
+func CreateWebhook(c *gin.Context, db *sql.DB) {
+	// Parse JSON request body into Webhook struct
+	var webhook Webhook
+	if err := c.ShouldBindJSON(&webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tagIDs, err := validateWebhook(db, &webhook)
+	if err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+
+	// Generate a secret if none was given
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Insert webhook into database with RETURNING id and created_at
+	createdBy, _ := currentUserID(c)
+	webhook.Active = true
+	err = tx.QueryRow("INSERT INTO webhooks (url, secret, event_types, tag_ids, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at", webhook.URL, webhook.Secret, pq.Array(webhook.EventTypes), pq.Array(tagIDs), nullableID(createdBy)).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save webhook"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogWebhookCreated, TargetType: "webhook", TargetID: webhook.ID}, nil); err != nil {
+		log.Printf("Error logging webhook creation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the added webhook
+	c.JSON(http.StatusOK, webhook)
+}
+
+// Update a webhook by ID. The secret is only changed if a new one is given.
+func UpdateWebhook(c *gin.Context, db *sql.DB) {
+	// Parse the webhook ID from the URL parameter
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	// Parse the request body, keeping the webhook active unless told otherwise
+	var input struct {
+		Webhook
+		Active *bool `json:"active"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	webhook := input.Webhook
+	webhook.Active = input.Active == nil || *input.Active
+	tagIDs, err := validateWebhook(db, &webhook)
+	if err != nil {
+		respondWithError(c, err, "Failed to retrieve tags")
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Execute SQL to update the webhook
+	before, err := snapshotTarget(tx, "webhook", webhookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up webhook"})
+		return
+	}
+	err = tx.QueryRow("UPDATE webhooks SET url = $1, event_types = $2, tag_ids = $3, active = $4, secret = COALESCE(NULLIF($5, ''), secret) WHERE id = $6 RETURNING id, created_at", webhook.URL, pq.Array(webhook.EventTypes), pq.Array(tagIDs), webhook.Active, webhook.Secret, webhookID).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogWebhookUpdated, TargetType: "webhook", TargetID: webhookID}, before); err != nil {
+		log.Printf("Error logging webhook update: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return the updated webhook without its secret
+	webhook.Secret = ""
+	c.JSON(http.StatusOK, webhook)
+}
+
+// Delete a webhook by ID along with its deliveries
+func DeleteWebhook(c *gin.Context, db *sql.DB) {
+	// Parse the webhook ID from the URL parameter
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	// Start a transaction so the change and its log entry are saved together
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Execute SQL to delete the webhook
+	before, err := snapshotTarget(tx, "webhook", webhookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up webhook"})
+		return
+	}
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = $1", webhookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify deletion"})
+		return
+	}
+
+	// If no rows were affected, the webhook does not exist
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err := logChange(c, tx, moderationLogEntry{Action: LogWebhookDeleted, TargetType: "webhook", TargetID: webhookID}, before); err != nil {
+		log.Printf("Error logging webhook deletion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log change"})
+		return
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	// Return success message
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// Columns selected to scan a webhook delivery
+const webhookDeliveryColumns = "id, webhook_id, event_type, payload, status, attempts, last_status_code, last_error, next_attempt_at, created_at, delivered_at"
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }, delivery *WebhookDelivery) error {
+	var payload []byte
+	if err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventType, &payload, &delivery.Status, &delivery.Attempts, &delivery.LastStatusCode, &delivery.LastError, &delivery.NextAttemptAt, &delivery.CreatedAt, &delivery.DeliveredAt); err != nil {
+		return err
+	}
+	delivery.Payload = payload
+	return nil
+}
+
+// Delivery log endpoint of a webhook, newest first, optionally filtered by status
+func ListWebhookDeliveries(c *gin.Context, db *sql.DB) {
+	// Parse the webhook ID from the URL parameter
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	// Parse the status filter, cursor and page size
+	status := c.Query("status")
+	if status != "" && status != webhookPending && status != webhookSucceeded && status != webhookFailed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status: " + status})
+		return
+	}
+	limit := defaultWebhookDeliveries
+	if param := c.Query("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxWebhookDeliveries {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and " + strconv.Itoa(maxWebhookDeliveries)})
+			return
+		}
+	}
+	cursor := 0
+	if param := c.Query("cursor"); param != "" {
+		cursor, err = strconv.Atoi(param)
+		if err != nil || cursor <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+	}
+
+	// Ensure the webhook exists
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1)", webhookID).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up webhook"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	// Query database for the page of deliveries, fetching one extra to know whether another page follows
+	rows, err := db.Query(`
+	SELECT `+webhookDeliveryColumns+`
+	FROM webhook_deliveries
+	WHERE webhook_id = $1 AND ($2 = '' OR status = $2) AND ($3 = 0 OR id < $3)
+	ORDER BY id DESC
+	LIMIT $4
+	`, webhookID, status, cursor, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := scanWebhookDelivery(rows, &delivery); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return the page of deliveries with the cursor of the next page, if any
+	var nextCursor *int
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		nextCursor = &deliveries[limit-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "next_cursor": nextCursor})
+}
+
+// Send a delivery's payload again as a new delivery, keeping the original in the log
+func RedeliverWebhook(c *gin.Context, db *sql.DB) {
+	// Parse the webhook and delivery IDs from the URL parameters
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+	deliveryID, err := strconv.Atoi(c.Param("deliveryID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	// Queue a copy of the delivery to be sent right away
+	var delivery WebhookDelivery
+	err = scanWebhookDelivery(db.QueryRow(`
+	INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+	SELECT webhook_id, event_type, payload FROM webhook_deliveries WHERE id = $1 AND webhook_id = $2
+	RETURNING `+webhookDeliveryColumns, deliveryID, webhookID), &delivery)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+		return
+	}
+
+	// Return the new delivery
+	c.JSON(http.StatusOK, delivery)
+}
+
+// Queue deliveries of an event to the webhooks subscribed to it, in the
+// transaction that made the change so the deliveries are only saved with it.
+// The payload is a snapshot of the thread and comment when the event happened.
+// Webhooks are only sent content that guests can read, so events about hidden
+// content or categories restricted to members are not delivered.
+func queueWebhooks(db *sql.DB, q queryer, event pubsub.Event) error {
+	if !webhookEventTypes[event.Type] {
+		return nil
+	}
+
+	// Find the active webhooks subscribed to the event type
+	rows, err := q.Query("SELECT id, tag_ids FROM webhooks WHERE active AND $1 = ANY(event_types)", event.Type)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	filters := make(map[int][]int64)
+	for rows.Next() {
+		var id int
+		var tagIDs pq.Int64Array
+		if err := rows.Scan(&id, &tagIDs); err != nil {
+			return err
+		}
+		filters[id] = tagIDs
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+
+	// Build the payload from the thread and comment, unless they are not public
+	payload := webhookPayload{Event: event.Type, CreatedAt: time.Now(), ActorID: event.UserID}
+	thread := &payload.Thread
+	var hidden bool
+	var readRole string
+	err = q.QueryRow("SELECT t.id, t.name, t.category_id, t.user_id, COALESCE(u.username, ''), t.created_at, t.deleted_at IS NOT NULL, t.hidden_at IS NOT NULL, c.read_role FROM threads t JOIN categories c ON c.id = t.category_id LEFT JOIN users u ON u.id = t.user_id WHERE t.id = $1", event.ThreadID).Scan(&thread.ID, &thread.Name, &thread.CategoryID, &thread.UserID, &thread.UserName, &thread.CreatedAt, &thread.Deleted, &hidden, &readRole)
+	if err == sql.ErrNoRows {
+		// The thread was purged in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if hidden || readRole != RoleGuest {
+		return nil
+	}
+	if event.CommentID != 0 {
+		comment := &webhookComment{}
+		err = q.QueryRow("SELECT m.id, m.user_id, COALESCE(u.username, ''), m.text, m.created_at, m.deleted_at IS NOT NULL, m.hidden_at IS NOT NULL FROM comments m LEFT JOIN users u ON u.id = m.user_id WHERE m.id = $1", event.CommentID).Scan(&comment.ID, &comment.UserID, &comment.UserName, &comment.Text, &comment.CreatedAt, &comment.Deleted, &hidden)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hidden {
+			return nil
+		}
+		payload.Comment = comment
+	}
+
+	// Name the thread's tags
+	set, err := getTagSet(db)
+	if err != nil {
+		return err
+	}
+	var threadTagIDs pq.Int64Array
+	if err := q.QueryRow("SELECT COALESCE(array_agg(tag_id), '{}') FROM thread_tags WHERE thread_id = $1", event.ThreadID).Scan(&threadTagIDs); err != nil {
+		return err
+	}
+	hasTag := make(map[int]bool)
+	thread.Tags = []string{}
+	for _, id := range threadTagIDs {
+		hasTag[int(id)] = true
+		thread.Tags = append(thread.Tags, set.byID[int(id)].Name)
+	}
+
+	// Keep the webhooks whose tag filter matches the thread
+	var webhookIDs []int
+	for id, tagIDs := range filters {
+		matches := len(tagIDs) == 0
+		for _, tagID := range tagIDs {
+			for _, descendant := range set.descendants(int(tagID)) {
+				if hasTag[descendant] {
+					matches = true
+				}
+			}
+		}
+		if matches {
+			webhookIDs = append(webhookIDs, id)
+		}
+	}
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+
+	// Queue a delivery for each webhook
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT INTO webhook_deliveries (webhook_id, event_type, payload) SELECT unnest($1::int[]), $2, $3", pq.Array(webhookIDs), event.Type, string(body))
+	return err
+}
+
+// Sign a webhook body with the webhook's secret. Receivers verify a request by
+// computing the HMAC-SHA256 of the X-Webhook-Timestamp header, a period and
+// the body, and comparing its hex encoding to the X-Webhook-Signature header
+// after its sha256= prefix.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delay before retrying a delivery that has failed the given number of times
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxBackoff)
+}
+
+// Check whether an IP address is reachable from the public internet, so that
+// webhooks cannot be used to reach services on the server's own network
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+// Check that a webhook host is not a local or private address. Host names
+// that cannot be resolved are allowed here, as they are checked again when
+// the webhook is delivered.
+func isPublicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicIP(ip)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuse to connect to local or private addresses. This runs after the host
+// name is resolved, so a webhook's DNS record cannot later be pointed at them.
+func dialPublicOnly(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errors.New("webhook target " + host + " is a local or private address")
+	}
+	return nil
+}
+
+// Create the HTTP client that sends webhooks. It connects directly, without
+// any proxy from the environment, so every address it dials is checked.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: dialPublicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// Send the queued webhook deliveries that are due. Deliveries are leased while
+// they are sent, so several instances can run this at the same time.
+func DeliverWebhooks(ctx context.Context, db *sql.DB) error {
+	client := newWebhookClient()
+	for {
+		// Claim a batch of due deliveries
+		rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries d SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT pending.id FROM webhook_deliveries pending
+			JOIN webhooks active ON active.id = pending.webhook_id AND active.active
+			WHERE pending.status = 'pending' AND pending.next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY pending.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF pending SKIP LOCKED
+		)
+		RETURNING d.id, d.event_type, d.payload, d.attempts, w.url, w.secret
+		`, webhookBatchSize, webhookLease.Seconds())
+		if err != nil {
+			return err
+		}
+		type claimed struct {
+			id        int
+			eventType string
+			payload   []byte
+			attempts  int
+			url       string
+			secret    string
+		}
+		var batch []claimed
+		for rows.Next() {
+			var d claimed
+			if err := rows.Scan(&d.id, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Send each delivery and record the outcome
+		for _, d := range batch {
+			statusCode, sendErr := sendWebhook(ctx, client, d.id, d.eventType, d.url, d.secret, d.payload)
+			attempts := d.attempts + 1
+			if sendErr == nil {
+				_, err = db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4, last_error = NULL, next_attempt_at = NULL, delivered_at = CURRENT_TIMESTAMP WHERE id = $1", d.id, webhookSucceeded, attempts, statusCode)
+			} else {
+				status := webhookPending
+				if attempts >= webhookMaxAttempts {
+					status = webhookFailed
+				}
+				_, err = db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4, last_error = $5, next_attempt_at = CASE WHEN $2 = 'pending' THEN CURRENT_TIMESTAMP + make_interval(secs => $6) END WHERE id = $1", d.id, status, attempts, nullableID(statusCode), sendErr.Error(), webhookRetryDelay(attempts).Seconds())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(batch) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// Send a webhook request, returning the response status code, if any, and an
+// error unless the receiver responded with a 2xx status
+func sendWebhook(ctx context.Context, client *http.Client, deliveryID int, eventType string, target string, secret string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ForumFlow-Webhooks")
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,27 @@
+// Package jobs runs background maintenance tasks inside the server process.
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Run a job every interval until the context is cancelled, logging any errors.
+// The first run happens immediately.
+func Every(ctx context.Context, interval time.Duration, name string, job func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job(ctx); err != nil {
+			log.Printf("Job %s failed: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
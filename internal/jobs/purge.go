@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Hard delete threads and comments that were soft deleted before the retention period
+func PurgeDeleted(ctx context.Context, db *sql.DB, retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+
+	// Start a transaction so comments and their threads are purged together
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Purge expired comments, along with any comments left on expired threads
+	comments, err := tx.ExecContext(ctx, `
+	DELETE FROM comments
+	WHERE deleted_at < $1
+	OR thread_id IN (SELECT id FROM threads WHERE deleted_at < $1)
+	`, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to purge comments: %v", err)
+	}
+
+	// Purge expired threads
+	threads, err := tx.ExecContext(ctx, "DELETE FROM threads WHERE deleted_at < $1", cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to purge threads: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	// Log how much was purged
+	commentCount, _ := comments.RowsAffected()
+	threadCount, _ := threads.RowsAffected()
+	if commentCount > 0 || threadCount > 0 {
+		log.Printf("Purged %d deleted threads and %d deleted comments", threadCount, commentCount)
+	}
+	return nil
+}
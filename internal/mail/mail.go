@@ -0,0 +1,116 @@
+// Package mail sends emails through a pluggable backend.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// An email with plain text and HTML versions of its body
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string // Extra headers, such as List-Unsubscribe
+}
+
+// A Mailer delivers emails
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Format a message as a multipart/alternative MIME email
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(partWriter)
+		if _, err := encoder.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	// Write the headers in a stable order, followed by the body
+	headers := map[string]string{
+		"From":         from,
+		"To":           msg.To,
+		"Subject":      mime.QEncoding.Encode("utf-8", msg.Subject),
+		"Date":         now.Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+		"Content-Type": "multipart/alternative; boundary=" + writer.Boundary(),
+	}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var email bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&email, "%s: %s\r\n", name, headers[name])
+	}
+	email.WriteString("\r\n")
+	email.Write(body.Bytes())
+	return email.Bytes(), nil
+}
+
+// FileSink writes each email to a .eml file in a directory instead of sending
+// it, for local development and testing
+type FileSink struct {
+	dir  string
+	from string
+}
+
+func NewFileSink(dir string, from string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir, from: from}, nil
+}
+
+func (s *FileSink) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+	email, err := format(s.from, msg, now)
+	if err != nil {
+		return err
+	}
+
+	// Name files by time so they sort in the order they were sent
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := now.UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+	return os.WriteFile(filepath.Join(s.dir, name), email, 0o644)
+}
@@ -0,0 +1,207 @@
+package mail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// An email received by the server
+type Inbound struct {
+	From       string   // Address of the sender
+	Recipients []string // Addresses the email was sent to, including copies
+	Subject    string
+	Text       string // Plain text body, converted from HTML if there is no plain text part
+}
+
+// Headers listing the addresses an email was delivered to. Delivered-To and
+// X-Original-To are added by mail servers and include plus-addressed recipients
+// even when the email was sent as a blind copy.
+var recipientHeaders = []string{"To", "Cc", "Delivered-To", "X-Original-To", "Envelope-To"}
+
+// Maximum depth of nested multipart bodies
+const maxMultipartDepth = 5
+
+// Parse an RFC 5322 email
+func Parse(r io.Reader) (*Inbound, error) {
+	msg, err := netmail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the headers
+	decoder := new(mime.WordDecoder)
+	parser := netmail.AddressParser{WordDecoder: decoder}
+	from, err := parser.Parse(msg.Header.Get("From"))
+	if err != nil {
+		return nil, errors.New("invalid From header")
+	}
+	inbound := &Inbound{From: strings.ToLower(from.Address)}
+	if inbound.Subject, err = decoder.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		inbound.Subject = msg.Header.Get("Subject")
+	}
+	for _, name := range recipientHeaders {
+		for _, value := range msg.Header[name] {
+			addresses, err := parser.ParseList(value)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				inbound.Recipients = append(inbound.Recipients, strings.ToLower(address.Address))
+			}
+		}
+	}
+
+	// Find the plain text body, or failing that the HTML body
+	plain, htmlBody, err := readBody(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0)
+	if err != nil {
+		return nil, err
+	}
+	if plain != "" {
+		inbound.Text = plain
+	} else {
+		inbound.Text = htmlToText(htmlBody)
+	}
+	inbound.Text = strings.ReplaceAll(inbound.Text, "\r\n", "\n")
+	return inbound, nil
+}
+
+// Read the first plain text and HTML parts of a body, looking inside multipart
+// bodies. Attachments are skipped.
+func readBody(contentType string, encoding string, body io.Reader, depth int) (string, string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMultipartDepth {
+			return "", "", nil
+		}
+		var plain, htmlBody string
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", "", err
+			}
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			partPlain, partHTML, err := readBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			if err != nil {
+				return "", "", err
+			}
+			if plain == "" {
+				plain = partPlain
+			}
+			if htmlBody == "" {
+				htmlBody = partHTML
+			}
+		}
+		return plain, htmlBody, nil
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", "", nil
+	}
+
+	// Decode the text
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	text := decodeCharset(content, params["charset"])
+	if mediaType == "text/html" {
+		return "", text, nil
+	}
+	return text, "", nil
+}
+
+// Convert text to UTF-8. Latin-1 is converted and anything else is assumed to
+// be UTF-8, with invalid bytes replaced.
+func decodeCharset(content []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(content))
+		for i, b := range content {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	if utf8.Valid(content) {
+		return string(content)
+	}
+	return strings.ToValidUTF8(string(content), "�")
+}
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</blockquote>`)
+	htmlQuotes = regexp.MustCompile(`(?is)<blockquote.*?</blockquote>`)
+	htmlTags   = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// Roughly convert an HTML body to plain text, dropping quoted blocks
+func htmlToText(body string) string {
+	body = htmlQuotes.ReplaceAllString(body, "")
+	body = htmlBreaks.ReplaceAllString(body, "\n")
+	body = htmlTags.ReplaceAllString(body, "")
+	return html.UnescapeString(body)
+}
+
+var (
+	// The attribution line mail clients put above quoted text, such as
+	// "On Mon, 1 Jan 2024 at 10:00, Someone <someone@example.com> wrote:"
+	attributionLine = regexp.MustCompile(`^On .*wrote:$`)
+	// Separators Outlook and others put above the original message
+	originalMessageLine = regexp.MustCompile(`^(-{2,}\s*Original Message\s*-{2,}|_{10,}|From: .+)$`)
+)
+
+// Strip the quoted original message and signature from a reply, keeping only
+// what the sender wrote
+func StripReply(text string) string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "--" || originalMessageLine.MatchString(line) {
+			break
+		}
+
+		// Attribution lines may be wrapped onto a second line
+		if strings.HasPrefix(line, "On ") && !strings.HasSuffix(line, "wrote:") && scanner.Scan() {
+			next := strings.TrimRight(scanner.Text(), " \t")
+			if attributionLine.MatchString(line + " " + next) {
+				break
+			}
+			lines = append(lines, line)
+			line = next
+		}
+		if attributionLine.MatchString(line) {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,229 @@
+package mail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Join the lines of an email with CRLF line endings
+func email(lines ...string) string {
+	return strings.Join(lines, "\r\n")
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  Inbound
+	}{
+		{
+			name: "plain text",
+			email: email(
+				"From: Alice <Alice@Example.com>",
+				"To: reply+abc@forum.example.com",
+				"Subject: Hello",
+				"",
+				"Hi there",
+				"Second line",
+			),
+			want: Inbound{From: "alice@example.com", Recipients: []string{"reply+abc@forum.example.com"}, Subject: "Hello", Text: "Hi there\nSecond line"},
+		},
+		{
+			name: "encoded headers",
+			email: email(
+				"From: =?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>",
+				"To: forum@example.com",
+				"Subject: =?UTF-8?B?Q2Fmw6kgbWVldHVw?=",
+				"",
+				"Body",
+			),
+			want: Inbound{From: "renee@example.com", Recipients: []string{"forum@example.com"}, Subject: "Café meetup", Text: "Body"},
+		},
+		{
+			name: "every recipient header",
+			email: email(
+				"From: alice@example.com",
+				"To: One@example.com, two@example.com",
+				"Cc: three@example.com",
+				"Delivered-To: reply+xyz@forum.example.com",
+				"Subject: Copies",
+				"",
+				"Body",
+			),
+			want: Inbound{From: "alice@example.com", Recipients: []string{"one@example.com", "two@example.com", "three@example.com", "reply+xyz@forum.example.com"}, Subject: "Copies", Text: "Body"},
+		},
+		{
+			name: "quoted-printable",
+			email: email(
+				"From: alice@example.com",
+				"Subject: QP",
+				"Content-Type: text/plain; charset=utf-8",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"Caf=C3=A9 with a soft=",
+				" line break",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "QP", Text: "Café with a soft line break"},
+		},
+		{
+			name: "base64",
+			email: email(
+				"From: alice@example.com",
+				"Subject: Base64",
+				"Content-Type: text/plain; charset=utf-8",
+				"Content-Transfer-Encoding: BASE64",
+				"",
+				"SGVsbG8gZnJvbSBiYXNlNjQ=",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "Base64", Text: "Hello from base64"},
+		},
+		{
+			name: "latin-1",
+			email: email(
+				"From: alice@example.com",
+				"Subject: Latin",
+				"Content-Type: text/plain; charset=ISO-8859-1",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"Caf=E9",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "Latin", Text: "Café"},
+		},
+		{
+			name: "invalid utf-8",
+			email: email(
+				"From: alice@example.com",
+				"Subject: Invalid",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"bad =FF byte",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "Invalid", Text: "bad � byte"},
+		},
+		{
+			name: "alternative prefers plain text",
+			email: email(
+				"From: alice@example.com",
+				"Subject: Alternative",
+				`Content-Type: multipart/alternative; boundary="b1"`,
+				"",
+				"--b1",
+				"Content-Type: text/html",
+				"",
+				"<p>HTML version</p>",
+				"--b1",
+				"Content-Type: text/plain",
+				"",
+				"Plain version",
+				"--b1--",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "Alternative", Text: "Plain version"},
+		},
+		{
+			name: "html only",
+			email: email(
+				"From: alice@example.com",
+				"Subject: HTML",
+				`Content-Type: multipart/alternative; boundary="b1"`,
+				"",
+				"--b1",
+				"Content-Type: text/html",
+				"",
+				"<div>Fish &amp; chips<br>please</div><blockquote>quoted reply</blockquote>",
+				"--b1--",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "HTML", Text: "Fish & chips\nplease\n"},
+		},
+		{
+			name: "nested multipart with attachment",
+			email: email(
+				"From: alice@example.com",
+				"Subject: Nested",
+				`Content-Type: multipart/mixed; boundary="outer"`,
+				"",
+				"--outer",
+				"Content-Type: text/plain",
+				"Content-Disposition: attachment; filename=notes.txt",
+				"",
+				"Attached notes",
+				"--outer",
+				`Content-Type: multipart/alternative; boundary="inner"`,
+				"",
+				"--inner",
+				"Content-Type: text/plain",
+				"",
+				"Inner text",
+				"--inner--",
+				"--outer--",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "Nested", Text: "Inner text"},
+		},
+		{
+			name: "non-text body",
+			email: email(
+				"From: alice@example.com",
+				"Subject: Image",
+				"Content-Type: image/png",
+				"",
+				"not text",
+			),
+			want: Inbound{From: "alice@example.com", Subject: "Image", Text: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.email))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Parse = %#v, want %#v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+	}{
+		{"no headers", "just a body"},
+		{"missing From", email("Subject: Hi", "", "Body")},
+		{"invalid From", email("From: not an address", "", "Body")},
+		{"unterminated multipart", email("From: alice@example.com", `Content-Type: multipart/mixed; boundary="b1"`, "", "--b1", "Content-Type: text/plain", "", "Body")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(tt.email)); err == nil {
+				t.Errorf("Parse succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestStripReply(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"no quote", "Sounds good!", "Sounds good!"},
+		{"quoted lines", "Agreed.\n> original\n> text", "Agreed."},
+		{"attribution", "Yes\n\nOn Mon, 1 Jan 2024 at 10:00, Bob <bob@example.com> wrote:\n> Can you?", "Yes"},
+		{"wrapped attribution", "Yes\nOn Mon, 1 Jan 2024 at 10:00, Bob\n<bob@example.com> wrote:\n> Can you?", "Yes"},
+		{"line starting with On", "On second thought, no.\nThanks", "On second thought, no.\nThanks"},
+		{"signature", "Thanks\n--\nAlice", "Thanks"},
+		{"original message", "Sure\n-----Original Message-----\nFrom: Bob", "Sure"},
+		{"outlook header", "Sure\n\nFrom: Bob <bob@example.com>\nSent: Monday", "Sure"},
+		{"trailing spaces", "Hi  \n\n", "Hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripReply(tt.text); got != tt.want {
+				t.Errorf("StripReply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
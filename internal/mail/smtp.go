@@ -0,0 +1,34 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP sends emails through an SMTP server
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// Create an SMTP mailer for a server at host:port. Authentication is skipped
+// if no username is given.
+func NewSMTP(addr string, username string, password string, from string) *SMTP {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTP{addr: addr, from: from, auth: auth}
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	email, err := format(s.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, email)
+}
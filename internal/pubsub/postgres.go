@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channel that events are sent on with NOTIFY
+const postgresChannel = "forum_events"
+
+// Postgres delivers events to the subscribers of every server instance
+// connected to the same database using LISTEN/NOTIFY. Events published by an
+// instance reach its own subscribers the same way. Events sent while an
+// instance is reconnecting to the database are lost.
+type Postgres struct {
+	db          *sql.DB
+	listener    *pq.Listener
+	subscribers subscribers
+	done        chan struct{}
+}
+
+// Listen for events using a dedicated connection to the database at dbURL
+func NewPostgres(db *sql.DB, dbURL string) (*Postgres, error) {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Event listener error: %v", err)
+		}
+	})
+	if err := listener.Listen(postgresChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	p := &Postgres{db: db, listener: listener, done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+func (p *Postgres) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", postgresChannel, string(payload))
+	return err
+}
+
+func (p *Postgres) Subscribe(handler Handler) func() {
+	return p.subscribers.add(handler)
+}
+
+// Stop listening for events
+func (p *Postgres) Close() error {
+	err := p.listener.Close()
+	<-p.done
+	return err
+}
+
+// Deliver notifications to the subscribers until the listener is closed
+func (p *Postgres) run() {
+	defer close(p.done)
+	ping := time.NewTicker(time.Minute)
+	defer ping.Stop()
+	for {
+		select {
+		case notification, ok := <-p.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification means the connection was re-established
+			if notification == nil {
+				log.Println("Event listener reconnected, events may have been missed")
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+				log.Printf("Error decoding event: %v", err)
+				continue
+			}
+			p.subscribers.deliver(event)
+		case <-ping.C:
+			// Detect dropped connections that would otherwise go unnoticed
+			go p.listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package pubsub delivers domain events to subscribers, within one server
+// instance or across all of them.
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// Types of domain events
+const (
+	ThreadCreated  = "thread.created"
+	ThreadUpdated  = "thread.updated"
+	ThreadDeleted  = "thread.deleted"
+	ThreadRestored = "thread.restored"
+
+	CommentCreated  = "comment.created"
+	CommentUpdated  = "comment.updated"
+	CommentDeleted  = "comment.deleted"
+	CommentRestored = "comment.restored"
+
+	ReactionsChanged = "reactions.changed"
+
+	// Ephemeral event of a user typing in a thread, only delivered within an instance
+	Typing = "typing"
+)
+
+// A change in the forum. Events only carry IDs, so subscribers load the
+// current state of what changed themselves.
+type Event struct {
+	Type      string `json:"type"`
+	ThreadID  int    `json:"thread_id,omitempty"`
+	CommentID int    `json:"comment_id,omitempty"`
+	UserID    int    `json:"user_id,omitempty"` // The user who caused the event, if any
+	UserName  string `json:"user_name,omitempty"`
+}
+
+// A Handler receives events. It is called from the delivering goroutine, so
+// it must not block.
+type Handler func(Event)
+
+// A PubSub publishes events to every subscriber
+type PubSub interface {
+	Publish(ctx context.Context, event Event) error
+	// Subscribe to all events until the returned function is called
+	Subscribe(handler Handler) (unsubscribe func())
+}
+
+// The subscribers of a PubSub
+type subscribers struct {
+	mu       sync.RWMutex
+	next     int
+	handlers map[int]Handler
+}
+
+func (s *subscribers) add(handler Handler) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers == nil {
+		s.handlers = make(map[int]Handler)
+	}
+	id := s.next
+	s.next++
+	s.handlers[id] = handler
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.handlers, id)
+	}
+}
+
+func (s *subscribers) deliver(event Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, handler := range s.handlers {
+		handler(event)
+	}
+}
+
+// Memory delivers events to subscribers in the same process only, which is
+// enough when running a single instance
+type Memory struct {
+	subscribers subscribers
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Publish(ctx context.Context, event Event) error {
+	m.subscribers.deliver(event)
+	return nil
+}
+
+func (m *Memory) Subscribe(handler Handler) func() {
+	return m.subscribers.add(handler)
+}
@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	created := Event{Type: CommentCreated, ThreadID: 1, CommentID: 2, UserID: 3}
+	deleted := Event{Type: ThreadDeleted, ThreadID: 1}
+	tests := []struct {
+		name        string
+		subscribers int
+		unsubscribe int // Number of subscribers that unsubscribe before the events are published
+		events      []Event
+	}{
+		{"no subscribers", 0, 0, []Event{created}},
+		{"one subscriber", 1, 0, []Event{created}},
+		{"several subscribers", 3, 0, []Event{created, deleted}},
+		{"in order", 1, 0, []Event{created, deleted, created}},
+		{"unsubscribed", 2, 1, []Event{created, deleted}},
+		{"all unsubscribed", 2, 2, []Event{created}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemory()
+			received := make([][]Event, tt.subscribers)
+			unsubscribes := make([]func(), tt.subscribers)
+			for i := range received {
+				i := i
+				unsubscribes[i] = m.Subscribe(func(event Event) {
+					received[i] = append(received[i], event)
+				})
+			}
+			for _, unsubscribe := range unsubscribes[:tt.unsubscribe] {
+				unsubscribe()
+			}
+
+			for _, event := range tt.events {
+				if err := m.Publish(context.Background(), event); err != nil {
+					t.Fatalf("Publish failed: %v", err)
+				}
+			}
+
+			for i, events := range received {
+				var want []Event
+				if i >= tt.unsubscribe {
+					want = tt.events
+				}
+				if !reflect.DeepEqual(events, want) {
+					t.Errorf("subscriber %d received %v, want %v", i, events, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryUnsubscribeTwice(t *testing.T) {
+	m := NewMemory()
+	var first, second int
+	unsubscribe := m.Subscribe(func(Event) { first++ })
+	m.Subscribe(func(Event) { second++ })
+	unsubscribe()
+	unsubscribe()
+
+	m.Publish(context.Background(), Event{Type: Typing, ThreadID: 1})
+	if first != 0 || second != 1 {
+		t.Errorf("got %d and %d events, want 0 and 1", first, second)
+	}
+}
@@ -0,0 +1,135 @@
+// Package render turns user-written text into HTML that is safe to display.
+package render
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A mention is an @ followed by a username, not preceded by a word character
+// so that email addresses are not treated as mentions
+var mentionPattern = regexp.MustCompile(`(^|[^\w@])@([A-Za-z0-9_][A-Za-z0-9_.-]*)`)
+
+// A piece of text that is either code or prose
+type segment struct {
+	Text   string
+	Code   bool
+	Fenced bool
+}
+
+// Split text into code and prose segments. Fenced blocks are delimited by ```
+// and inline code by single backticks. An unclosed delimiter is treated as prose.
+func split(text string) []segment {
+	var segments []segment
+	for text != "" {
+		// Find the next code delimiter
+		start := strings.Index(text, "`")
+		if start < 0 {
+			segments = append(segments, segment{Text: text})
+			break
+		}
+
+		delimiter := "`"
+		fenced := strings.HasPrefix(text[start:], "```")
+		if fenced {
+			delimiter = "```"
+		}
+		end := strings.Index(text[start+len(delimiter):], delimiter)
+		if end < 0 {
+			segments = append(segments, segment{Text: text})
+			break
+		}
+		end += start + len(delimiter)
+
+		if start > 0 {
+			segments = append(segments, segment{Text: text[:start]})
+		}
+		segments = append(segments, segment{Text: text[start+len(delimiter) : end], Code: true, Fenced: fenced})
+		text = text[end+len(delimiter):]
+	}
+	return segments
+}
+
+// Mentions returns the distinct usernames mentioned outside of code, in order of appearance
+func Mentions(text string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, segment := range split(text) {
+		if segment.Code {
+			continue
+		}
+		for _, match := range mentionPattern.FindAllStringSubmatch(segment.Text, -1) {
+			username := strings.TrimRight(match[2], ".-")
+			if !seen[username] {
+				seen[username] = true
+				usernames = append(usernames, username)
+			}
+		}
+	}
+	return usernames
+}
+
+// HTML escapes text and renders code spans and blocks. Mentions of the given
+// users, keyed by username, are rendered as links to their profiles.
+func HTML(text string, users map[string]int) string {
+	var out strings.Builder
+	for _, segment := range split(text) {
+		switch {
+		case segment.Fenced:
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Trim(segment.Text, "\n")) + "</code></pre>")
+		case segment.Code:
+			out.WriteString("<code>" + html.EscapeString(segment.Text) + "</code>")
+		default:
+			out.WriteString(renderMentions(segment.Text, users))
+		}
+	}
+	return out.String()
+}
+
+// Escape prose and link mentions of known users
+func renderMentions(text string, users map[string]int) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		// match[4] and match[5] delimit the username, just after the @
+		username := strings.TrimRight(text[match[4]:match[5]], ".-")
+		userID, ok := users[username]
+		if !ok {
+			continue
+		}
+		at := match[4] - 1
+		end := match[4] + len(username)
+
+		out.WriteString(html.EscapeString(text[last:at]))
+		out.WriteString(`<a class="mention" href="/users/` + strconv.Itoa(userID) + `">@` + html.EscapeString(username) + `</a>`)
+		last = end
+	}
+	out.WriteString(html.EscapeString(text[last:]))
+	return out.String()
+}
+
+// Quote renders quoted text as a blockquote linking back to the source comment.
+// A sourceID of 0 means the source no longer exists, so there is nothing to link to.
+// Stale quotes no longer match their source and are marked as such.
+func Quote(sourceID int, text string, stale bool) string {
+	class := "quote"
+	if stale {
+		class += " stale"
+	}
+
+	var out strings.Builder
+	out.WriteString(`<blockquote class="` + class + `">`)
+	out.WriteString(html.EscapeString(text))
+	switch {
+	case sourceID == 0:
+		out.WriteString(`<cite>Quoted comment was deleted</cite>`)
+	case stale:
+		out.WriteString(`<cite><a href="#comment-` + strconv.Itoa(sourceID) + `">Quoted comment has since changed</a></cite>`)
+	default:
+		out.WriteString(`<cite><a href="#comment-` + strconv.Itoa(sourceID) + `">Source</a></cite>`)
+	}
+	out.WriteString(`</blockquote>`)
+	return out.String()
+}
@@ -0,0 +1,102 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"none", "hello world", nil},
+		{"single", "thanks @alice", []string{"alice"}},
+		{"start of text", "@bob what do you think?", []string{"bob"}},
+		{"in order without duplicates", "@carol and @dave, @carol again", []string{"carol", "dave"}},
+		{"trailing punctuation", "ask @eve. or @frank-", []string{"eve", "frank"}},
+		{"dots and dashes inside", "cc @first.last and @a-b_c", []string{"first.last", "a-b_c"}},
+		{"email address", "mail me at user@example.com", nil},
+		{"double at", "@@grace", nil},
+		{"inline code", "run `@heidi` but ask @ivan", []string{"ivan"}},
+		{"fenced code", "```\n@judy\n``` then @mallory", []string{"mallory"}},
+		{"unclosed code", "`@oscar", []string{"oscar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Mentions(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Mentions(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTML(t *testing.T) {
+	users := map[string]int{"alice": 1, "first.last": 2}
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "hello", "hello"},
+		{"escaped", `<b>"hi"</b> & bye`, "&lt;b&gt;&#34;hi&#34;&lt;/b&gt; &amp; bye"},
+		{"known mention", "hi @alice!", `hi <a class="mention" href="/users/1">@alice</a>!`},
+		{"mention with trailing dot", "ask @first.last.", `ask <a class="mention" href="/users/2">@first.last</a>.`},
+		{"unknown mention", "hi @bob", "hi @bob"},
+		{"escaped around mention", "<@alice>", `&lt;<a class="mention" href="/users/1">@alice</a>&gt;`},
+		{"inline code", "use `<br>` and `@alice`", "use <code>&lt;br&gt;</code> and <code>@alice</code>"},
+		{"fenced code", "```\nx < 1\n```", "<pre><code>x &lt; 1</code></pre>"},
+		{"unclosed code", "a `b", "a `b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTML(tt.text, users); got != tt.want {
+				t.Errorf("HTML(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		name     string
+		sourceID int
+		text     string
+		stale    bool
+		want     string
+	}{
+		{
+			name:     "source",
+			sourceID: 7,
+			text:     "quoted",
+			want:     `<blockquote class="quote">quoted<cite><a href="#comment-7">Source</a></cite></blockquote>`,
+		},
+		{
+			name:     "stale",
+			sourceID: 7,
+			text:     "quoted",
+			stale:    true,
+			want:     `<blockquote class="quote stale">quoted<cite><a href="#comment-7">Quoted comment has since changed</a></cite></blockquote>`,
+		},
+		{
+			name:     "deleted source",
+			sourceID: 0,
+			text:     "quoted",
+			want:     `<blockquote class="quote">quoted<cite>Quoted comment was deleted</cite></blockquote>`,
+		},
+		{
+			name:     "escaped",
+			sourceID: 3,
+			text:     "<script>",
+			want:     `<blockquote class="quote">&lt;script&gt;<cite><a href="#comment-3">Source</a></cite></blockquote>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Quote(tt.sourceID, tt.text, tt.stale); got != tt.want {
+				t.Errorf("Quote(%d, %q, %v) = %q, want %q", tt.sourceID, tt.text, tt.stale, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package search
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Words of context kept on each side of the first match in a snippet
+const snippetContext = 12
+
+// Memory is an in-process Indexer for use with SQLite or in tests, where the
+// Postgres full-text search functions are not available
+type Memory struct {
+	mu   sync.RWMutex
+	docs map[documentKey]Document
+}
+
+type documentKey struct {
+	threadID  int
+	commentID int
+}
+
+func NewMemory() *Memory {
+	return &Memory{docs: make(map[documentKey]Document)}
+}
+
+func (m *Memory) Index(ctx context.Context, doc Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs[documentKey{doc.ThreadID, doc.CommentID}] = doc
+	return nil
+}
+
+func (m *Memory) RemoveThread(ctx context.Context, threadID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.docs {
+		if key.threadID == threadID {
+			delete(m.docs, key)
+		}
+	}
+	return nil
+}
+
+// Split text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (m *Memory) Search(ctx context.Context, query Query) (Results, error) {
+	// Split each term into its words, so that terms are matched as sequences of words
+	var include, exclude [][]string
+	for _, term := range query.Terms {
+		words := tokenize(term.Text)
+		if len(words) == 0 {
+			continue
+		}
+		if term.Negated {
+			exclude = append(exclude, words)
+		} else {
+			include = append(include, words)
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Find the threads with visible comments
+	answered := make(map[int]bool)
+	for key, doc := range m.docs {
+		if key.commentID != 0 && !doc.Hidden {
+			answered[key.threadID] = true
+		}
+	}
+
+	// Find the documents containing every included term and no excluded term,
+	// ranked by how often the included terms appear
+	matches := []Result{}
+	for _, doc := range m.docs {
+		if doc.Hidden || !matchesFilters(doc, query) || (query.Unanswered && answered[doc.ThreadID]) {
+			continue
+		}
+
+		text := doc.Body
+		if doc.Kind == KindThread {
+			text = doc.Title
+		}
+		words := tokenize(text)
+
+		rank := 0.0
+		matched := true
+		for _, term := range include {
+			count := countSequence(words, term)
+			if count == 0 {
+				matched = false
+				break
+			}
+			rank += float64(count) / math.Log(float64(len(words))+2)
+		}
+		for _, term := range exclude {
+			matched = matched && countSequence(words, term) == 0
+		}
+		if !matched {
+			continue
+		}
+
+		result := Result{
+			Kind:      doc.Kind,
+			ThreadID:  doc.ThreadID,
+			Title:     doc.Title,
+			Snippet:   snippet(text, include),
+			Rank:      rank,
+			AuthorID:  doc.AuthorID,
+			Author:    doc.Author,
+			CreatedAt: doc.CreatedAt,
+		}
+		if doc.CommentID != 0 {
+			commentID := doc.CommentID
+			result.CommentID = &commentID
+		}
+		matches = append(matches, result)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Rank != matches[j].Rank {
+			return matches[i].Rank > matches[j].Rank
+		}
+		return matches[i].CreatedAt.After(matches[j].CreatedAt)
+	})
+
+	// Return the requested page
+	start := min(query.Offset, len(matches))
+	end := min(start+query.Limit, len(matches))
+	return Results{Results: matches[start:end], Total: len(matches)}, nil
+}
+
+// Count the occurrences of a sequence of words
+func countSequence(words []string, sequence []string) int {
+	count := 0
+	for i := 0; i+len(sequence) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(sequence)], sequence) {
+			count++
+		}
+	}
+	return count
+}
+
+// Check a document against the query's filters
+func matchesFilters(doc Document, query Query) bool {
+	if !slices.Contains(query.CategoryIDs, doc.CategoryID) {
+		return false
+	}
+	if (query.In == InTitle && doc.Kind != KindThread) || (query.In == InBody && doc.Kind != KindComment) {
+		return false
+	}
+	for _, tags := range query.Tags {
+		found := false
+		for _, tag := range doc.Tags {
+			found = found || slices.Contains(tags, tag)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(query.Authors) > 0 && !slices.Contains(query.Authors, doc.Author) {
+		return false
+	}
+	if !query.From.IsZero() && doc.CreatedAt.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !doc.CreatedAt.Before(query.To) {
+		return false
+	}
+	return true
+}
+
+// Build a snippet around the first match of one of the terms, highlighting the
+// words of every term. Without terms the snippet is the start of the text.
+func snippet(text string, terms [][]string) string {
+	words := strings.Fields(text)
+	isTerm := func(word string) bool {
+		for _, token := range tokenize(word) {
+			for _, term := range terms {
+				if slices.Contains(term, token) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	first := 0
+	for i, word := range words {
+		if isTerm(word) {
+			first = i
+			break
+		}
+	}
+	start := max(first-snippetContext, 0)
+	end := min(start+2*snippetContext+1, len(words))
+
+	parts := make([]string, 0, end-start)
+	for _, word := range words[start:end] {
+		if isTerm(word) {
+			word = highlightStart + word + highlightStop
+		}
+		parts = append(parts, word)
+	}
+	return highlight(strings.Join(parts, " "))
+}
@@ -0,0 +1,199 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func day(n int) time.Time {
+	return time.Date(2026, 1, n, 0, 0, 0, 0, time.UTC)
+}
+
+// An index of two threads with a comment between them in category 1, and one
+// thread in category 2
+func newTestIndex(t *testing.T) *Memory {
+	t.Helper()
+	m := NewMemory()
+	docs := []Document{
+		{Kind: KindThread, ThreadID: 1, Title: "Go generics question", AuthorID: 1, Author: "alice", Tags: []int{10}, CategoryID: 1, CreatedAt: day(1)},
+		{Kind: KindComment, ThreadID: 1, CommentID: 5, Title: "Go generics question", Body: "Generics in Go are great", AuthorID: 2, Author: "bob", Tags: []int{10}, CategoryID: 1, CreatedAt: day(2)},
+		{Kind: KindThread, ThreadID: 2, Title: "Cooking pasta", AuthorID: 2, Author: "bob", Tags: []int{20}, CategoryID: 1, CreatedAt: day(3)},
+		{Kind: KindThread, ThreadID: 3, Title: "Private go stuff", AuthorID: 1, Author: "alice", CategoryID: 2, CreatedAt: day(4)},
+	}
+	for _, doc := range docs {
+		if err := m.Index(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// The matched documents as "thread" or "thread#comment", sorted
+func resultKeys(results Results) []string {
+	keys := []string{}
+	for _, result := range results.Results {
+		key := strconv.Itoa(result.ThreadID)
+		if result.CommentID != nil {
+			key += "#" + strconv.Itoa(*result.CommentID)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestMemorySearch(t *testing.T) {
+	m := newTestIndex(t)
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{"no terms", Query{}, []string{"1", "1#5", "2"}},
+		{"word", Query{Terms: []Term{{Text: "go"}}}, []string{"1", "1#5"}},
+		{"case insensitive", Query{Terms: []Term{{Text: "PASTA"}}}, []string{"2"}},
+		{"all terms", Query{Terms: []Term{{Text: "go"}, {Text: "great"}}}, []string{"1#5"}},
+		{"phrase", Query{Terms: []Term{{Text: "generics in go", Phrase: true}}}, []string{"1#5"}},
+		{"phrase out of order", Query{Terms: []Term{{Text: "go in generics", Phrase: true}}}, []string{}},
+		{"negated", Query{Terms: []Term{{Text: "go"}, {Text: "great", Negated: true}}}, []string{"1"}},
+		{"other categories", Query{Terms: []Term{{Text: "go"}}, CategoryIDs: []int{1, 2}}, []string{"1", "1#5", "3"}},
+		{"no categories", Query{CategoryIDs: []int{}}, []string{}},
+		{"author", Query{Authors: []string{"bob"}}, []string{"1#5", "2"}},
+		{"in title", Query{Terms: []Term{{Text: "go"}}, In: InTitle}, []string{"1"}},
+		{"in body", Query{Terms: []Term{{Text: "go"}}, In: InBody}, []string{"1#5"}},
+		{"tag", Query{Tags: [][]int{{20}}}, []string{"2"}},
+		{"any tag of a group", Query{Tags: [][]int{{10, 20}}}, []string{"1", "1#5", "2"}},
+		{"a tag from every group", Query{Tags: [][]int{{10}, {20}}}, []string{}},
+		{"unanswered", Query{Unanswered: true}, []string{"2"}},
+		{"from", Query{From: day(2)}, []string{"1#5", "2"}},
+		{"to excludes the day", Query{To: day(2)}, []string{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.query
+			if query.CategoryIDs == nil {
+				query.CategoryIDs = []int{1}
+			}
+			query.Limit = 10
+			results, err := m.Search(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultKeys(results); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if results.Total != len(tt.want) {
+				t.Errorf("got total %d, want %d", results.Total, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestMemorySearchRanksAndPages(t *testing.T) {
+	m := NewMemory()
+	for i, title := range []string{"go", "go go go", "go go"} {
+		doc := Document{Kind: KindThread, ThreadID: i + 1, Title: title, CategoryID: 1, CreatedAt: day(1)}
+		if err := m.Index(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name          string
+		limit, offset int
+		want          []int
+	}{
+		{"all", 10, 0, []int{2, 3, 1}},
+		{"first page", 2, 0, []int{2, 3}},
+		{"second page", 2, 2, []int{1}},
+		{"past the end", 2, 4, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := m.Search(context.Background(), Query{Terms: []Term{{Text: "go"}}, CategoryIDs: []int{1}, Limit: tt.limit, Offset: tt.offset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []int{}
+			for _, result := range results.Results {
+				got = append(got, result.ThreadID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got threads %v, want %v", got, tt.want)
+			}
+			if results.Total != 3 {
+				t.Errorf("got total %d, want 3", results.Total)
+			}
+		})
+	}
+}
+
+func TestMemoryRemoveThread(t *testing.T) {
+	m := newTestIndex(t)
+	if err := m.RemoveThread(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	results, err := m.Search(context.Background(), Query{CategoryIDs: []int{1}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resultKeys(results), []string{"2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMemoryHiddenComments(t *testing.T) {
+	m := newTestIndex(t)
+	hidden := Document{Kind: KindComment, ThreadID: 2, CommentID: 6, Title: "Cooking pasta", Body: "Spam recipe", AuthorID: 3, Author: "carol", Tags: []int{20}, CategoryID: 1, CreatedAt: day(4), Hidden: true}
+	if err := m.Index(context.Background(), hidden); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{"not matched", Query{Terms: []Term{{Text: "recipe"}}}, []string{}},
+		{"not an answer", Query{Unanswered: true}, []string{"2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.query
+			query.CategoryIDs = []int{1}
+			query.Limit = 10
+			results, err := m.Search(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultKeys(results); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := "one two three four five six seven eight nine ten eleven twelve thirteen fourteen fifteen"
+	tests := []struct {
+		name  string
+		text  string
+		terms [][]string
+		want  string
+	}{
+		{"no terms", "Cooking pasta", nil, "Cooking pasta"},
+		{"highlighted", "Cooking pasta tonight", [][]string{{"pasta"}}, "Cooking <mark>pasta</mark> tonight"},
+		{"punctuation kept", "Is it pasta?", [][]string{{"pasta"}}, "Is it <mark>pasta?</mark>"},
+		{"escaped", "<b>pasta</b> & sauce", [][]string{{"sauce"}}, "&lt;b&gt;pasta&lt;/b&gt; &amp; <mark>sauce</mark>"},
+		{"trimmed before the match", long, [][]string{{"fifteen"}}, "three four five six seven eight nine ten eleven twelve thirteen fourteen <mark>fifteen</mark>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snippet(tt.text, tt.terms); got != tt.want {
+				t.Errorf("snippet(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Layout of the dates accepted by the before: and after: operators
+const DateLayout = "2006-01-02"
+
+// Parts of a document that in: can restrict a search to
+const (
+	InTitle = "title"
+	InBody  = "body"
+)
+
+// States that is: can filter on
+const (
+	IsUnanswered = "unanswered"
+)
+
+// A ParseError describes a malformed query and where in it the problem is
+type ParseError struct {
+	Offset  int // Offset of the problem in runes from the start of the query
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (at character %d)", e.Message, e.Offset+1)
+}
+
+// A parsed query, whose clauses must all match
+type Expr struct {
+	Clauses []Clause
+}
+
+// A Clause is one of Term, AuthorFilter, TagFilter, InFilter, DateFilter or IsFilter
+type Clause interface {
+	clause()
+	String() string
+}
+
+// A word, or a phrase whose words must appear together and in order
+type Term struct {
+	Text    string
+	Phrase  bool
+	Negated bool // Matches documents that do not contain the term
+}
+
+// author:USERNAME
+type AuthorFilter struct {
+	Username string
+}
+
+// tag:NAME, which also matches the tag's synonyms and descendants
+type TagFilter struct {
+	Name string
+}
+
+// in:title or in:body
+type InFilter struct {
+	Field string
+}
+
+// before:YYYY-MM-DD or after:YYYY-MM-DD, both of which exclude the given day
+type DateFilter struct {
+	Before bool
+	Date   time.Time
+}
+
+// is:unanswered
+type IsFilter struct {
+	State string
+}
+
+func (Term) clause()         {}
+func (AuthorFilter) clause() {}
+func (TagFilter) clause()    {}
+func (InFilter) clause()     {}
+func (DateFilter) clause()   {}
+func (IsFilter) clause()     {}
+
+func (t Term) String() string {
+	text := t.Text
+	if t.Phrase {
+		text = `"` + text + `"`
+	}
+	if t.Negated {
+		text = "-" + text
+	}
+	return text
+}
+
+func (f AuthorFilter) String() string { return "author:" + quoteValue(f.Username) }
+func (f TagFilter) String() string    { return "tag:" + quoteValue(f.Name) }
+func (f InFilter) String() string     { return "in:" + f.Field }
+func (f IsFilter) String() string     { return "is:" + f.State }
+
+func (f DateFilter) String() string {
+	if f.Before {
+		return "before:" + f.Date.Format(DateLayout)
+	}
+	return "after:" + f.Date.Format(DateLayout)
+}
+
+// Quote an operator value if it contains spaces
+func quoteValue(value string) string {
+	if strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// Format the query in its canonical form, which parses back to the same query
+func (e *Expr) String() string {
+	parts := make([]string, len(e.Clauses))
+	for i, clause := range e.Clauses {
+		parts[i] = clause.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// Parse a query made of words, "quoted phrases" and operators such as
+// author:alice, tag:"Interests and Hobbies", in:title, before:2026-01-01 and
+// is:unanswered. Words and phrases can be negated with a leading dash. A word
+// with a colon that does not start with an operator name, such as https://…
+// or "Note:", is searched for as it is.
+func Parse(query string) (*Expr, error) {
+	p := parser{input: []rune(query)}
+	expr := &Expr{Clauses: []Clause{}}
+	for {
+		p.skipSpace()
+		if p.done() {
+			return expr, nil
+		}
+		clause, err := p.clause()
+		if err != nil {
+			return nil, err
+		}
+		expr.Clauses = append(expr.Clauses, clause)
+	}
+}
+
+type parser struct {
+	input []rune
+	pos   int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() rune {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *parser) errorAt(offset int, format string, args ...interface{}) error {
+	return &ParseError{Offset: offset, Message: fmt.Sprintf(format, args...)}
+}
+
+// Parse a word, phrase or operator
+func (p *parser) clause() (Clause, error) {
+	start := p.pos
+	negated := false
+	if p.peek() == '-' && p.pos+1 < len(p.input) && !unicode.IsSpace(p.input[p.pos+1]) {
+		negated = true
+		p.pos++
+	}
+
+	// A quoted phrase
+	if p.peek() == '"' {
+		text, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		return Term{Text: text, Phrase: true, Negated: negated}, nil
+	}
+
+	// An operator is one of the operator names followed by a colon
+	nameStart := p.pos
+	for !p.done() && unicode.IsLetter(p.peek()) {
+		p.pos++
+	}
+	name := strings.ToLower(string(p.input[nameStart:p.pos]))
+	if isOperator(name) && p.peek() == ':' {
+		p.pos++
+		if negated {
+			return nil, p.errorAt(start, "%s: cannot be negated, only words and phrases can", name)
+		}
+		return p.operator(name, start)
+	}
+
+	// Otherwise a plain word
+	p.pos = nameStart
+	return Term{Text: p.word(), Negated: negated}, nil
+}
+
+// Read up to the next space
+func (p *parser) word() string {
+	start := p.pos
+	for !p.done() && !unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// Read a quoted string, without the quotes
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	end := p.pos
+	for end < len(p.input) && p.input[end] != '"' {
+		end++
+	}
+	if end == len(p.input) {
+		return "", p.errorAt(start, "missing closing quote")
+	}
+	text := strings.Join(strings.Fields(string(p.input[p.pos:end])), " ")
+	p.pos = end + 1
+	if text == "" {
+		return "", p.errorAt(start, "empty quotes")
+	}
+	return text, nil
+}
+
+// Check whether a lowercase name is the name of an operator
+func isOperator(name string) bool {
+	switch name {
+	case "author", "tag", "in", "before", "after", "is":
+		return true
+	}
+	return false
+}
+
+// Parse the value of the named operator, which started at the given offset
+func (p *parser) operator(name string, start int) (Clause, error) {
+	valueStart := p.pos
+	var value string
+	if p.peek() == '"' {
+		var err error
+		if value, err = p.quoted(); err != nil {
+			return nil, err
+		}
+	} else {
+		value = p.word()
+	}
+	if value == "" {
+		return nil, p.errorAt(start, "%s: needs a value", name)
+	}
+
+	switch name {
+	case "author":
+		return AuthorFilter{Username: value}, nil
+	case "tag":
+		return TagFilter{Name: value}, nil
+	case "in":
+		field := strings.ToLower(value)
+		if field != InTitle && field != InBody {
+			return nil, p.errorAt(valueStart, "in: must be %s or %s, not %q", InTitle, InBody, value)
+		}
+		return InFilter{Field: field}, nil
+	case "before", "after":
+		date, err := time.Parse(DateLayout, value)
+		if err != nil {
+			return nil, p.errorAt(valueStart, "%s: needs a date like 2026-01-31, not %q", name, value)
+		}
+		return DateFilter{Before: name == "before", Date: date}, nil
+	default:
+		state := strings.ToLower(value)
+		if state != IsUnanswered {
+			return nil, p.errorAt(valueStart, "is: must be %s, not %q", IsUnanswered, value)
+		}
+		return IsFilter{State: state}, nil
+	}
+}
@@ -0,0 +1,118 @@
+package search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []Clause
+	}{
+		{"empty", "", []Clause{}},
+		{"blank", "   ", []Clause{}},
+		{"words", "go  generics", []Clause{Term{Text: "go"}, Term{Text: "generics"}}},
+		{"phrase", `"go   generics"`, []Clause{Term{Text: "go generics", Phrase: true}}},
+		{"negated word", "-java", []Clause{Term{Text: "java", Negated: true}}},
+		{"negated phrase", `-"hello world"`, []Clause{Term{Text: "hello world", Phrase: true, Negated: true}}},
+		{"lone dash", "a - b", []Clause{Term{Text: "a"}, Term{Text: "-"}, Term{Text: "b"}}},
+		{"author", "author:alice", []Clause{AuthorFilter{Username: "alice"}}},
+		{"operator name is case insensitive", "AUTHOR:alice", []Clause{AuthorFilter{Username: "alice"}}},
+		{"quoted tag", `tag:"Interests and Hobbies"`, []Clause{TagFilter{Name: "Interests and Hobbies"}}},
+		{"in title", "in:Title", []Clause{InFilter{Field: InTitle}}},
+		{"in body", "in:body", []Clause{InFilter{Field: InBody}}},
+		{"before", "before:2026-01-31", []Clause{DateFilter{Before: true, Date: day(31)}}},
+		{"after", "after:2026-01-02", []Clause{DateFilter{Date: day(2)}}},
+		{"is unanswered", "is:unanswered", []Clause{IsFilter{State: IsUnanswered}}},
+		{"word with a colon after digits", "12:30", []Clause{Term{Text: "12:30"}}},
+		{"unknown operator", "go foo:bar", []Clause{Term{Text: "go"}, Term{Text: "foo:bar"}}},
+		{"url", "see https://example.com/a?b=c", []Clause{Term{Text: "see"}, Term{Text: "https://example.com/a?b=c"}}},
+		{"word ending in a colon", "Note: foo", []Clause{Term{Text: "Note:"}, Term{Text: "foo"}}},
+		{"error message", "error: timeout", []Clause{Term{Text: "error:"}, Term{Text: "timeout"}}},
+		{"negated unknown operator", "-foo:bar", []Clause{Term{Text: "foo:bar", Negated: true}}},
+		{"operator name inside a word", "authors:alice", []Clause{Term{Text: "authors:alice"}}},
+		{
+			"mixed",
+			`author:bob tag:go "error handling" -panic in:body`,
+			[]Clause{AuthorFilter{Username: "bob"}, TagFilter{Name: "go"}, Term{Text: "error handling", Phrase: true}, Term{Text: "panic", Negated: true}, InFilter{Field: InBody}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.query, err)
+			}
+			if !reflect.DeepEqual(expr.Clauses, tt.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", tt.query, expr.Clauses, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		offset int
+	}{
+		{"unclosed quote", `go "generics`, 3},
+		{"empty quotes", `go ""`, 3},
+		{"negated operator", "-author:alice", 0},
+		{"missing value", "author:", 0},
+		{"missing value before space", "go tag: x", 3},
+		{"invalid in", "in:comments", 3},
+		{"invalid date", "before:31/01/2026", 7},
+		{"invalid is", "is:open", 3},
+		{"unclosed quoted value", `tag:"go`, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Parse(%q) = %v, want a ParseError", tt.query, err)
+			}
+			if parseErr.Offset != tt.offset {
+				t.Errorf("Parse(%q) failed at offset %d, want %d: %v", tt.query, parseErr.Offset, tt.offset, err)
+			}
+		})
+	}
+}
+
+func TestExprStringRoundTrips(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"go  generics", "go generics"},
+		{`-"hello   world"`, `-"hello world"`},
+		{`TAG:"Interests and Hobbies" author:bob`, `tag:"Interests and Hobbies" author:bob`},
+		{`author:"alice"`, "author:alice"},
+		{"in:TITLE is:Unanswered", "in:title is:unanswered"},
+		{"before:2026-01-31 after:2026-01-02", "before:2026-01-31 after:2026-01-02"},
+		{"Note: https://example.com", "Note: https://example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.query, err)
+			}
+			got := expr.String()
+			if got != tt.want {
+				t.Errorf("Parse(%q).String() = %q, want %q", tt.query, got, tt.want)
+			}
+			again, err := Parse(got)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", got, err)
+			}
+			if !reflect.DeepEqual(again, expr) {
+				t.Errorf("Parse(%q) = %#v, want %#v", got, again, expr)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Postgres searches the search_vector columns of the threads and comments
+// tables, which the database keeps up to date as generated columns
+type Postgres struct {
+	db *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Search(ctx context.Context, query Query) (Results, error) {
+	sqlQuery, args := buildQuery(query)
+	rows, err := p.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return Results{}, err
+	}
+	defer rows.Close()
+
+	results := Results{Results: []Result{}}
+	for rows.Next() {
+		var result Result
+		if err := rows.Scan(&result.Kind, &result.ThreadID, &result.CommentID, &result.Title, &result.Snippet, &result.Rank, &result.AuthorID, &result.Author, &result.CreatedAt, &results.Total); err != nil {
+			return Results{}, err
+		}
+		result.Snippet = highlight(result.Snippet)
+		results.Results = append(results.Results, result)
+	}
+	return results, rows.Err()
+}
+
+// Build the SQL of a search query and its arguments
+func buildQuery(query Query) (string, []interface{}) {
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// Combine the terms into one text search query. Without terms every document
+	// matches, unranked and with its start as the snippet.
+	var terms []string
+	for _, term := range query.Terms {
+		function := "plainto_tsquery"
+		if term.Phrase {
+			function = "phraseto_tsquery"
+		}
+		tsTerm := function + "('english', " + arg(term.Text) + ")"
+		if term.Negated {
+			tsTerm = "!!" + tsTerm
+		}
+		terms = append(terms, tsTerm)
+	}
+	tsQuery := strings.Join(terms, " && ")
+	match := func(vector string) string { return vector + " @@ (" + tsQuery + ")" }
+	headline := func(text string) string { return "left(" + text + ", 200)" }
+	rank := func(vector string) string { return "0::real" }
+	if len(terms) == 0 {
+		match = func(vector string) string { return "TRUE" }
+	} else {
+		headlineOptions := arg("StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", MaxWords=35, MinWords=15")
+		headline = func(text string) string {
+			return "ts_headline('english', " + text + ", " + tsQuery + ", " + headlineOptions + ")"
+		}
+		rank = func(vector string) string { return "ts_rank(" + vector + ", " + tsQuery + ")" }
+	}
+
+	// Filters shared by threads and comments, where t is the thread and doc is
+	// the alias of the thread or comment being matched
+	conditions := []string{
+		"t.deleted_at IS NULL",
+		"t.hidden_at IS NULL",
+		"t.category_id = ANY(" + arg(pq.Array(query.CategoryIDs)) + ")",
+	}
+	for _, tags := range query.Tags {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM thread_tags WHERE thread_tags.thread_id = t.id AND thread_tags.tag_id = ANY("+arg(pq.Array(tags))+"))")
+	}
+	if len(query.Authors) > 0 {
+		conditions = append(conditions, "u.username = ANY("+arg(pq.Array(query.Authors))+")")
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "doc.created_at >= "+arg(query.From))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "doc.created_at < "+arg(query.To))
+	}
+	if query.Unanswered {
+		conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM comments answers WHERE answers.thread_id = t.id AND answers.deleted_at IS NULL AND answers.hidden_at IS NULL)")
+	}
+	where := func(doc string) string {
+		return strings.ReplaceAll(strings.Join(conditions, " AND "), "doc.", doc+".")
+	}
+
+	// Match thread titles and comments unless the query is limited to one of them
+	var selects []string
+	if query.In != InBody {
+		selects = append(selects, `
+		SELECT 'thread' AS kind, t.id AS thread_id, NULL::int AS comment_id, t.name AS title,
+			`+headline("t.name")+` AS snippet, `+rank("t.search_vector")+` AS rank,
+			t.user_id AS author_id, COALESCE(u.username, '') AS author, t.created_at
+		FROM threads t
+		LEFT JOIN users u ON u.id = t.user_id
+		WHERE `+match("t.search_vector")+` AND `+where("t"))
+	}
+	if query.In != InTitle {
+		selects = append(selects, `
+		SELECT 'comment' AS kind, t.id AS thread_id, d.id AS comment_id, t.name AS title,
+			`+headline("d.text")+` AS snippet, `+rank("d.search_vector")+` AS rank,
+			d.user_id AS author_id, COALESCE(u.username, '') AS author, d.created_at
+		FROM comments d
+		JOIN threads t ON t.id = d.thread_id
+		LEFT JOIN users u ON u.id = d.user_id
+		WHERE `+match("d.search_vector")+` AND d.deleted_at IS NULL AND d.hidden_at IS NULL AND `+where("d"))
+	}
+
+	sqlQuery := `
+	WITH matches AS (` + strings.Join(selects, `
+		UNION ALL`) + `
+	)
+	SELECT kind, thread_id, comment_id, title, snippet, rank, author_id, author, created_at, COUNT(*) OVER ()
+	FROM matches
+	ORDER BY rank DESC, created_at DESC
+	LIMIT ` + arg(query.Limit) + ` OFFSET ` + arg(query.Offset)
+
+	return sqlQuery, args
+}
@@ -0,0 +1,26 @@
+package search
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildQueryUnanswered(t *testing.T) {
+	tests := []struct {
+		name       string
+		unanswered bool
+		want       bool
+	}{
+		{"unanswered", true, true},
+		{"any", false, false},
+	}
+	answers := "NOT EXISTS (SELECT 1 FROM comments answers WHERE answers.thread_id = t.id AND answers.deleted_at IS NULL AND answers.hidden_at IS NULL)"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlQuery, _ := buildQuery(Query{Unanswered: tt.unanswered, CategoryIDs: []int{1}, Limit: 10})
+			if got := strings.Contains(sqlQuery, answers); got != tt.want {
+				t.Errorf("query filters out threads with visible answers: %v, want %v\n%s", got, tt.want, sqlQuery)
+			}
+		})
+	}
+}
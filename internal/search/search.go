@@ -0,0 +1,90 @@
+// Package search finds threads and comments matching a text query.
+package search
+
+import (
+	"context"
+	"html"
+	"strings"
+	"time"
+)
+
+// Kinds of documents that can be searched
+const (
+	KindThread  = "thread"
+	KindComment = "comment"
+)
+
+// Markers placed around matched words in snippets before they are escaped.
+// They are in the Unicode private use area so they do not clash with user text.
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+// A search query with optional filters. Zero values mean no filter.
+type Query struct {
+	Terms       []Term
+	Tags        [][]int  // Matches documents in threads having at least one tag ID from every group
+	Authors     []string // Matches documents written by any of these users
+	In          string   // InTitle or InBody to search only thread titles or comments
+	From        time.Time
+	To          time.Time
+	Unanswered  bool  // Matches documents in threads without comments only
+	CategoryIDs []int // Matches documents in these categories only
+	Limit       int
+	Offset      int
+}
+
+type Result struct {
+	Kind      string    `json:"kind"`
+	ThreadID  int       `json:"thread_id"`
+	CommentID *int      `json:"comment_id"`
+	Title     string    `json:"title"`
+	Snippet   string    `json:"snippet"`
+	Rank      float64   `json:"rank"`
+	AuthorID  int       `json:"author_id"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Results struct {
+	Results []Result `json:"results"`
+	Total   int      `json:"total"`
+}
+
+// An Engine runs search queries
+type Engine interface {
+	Search(ctx context.Context, query Query) (Results, error)
+}
+
+// A document to be indexed. CommentID is 0 for a thread's own document.
+type Document struct {
+	Kind       string
+	ThreadID   int
+	CommentID  int
+	Title      string
+	Body       string
+	AuthorID   int
+	Author     string
+	Tags       []int
+	CategoryID int
+	CreatedAt  time.Time
+	Hidden     bool // Hidden by moderators, so never matched and not an answer to its thread
+}
+
+// An Indexer is an Engine that must be told about every change to the searchable
+// content, unlike engines that read the database directly
+type Indexer interface {
+	Engine
+	// Add or replace a document
+	Index(ctx context.Context, doc Document) error
+	// Remove a thread's documents, including its comments
+	RemoveThread(ctx context.Context, threadID int) error
+}
+
+// Escape a snippet for HTML and turn the highlight markers into <mark> tags
+func highlight(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}